@@ -0,0 +1,156 @@
+// Package audit keeps an append-only log of what was done to reservations,
+// by whom and when, for chargeback and incident review.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Actions recorded in the log.
+const (
+	Reserved      = "reserved"
+	Pending       = "pending"
+	Queued        = "queued"
+	Preempted     = "preempted"
+	Released      = "released"
+	ForceReleased = "force_released"
+	Expired       = "expired"
+	Renewed       = "renewed"
+)
+
+// Actions lists the actions recorded in the log.
+var Actions = []string{Reserved, Pending, Queued, Preempted, Released, ForceReleased, Expired, Renewed}
+
+// KnownAction reports whether action is one of Actions.
+func KnownAction(action string) bool {
+	for _, a := range Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// System is the actor of what the service does on its own, such as expiring
+// reservations or handing out queued ones.
+const System = "system"
+
+// Entry is one action on a reservation. Request is the topology it asked for
+// and Assignment the concrete testbed it got, if any.
+type Entry struct {
+	Time        time.Time         `json:"time"`
+	Action      string            `json:"action"`
+	Actor       string            `json:"actor"`
+	Reservation string            `json:"reservation"`
+	User        string            `json:"user,omitempty"`
+	Team        string            `json:"team,omitempty"`
+	Devices     []string          `json:"devices,omitempty"`
+	Ports       []string          `json:"ports,omitempty"`
+	Request     json.RawMessage   `json:"request,omitempty"`
+	Assignment  json.RawMessage   `json:"assignment,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+}
+
+// Filter selects entries. Zero fields match every entry; User matches the
+// actor as well as the owner of the reservation.
+type Filter struct {
+	Device      string
+	User        string
+	Reservation string
+	Action      string
+	Since       time.Time
+	Until       time.Time
+}
+
+// Matches reports whether an entry is selected by the filter.
+func (f Filter) Matches(e Entry) bool {
+	switch {
+	case f.User != "" && e.User != f.User && e.Actor != f.User:
+		return false
+	case f.Reservation != "" && e.Reservation != f.Reservation:
+		return false
+	case f.Action != "" && e.Action != f.Action:
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	}
+	if f.Device == "" {
+		return true
+	}
+	for _, d := range e.Devices {
+		if d == f.Device {
+			return true
+		}
+	}
+	return false
+}
+
+// Log is a file of entries, one JSON object per line. Entries are only ever
+// appended.
+type Log struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// Open opens the log at path, creating it if needed.
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{path: path, file: file}, nil
+}
+
+// Append writes an entry and syncs it to disk.
+func (l *Log) Append(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Scan calls each with the entries selected by the filter, oldest first,
+// until each returns false. Entries appended meanwhile are not scanned.
+func (l *Log) Scan(f Filter, each func(Entry) bool) error {
+	l.mu.Lock()
+	info, err := l.file.Stat()
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(io.LimitReader(file, info.Size()))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		e := Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("%s:%d: %v", l.path, line, err)
+		}
+		if f.Matches(e) && !each(e) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
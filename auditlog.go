@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"lablrs/audit"
+	"lablrs/events"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// auditLog records what is done to reservations. Nothing is recorded while
+// it is nil.
+var auditLog *audit.Log
+
+// recordReservation publishes an event of a reservation and records it in the
+// audit log as done by actor, the name of a principal or audit.System. A
+// release by someone else than the owner, or by the service once a preempted
+// reservation is out of its grace period, is recorded as forced. The caller
+// must hold inventoryMu.
+func recordReservation(typ, actor string, r *Reservation, details map[string]string) {
+	publishReservation(typ, r, details)
+	if auditLog == nil {
+		return
+	}
+	e := audit.Entry{
+		Action:      typ,
+		Actor:       actor,
+		Reservation: r.ID,
+		User:        ownerName(r),
+		Team:        r.Team,
+		Devices:     append([]string{}, r.Devices...),
+		Ports:       append([]string{}, r.Ports...),
+		Details:     details,
+	}
+	forced := actor != audit.System && (r.Owner == nil || actor != r.Owner.Name)
+	if typ == events.Released && (forced || actor == audit.System && r.PreemptedBy != "") {
+		e.Action = audit.ForceReleased
+	}
+	switch typ {
+	case events.Reserved, events.Pending:
+		e.Request, _ = json.Marshal(r.request)
+		e.Assignment, _ = json.Marshal(r.Testbed)
+	case events.Queued:
+		e.Request, _ = json.Marshal(r.request)
+	}
+	if err := auditLog.Append(e); err != nil {
+		log.Printf("Error recording %s of reservation %s in the audit log: %v", e.Action, r.ID, err)
+	}
+}
+
+// getAudit lists the audit log entries selected by the device, user,
+// reservation, action, since and until query parameters, times being RFC
+// 3339. With format=jsonl the entries are exported as JSON lines.
+func getAudit(c *gin.Context) {
+	filter := audit.Filter{
+		Device:      c.Query("device"),
+		User:        c.Query("user"),
+		Reservation: c.Query("reservation"),
+		Action:      c.Query("action"),
+	}
+	if filter.Action != "" && !audit.KnownAction(filter.Action) {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown action %q, expected one of %s", filter.Action, strings.Join(audit.Actions, ", "))})
+		return
+	}
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := c.Query(name); v != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: %q is not an RFC 3339 time", name, v)})
+				return
+			}
+		}
+	}
+	switch format := c.DefaultQuery("format", "json"); format {
+	case "json":
+		entries := []audit.Entry{}
+		err := auditLog.Scan(filter, func(e audit.Entry) bool {
+			entries = append(entries, e)
+			return true
+		})
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.IndentedJSON(http.StatusOK, entries)
+	case "jsonl":
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Header("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		c.Status(http.StatusOK)
+		encoder := json.NewEncoder(c.Writer)
+		err := auditLog.Scan(filter, func(e audit.Entry) bool {
+			return encoder.Encode(e) == nil
+		})
+		if err != nil {
+			log.Printf("Error exporting the audit log: %v", err)
+		}
+	default:
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown format %q, expected json or jsonl", format)})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"lablrs/audit"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGetAuditFiltersByKnownActions(t *testing.T) {
+	log, err := audit.Open(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := auditLog
+	auditLog = log
+	t.Cleanup(func() { auditLog = saved })
+	for _, action := range []string{audit.Reserved, audit.Renewed} {
+		if err := log.Append(audit.Entry{Action: action, Actor: "alice", Reservation: "r1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/audit", getAudit)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/audit?action=renewed", nil))
+	entries := []audit.Entry{}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &entries) != nil || len(entries) != 1 || entries[0].Action != audit.Renewed {
+		t.Errorf("GET /audit?action=renewed = %d %s, want the renewed entry", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/audit?action=renew", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("GET /audit?action=renew = %d %s, want 400", w.Code, w.Body)
+	}
+}
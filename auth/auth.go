@@ -0,0 +1,110 @@
+// Package auth identifies the callers of the API. Authenticators recognize
+// one kind of credentials each: static API tokens, TLS client certificates or
+// OIDC JWTs. The gin middleware attaches the resulting principal to the
+// request.
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrNoCredentials is returned by authenticators when the request carries
+// none of the credentials they handle.
+var ErrNoCredentials = errors.New("no credentials")
+
+// ErrNotAccepted is returned, wrapped, by authenticators finding credentials
+// of their kind they do not accept, such as an unknown or expired bearer
+// token. A chain then tries the other credentials of the request.
+var ErrNotAccepted = errors.New("credentials not accepted")
+
+// Principal is an authenticated caller.
+type Principal struct {
+	Name   string   `json:"name"`
+	Team   string   `json:"team,omitempty"`
+	Roles  []string `json:"roles,omitempty"`
+	Method string   `json:"method"`
+}
+
+// Anonymous is the principal of requests when no authenticator is configured.
+var Anonymous = &Principal{Name: "anonymous", Method: "none"}
+
+// Authenticator identifies the caller of a request. It returns
+// ErrNoCredentials when the request has no credentials of its kind, and
+// another error when the credentials are invalid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Chain tries each authenticator in turn until one accepts the credentials
+// of the request. Credentials not accepted, e.g. a stale bearer token sent
+// along with a client certificate, do not end the chain; when no
+// authenticator accepts any, the first refusal is returned.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (*Principal, error) {
+	var refused error
+	for _, a := range c {
+		p, err := a.Authenticate(r)
+		if err == ErrNoCredentials {
+			continue
+		}
+		if errors.Is(err, ErrNotAccepted) {
+			if refused == nil {
+				refused = err
+			}
+			continue
+		}
+		return p, err
+	}
+	if refused != nil {
+		return nil, refused
+	}
+	return nil, ErrNoCredentials
+}
+
+const principalKey = "principal"
+
+// Middleware authenticates every request and rejects those without valid
+// credentials. An empty chain lets every request through as Anonymous.
+func Middleware(chain Chain) gin.HandlerFunc {
+	if len(chain) == 0 {
+		log.Println("No authentication configured, API requests are anonymous")
+	}
+	return func(c *gin.Context) {
+		if len(chain) == 0 {
+			c.Set(principalKey, Anonymous)
+			return
+		}
+		p, err := chain.Authenticate(c.Request)
+		if err != nil {
+			if err == ErrNoCredentials {
+				c.Header("WWW-Authenticate", "Bearer")
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthenticated: " + err.Error()})
+			return
+		}
+		c.Set(principalKey, p)
+	}
+}
+
+// PrincipalOf returns the principal attached to a request by Middleware.
+func PrincipalOf(c *gin.Context) *Principal {
+	if p, ok := c.Get(principalKey); ok {
+		return p.(*Principal)
+	}
+	return Anonymous
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
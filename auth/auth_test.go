@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// request returns a request with the given bearer token, if any, and the
+// given client certificate common name, if any.
+func request(token, commonName string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	if commonName != "" {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName, OrganizationalUnit: []string{"core"}}}
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	return r
+}
+
+func TestChainFallsThroughRefusedCredentials(t *testing.T) {
+	tokens, err := NewTokens([]StaticToken{{Token: "secret", Name: "ci"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := Chain{tokens, ClientCerts{}}
+	for _, tc := range []struct {
+		name       string
+		token      string
+		commonName string
+		want       string
+		wantErr    error
+	}{
+		{name: "token", token: "secret", want: "ci"},
+		{name: "certificate", commonName: "alice", want: "alice"},
+		{name: "stale token and certificate", token: "stale", commonName: "alice", want: "alice"},
+		{name: "stale token", token: "stale", wantErr: ErrNotAccepted},
+		{name: "nothing", wantErr: ErrNoCredentials},
+	} {
+		p, err := chain.Authenticate(request(tc.token, tc.commonName))
+		switch {
+		case tc.wantErr != nil && !errors.Is(err, tc.wantErr):
+			t.Errorf("%s: got %v, %v, want %v", tc.name, p, err, tc.wantErr)
+		case tc.wantErr == nil && (err != nil || p.Name != tc.want):
+			t.Errorf("%s: got %v, %v, want %s", tc.name, p, err, tc.want)
+		}
+	}
+}
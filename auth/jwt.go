@@ -0,0 +1,251 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// JWTConfig configures the validation of OIDC JWTs. Tokens must be signed
+// with RS256 or ES256 by a key of the JWKS file. Issuer and Audience are
+// checked when set. The principal name is read from NameClaim, falling back
+// to "sub"; its team from TeamClaim, which may be a string or a list whose
+// first element is used; and its roles from RolesClaim.
+type JWTConfig struct {
+	JWKSFile   string `json:"jwks_file"`
+	Issuer     string `json:"issuer,omitempty"`
+	Audience   string `json:"audience,omitempty"`
+	NameClaim  string `json:"name_claim,omitempty"`
+	TeamClaim  string `json:"team_claim,omitempty"`
+	RolesClaim string `json:"roles_claim,omitempty"`
+}
+
+// JWT authenticates requests carrying a bearer JWT.
+type JWT struct {
+	config JWTConfig
+	keys   map[string]crypto.PublicKey
+}
+
+// clockSkew is the tolerance on the expiry and not-before times of tokens.
+const clockSkew = time.Minute
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// NewJWT reads the keys of the JWKS file of the configuration.
+func NewJWT(config JWTConfig) (*JWT, error) {
+	jsonData, err := os.ReadFile(config.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(jsonData, &set); err != nil {
+		return nil, fmt.Errorf("reading JWKS from %s: %v", config.JWKSFile, err)
+	}
+	j := &JWT{config: config, keys: map[string]crypto.PublicKey{}}
+	for i, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		pub, err := key.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("JWKS %s: key %d: %v", config.JWKSFile, i, err)
+		}
+		j.keys[key.Kid] = pub
+	}
+	if len(j.keys) == 0 {
+		return nil, fmt.Errorf("JWKS %s has no signing keys", config.JWKSFile)
+	}
+	if j.config.NameClaim == "" {
+		j.config.NameClaim = "sub"
+	}
+	return j, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !pub.Curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve P-256")
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (j *JWT) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok || strings.Count(token, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+	claims, err := j.verify(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT: %v: %w", err, ErrNotAccepted)
+	}
+	p := &Principal{Method: "jwt"}
+	p.Name, _ = claims[j.config.NameClaim].(string)
+	if p.Name == "" {
+		p.Name, _ = claims["sub"].(string)
+	}
+	if p.Name == "" {
+		return nil, fmt.Errorf("invalid JWT: no %q claim", j.config.NameClaim)
+	}
+	if j.config.TeamClaim != "" {
+		if teams := stringList(claims[j.config.TeamClaim]); len(teams) > 0 {
+			p.Team = teams[0]
+		}
+	}
+	if j.config.RolesClaim != "" {
+		p.Roles = stringList(claims[j.config.RolesClaim])
+	}
+	return p, nil
+}
+
+// verify checks the signature and the registered claims of a token and
+// returns its claims.
+func (j *JWT) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %v", err)
+	}
+	key, ok := j.keys[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %v", err)
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("algorithm %q does not match RSA key %q", header.Alg, header.Kid)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig); err != nil {
+			return nil, fmt.Errorf("bad signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" {
+			return nil, fmt.Errorf("algorithm %q does not match EC key %q", header.Alg, header.Kid)
+		}
+		if len(sig) != 64 {
+			return nil, fmt.Errorf("bad signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, hash[:], r, s) {
+			return nil, fmt.Errorf("bad signature")
+		}
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims: %v", err)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, fmt.Errorf("expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("not valid yet")
+	}
+	if j.config.Issuer != "" && claims["iss"] != j.config.Issuer {
+		return nil, fmt.Errorf("issuer %v is not %q", claims["iss"], j.config.Issuer)
+	}
+	if j.config.Audience != "" && !contains(stringList(claims["aud"]), j.config.Audience) {
+		return nil, fmt.Errorf("audience %v does not include %q", claims["aud"], j.config.Audience)
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// stringList reads a claim holding a string or a list of strings.
+func stringList(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := []string{}
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func segment(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return b64(b)
+}
+
+// signer signs tokens with a generated key.
+type signer struct {
+	kid string
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func (s signer) jwk() map[string]string {
+	if s.rsa != nil {
+		return map[string]string{"kty": "RSA", "kid": s.kid, "use": "sig", "n": b64(s.rsa.N.Bytes()), "e": b64(big.NewInt(int64(s.rsa.E)).Bytes())}
+	}
+	return map[string]string{"kty": "EC", "kid": s.kid, "crv": "P-256", "x": b64(s.ec.X.FillBytes(make([]byte, 32))), "y": b64(s.ec.Y.FillBytes(make([]byte, 32)))}
+}
+
+// token returns a token of the claims with the given header, signed by s.
+func (s signer) token(t *testing.T, header map[string]string, claims map[string]interface{}) string {
+	t.Helper()
+	signed := segment(header) + "." + segment(claims)
+	hash := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch {
+	case header["alg"] == "none":
+	case header["alg"] == "HS256":
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case s.rsa != nil:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, s.rsa, crypto.SHA256, hash[:])
+	default:
+		var r, ss *big.Int
+		r, ss, err = ecdsa.Sign(rand.Reader, s.ec, hash[:])
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+// newSigners generates an RSA and an ECDSA key and a JWT authenticator
+// trusting both.
+func newSigners(t *testing.T) (signer, signer, *JWT) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, es := signer{kid: "rsa1", rsa: rsaKey}, signer{kid: "ec1", ec: ecKey}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	content, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{rs.jwk(), es.jwk()}})
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	j, err := NewJWT(JWTConfig{JWKSFile: path, Issuer: "https://idp", Audience: "lrs", TeamClaim: "groups", RolesClaim: "roles"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs, es, j
+}
+
+func TestJWT(t *testing.T) {
+	rs, es, j := newSigners(t)
+	now := time.Now().Unix()
+	claims := func(change map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "alice", "iss": "https://idp", "aud": []string{"lrs", "other"}, "exp": now + 3600, "groups": []string{"core"}, "roles": []string{"lead"}}
+		for k, v := range change {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+	// tampered gives a token the claims of mallory, keeping its signature.
+	tampered := func(token string) string {
+		parts := strings.Split(token, ".")
+		return parts[0] + "." + segment(claims(map[string]interface{}{"sub": "mallory"})) + "." + parts[2]
+	}
+	rsHeader := map[string]string{"alg": "RS256", "kid": "rsa1"}
+	esHeader := map[string]string{"alg": "ES256", "kid": "ec1"}
+	for _, tc := range []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{name: "RS256", token: rs.token(t, rsHeader, claims(nil))},
+		{name: "ES256", token: es.token(t, esHeader, claims(nil))},
+		{name: "audience string", token: rs.token(t, rsHeader, claims(map[string]interface{}{"aud": "lrs"}))},
+		{name: "tampered RSA claims", token: tampered(rs.token(t, rsHeader, claims(nil))), wantErr: "bad signature"},
+		{name: "tampered EC claims", token: tampered(es.token(t, esHeader, claims(nil))), wantErr: "bad signature"},
+		{name: "RSA signed by another key", token: signer{kid: "rsa1", rsa: mustRSA(t)}.token(t, rsHeader, claims(nil)), wantErr: "bad signature"},
+		{name: "EC signed by another key", token: signer{kid: "ec1", ec: mustEC(t)}.token(t, esHeader, claims(nil)), wantErr: "bad signature"},
+		{name: "wrong kid", token: rs.token(t, map[string]string{"alg": "RS256", "kid": "rsa2"}, claims(nil)), wantErr: `unknown key "rsa2"`},
+		{name: "kid of the other key", token: rs.token(t, map[string]string{"alg": "ES256", "kid": "ec1"}, claims(nil)), wantErr: "bad signature"},
+		{name: "expired", token: rs.token(t, rsHeader, claims(map[string]interface{}{"exp": now - 3600})), wantErr: "expired"},
+		{name: "expired within skew", token: rs.token(t, rsHeader, claims(map[string]interface{}{"exp": now - 10}))},
+		{name: "no exp", token: rs.token(t, rsHeader, claims(map[string]interface{}{"exp": nil})), wantErr: "no expiry"},
+		{name: "before nbf", token: rs.token(t, rsHeader, claims(map[string]interface{}{"nbf": now + 3600})), wantErr: "not valid yet"},
+		{name: "wrong iss", token: rs.token(t, rsHeader, claims(map[string]interface{}{"iss": "https://evil"})), wantErr: "issuer"},
+		{name: "no iss", token: rs.token(t, rsHeader, claims(map[string]interface{}{"iss": nil})), wantErr: "issuer"},
+		{name: "wrong aud", token: rs.token(t, rsHeader, claims(map[string]interface{}{"aud": "other"})), wantErr: "audience"},
+		{name: "alg none", token: rs.token(t, map[string]string{"alg": "none", "kid": "rsa1"}, claims(nil)), wantErr: `algorithm "none"`},
+		{name: "HS256", token: rs.token(t, map[string]string{"alg": "HS256", "kid": "rsa1"}, claims(nil)), wantErr: `algorithm "HS256"`},
+		{name: "ES256 header on RSA key", token: es.token(t, map[string]string{"alg": "ES256", "kid": "rsa1"}, claims(nil)), wantErr: `algorithm "ES256"`},
+		{name: "no subject", token: rs.token(t, rsHeader, claims(map[string]interface{}{"sub": nil})), wantErr: "no \"sub\" claim"},
+	} {
+		p, err := j.Authenticate(request(tc.token, ""))
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+			} else if p.Name != "alice" || p.Team != "core" || len(p.Roles) != 1 || p.Roles[0] != "lead" || p.Method != "jwt" {
+				t.Errorf("%s: principal %+v", tc.name, p)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got %v, %v, want an error with %q", tc.name, p, err, tc.wantErr)
+		} else if tc.wantErr != "no \"sub\" claim" && !errors.Is(err, ErrNotAccepted) {
+			t.Errorf("%s: %v is not ErrNotAccepted", tc.name, err)
+		}
+	}
+}
+
+func mustRSA(t *testing.T) *rsa.PrivateKey {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func mustEC(t *testing.T) *ecdsa.PrivateKey {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestJWTLeavesOtherTokens(t *testing.T) {
+	_, _, j := newSigners(t)
+	for _, token := range []string{"", "static-token"} {
+		if _, err := j.Authenticate(request(token, "")); err != ErrNoCredentials {
+			t.Errorf("token %q: got %v, want ErrNoCredentials", token, err)
+		}
+	}
+}
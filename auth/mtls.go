@@ -0,0 +1,29 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ClientCerts authenticates requests by the TLS client certificate verified
+// by the server. The principal is named after the certificate common name and
+// belongs to the team of its first organizational unit.
+type ClientCerts struct{}
+
+func (ClientCerts) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	p := &Principal{Name: cert.Subject.CommonName, Method: "mtls"}
+	if p.Name == "" && len(cert.DNSNames) > 0 {
+		p.Name = cert.DNSNames[0]
+	}
+	if p.Name == "" {
+		return nil, fmt.Errorf("client certificate has no common name")
+	}
+	if len(cert.Subject.OrganizationalUnit) > 0 {
+		p.Team = cert.Subject.OrganizationalUnit[0]
+	}
+	return p, nil
+}
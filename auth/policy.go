@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Permissions granted by roles.
+const (
+	// PermRead allows listing reservations, templates, the queue and usage.
+	PermRead = "read"
+	// PermReserve allows reserving testbeds.
+	PermReserve = "reserve"
+	// PermReleaseOwn allows releasing reservations of the principal.
+	PermReleaseOwn = "release-own"
+	// PermReleaseTeam allows releasing reservations of the principal's team.
+	PermReleaseTeam = "release-team"
+	// PermReleaseAny allows force-releasing any reservation.
+	PermReleaseAny = "release-any"
+	// PermTemplates allows creating, updating and deleting templates.
+	PermTemplates = "templates"
+	// PermDrain allows draining devices for maintenance.
+	PermDrain = "drain"
+	// PermRefresh allows reloading the inventory from NetBox.
+	PermRefresh = "inventory-refresh"
+	// PermAudit allows reading the audit log.
+	PermAudit = "audit"
+	// PermAll grants every permission.
+	PermAll = "*"
+)
+
+// builtinRoles are available to every policy, which may redefine them.
+var builtinRoles = map[string][]string{
+	"user":  {PermRead, PermReserve, PermReleaseOwn},
+	"lead":  {PermRead, PermReserve, PermReleaseOwn, PermReleaseTeam, PermTemplates, PermAudit},
+	"admin": {PermAll},
+}
+
+// Policy maps principals to roles, and roles to permissions. A principal has
+// the roles of its credentials, of the bindings naming it or its team, and
+// the default roles. Pools restrict devices, or some of their ports, to some
+// principals.
+type Policy struct {
+	Roles        map[string][]string `json:"roles,omitempty"`
+	Bindings     []Binding           `json:"bindings,omitempty"`
+	DefaultRoles []string            `json:"default_roles,omitempty"`
+	Pools        []Pool              `json:"pools,omitempty"`
+}
+
+// Binding grants roles to a principal, by name, or to every member of a team.
+type Binding struct {
+	Principal string   `json:"principal,omitempty"`
+	Team      string   `json:"team,omitempty"`
+	Roles     []string `json:"roles"`
+}
+
+// Pool is a set of devices, and optionally of their ports, reserved to some
+// principals, teams and roles. A device is in the pool when it has all of
+// DeviceAttributes. Without PortAttributes the whole device is in the pool,
+// otherwise only its ports with all of PortAttributes are. For instance only
+// the perf team may use the 400G ports of ATEs with
+//
+//	{"name": "400g-ate", "device_attributes": {"type": "ATE"},
+//	 "port_attributes": {"speed": "speed_400_gbps"}, "teams": ["perf"]}
+type Pool struct {
+	Name             string            `json:"name"`
+	DeviceAttributes map[string]string `json:"device_attributes"`
+	PortAttributes   map[string]string `json:"port_attributes,omitempty"`
+	Principals       []string          `json:"principals,omitempty"`
+	Teams            []string          `json:"teams,omitempty"`
+	Roles            []string          `json:"roles,omitempty"`
+}
+
+// LoadPolicy reads a policy file and checks that it only refers to known
+// roles and permissions.
+func LoadPolicy(path string) (*Policy, error) {
+	jsonData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err := json.Unmarshal(jsonData, p); err != nil {
+		return nil, fmt.Errorf("reading policy from %s: %v", path, err)
+	}
+	known := map[string]bool{}
+	for _, perm := range []string{PermRead, PermReserve, PermReleaseOwn, PermReleaseTeam, PermReleaseAny, PermTemplates, PermDrain, PermRefresh, PermAudit, PermAll} {
+		known[perm] = true
+	}
+	for role, perms := range p.Roles {
+		for _, perm := range perms {
+			if !known[perm] {
+				return nil, fmt.Errorf("policy %s: role %q has unknown permission %q", path, role, perm)
+			}
+		}
+	}
+	roles := append([]string{}, p.DefaultRoles...)
+	for _, b := range p.Bindings {
+		if b.Principal == "" && b.Team == "" {
+			return nil, fmt.Errorf("policy %s: binding of roles %v names neither principal nor team", path, b.Roles)
+		}
+		roles = append(roles, b.Roles...)
+	}
+	for _, pool := range p.Pools {
+		if len(pool.DeviceAttributes) == 0 {
+			return nil, fmt.Errorf("policy %s: pool %q has no device attributes", path, pool.Name)
+		}
+		roles = append(roles, pool.Roles...)
+	}
+	for _, role := range roles {
+		if p.permissions(role) == nil {
+			return nil, fmt.Errorf("policy %s: unknown role %q", path, role)
+		}
+	}
+	return p, nil
+}
+
+func (p *Policy) permissions(role string) []string {
+	if perms, ok := p.Roles[role]; ok {
+		return perms
+	}
+	return builtinRoles[role]
+}
+
+// RolesOf lists the roles of a principal.
+func (p *Policy) RolesOf(principal *Principal) []string {
+	roles := append([]string{}, principal.Roles...)
+	for _, b := range p.Bindings {
+		if (b.Principal != "" && b.Principal == principal.Name) || (b.Team != "" && b.Team == principal.Team) {
+			roles = append(roles, b.Roles...)
+		}
+	}
+	return append(roles, p.DefaultRoles...)
+}
+
+// Allowed reports whether a principal has one of the permissions. A nil
+// policy allows everything.
+func (p *Policy) Allowed(principal *Principal, perms ...string) bool {
+	if p == nil {
+		return true
+	}
+	for _, role := range p.RolesOf(principal) {
+		for _, granted := range p.permissions(role) {
+			if granted == PermAll || contains(perms, granted) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Require returns a middleware rejecting principals without the permission.
+func Require(p *Policy, perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := PrincipalOf(c)
+		if !p.Allowed(principal, perm) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%q lacks the %q permission", principal.Name, perm)})
+		}
+	}
+}
+
+// DeniedPools lists the pools the principal may not use. A nil policy has no
+// pools.
+func (p *Policy) DeniedPools(principal *Principal) []Pool {
+	if p == nil {
+		return nil
+	}
+	denied := []Pool{}
+	roles := p.RolesOf(principal)
+	for _, pool := range p.Pools {
+		if contains(pool.Principals, principal.Name) || (principal.Team != "" && contains(pool.Teams, principal.Team)) {
+			continue
+		}
+		admitted := false
+		for _, role := range roles {
+			admitted = admitted || contains(pool.Roles, role)
+		}
+		if !admitted {
+			denied = append(denied, pool)
+		}
+	}
+	return denied
+}
+
+// HasDevice reports whether a device with the given attributes is in the
+// pool, at least in part.
+func (pool Pool) HasDevice(attrs map[string]string) bool {
+	return matches(pool.DeviceAttributes, attrs)
+}
+
+// WholeDevice reports whether the pool holds whole devices rather than some
+// of their ports.
+func (pool Pool) WholeDevice() bool {
+	return len(pool.PortAttributes) == 0
+}
+
+// HasPort reports whether a port of a device of the pool is in the pool.
+func (pool Pool) HasPort(attrs map[string]string) bool {
+	return pool.WholeDevice() || matches(pool.PortAttributes, attrs)
+}
+
+func matches(want, attrs map[string]string) bool {
+	for k, v := range want {
+		if attrs[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadPolicy(t *testing.T, content string) (*Policy, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadPolicy(path)
+}
+
+func TestPolicyAllowed(t *testing.T) {
+	p, err := loadPolicy(t, `{
+		"bindings": [
+			{"principal": "lee", "roles": ["lead"]},
+			{"team": "infra", "roles": ["admin"]}
+		],
+		"default_roles": ["user"]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &Principal{Name: "alice", Team: "core"}
+	lead := &Principal{Name: "lee", Team: "core"}
+	admin := &Principal{Name: "ops", Team: "infra"}
+	tokenAdmin := &Principal{Name: "ci", Roles: []string{"admin"}}
+	for _, tc := range []struct {
+		principal *Principal
+		perm      string
+		want      bool
+	}{
+		{user, PermRead, true},
+		{user, PermReserve, true},
+		{user, PermReleaseOwn, true},
+		{user, PermReleaseTeam, false},
+		{user, PermReleaseAny, false},
+		{user, PermTemplates, false},
+		{user, PermAudit, false},
+		{lead, PermReleaseTeam, true},
+		{lead, PermTemplates, true},
+		{lead, PermAudit, true},
+		{lead, PermReleaseAny, false},
+		{lead, PermDrain, false},
+		{admin, PermReleaseAny, true},
+		{admin, PermDrain, true},
+		{admin, PermRefresh, true},
+		{tokenAdmin, PermDrain, true},
+	} {
+		if got := p.Allowed(tc.principal, tc.perm); got != tc.want {
+			t.Errorf("%s allowed %s = %v, want %v", tc.principal.Name, tc.perm, got, tc.want)
+		}
+	}
+	var none *Policy
+	if !none.Allowed(user, PermReleaseAny) {
+		t.Error("a nil policy denies a permission")
+	}
+}
+
+func TestPolicyRedefinedRole(t *testing.T) {
+	p, err := loadPolicy(t, `{"roles": {"user": ["read"]}, "default_roles": ["user"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Allowed(&Principal{Name: "alice"}, PermReserve) {
+		t.Error("redefined user role still allows reserving")
+	}
+}
+
+func TestPolicyPools(t *testing.T) {
+	p, err := loadPolicy(t, `{
+		"bindings": [{"principal": "lee", "roles": ["lead"]}],
+		"pools": [
+			{"name": "400g-ate", "device_attributes": {"type": "ATE"}, "port_attributes": {"speed": "speed_400_gbps"}, "teams": ["perf"]},
+			{"name": "lab-a", "device_attributes": {"site": "a"}, "principals": ["alice"], "roles": ["lead"]}
+		]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	denied := func(principal *Principal) []string {
+		names := []string{}
+		for _, pool := range p.DeniedPools(principal) {
+			names = append(names, pool.Name)
+		}
+		return names
+	}
+	for _, tc := range []struct {
+		principal *Principal
+		want      []string
+	}{
+		{&Principal{Name: "bob", Team: "core"}, []string{"400g-ate", "lab-a"}},
+		{&Principal{Name: "pat", Team: "perf"}, []string{"lab-a"}},
+		{&Principal{Name: "alice", Team: "core"}, []string{"400g-ate"}},
+		{&Principal{Name: "lee", Team: "core"}, []string{"400g-ate"}},
+	} {
+		got := denied(tc.principal)
+		if len(got) != len(tc.want) || (len(got) > 0 && got[0] != tc.want[0]) {
+			t.Errorf("pools denied to %s = %v, want %v", tc.principal.Name, got, tc.want)
+		}
+	}
+	ate := p.Pools[0]
+	if !ate.HasDevice(map[string]string{"type": "ATE", "vendor": "IXIA"}) || ate.HasDevice(map[string]string{"type": "DUT"}) {
+		t.Error("400g-ate pool does not match ATEs only")
+	}
+	if ate.WholeDevice() || !ate.HasPort(map[string]string{"speed": "speed_400_gbps"}) || ate.HasPort(map[string]string{"speed": "speed_100_gbps"}) {
+		t.Error("400g-ate pool does not hold only the 400G ports")
+	}
+}
+
+func TestLoadPolicyRejectsUnknownNames(t *testing.T) {
+	for _, content := range []string{
+		`{"roles": {"ops": ["reboot"]}}`,
+		`{"default_roles": ["superuser"]}`,
+		`{"bindings": [{"roles": ["user"]}]}`,
+		`{"pools": [{"name": "empty"}]}`,
+	} {
+		if _, err := loadPolicy(t, content); err == nil {
+			t.Errorf("LoadPolicy(%s) succeeded", content)
+		}
+	}
+}
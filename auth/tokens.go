@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// StaticToken is an API token and the principal it stands for. The token is
+// given either in clear or, preferably, as the hex SHA-256 of its value.
+type StaticToken struct {
+	Token  string   `json:"token,omitempty"`
+	SHA256 string   `json:"sha256,omitempty"`
+	Name   string   `json:"name"`
+	Team   string   `json:"team,omitempty"`
+	Roles  []string `json:"roles,omitempty"`
+}
+
+// Tokens authenticates requests carrying one of a fixed set of bearer tokens.
+type Tokens struct {
+	tokens []StaticToken
+	hashes [][]byte
+}
+
+// LoadTokens reads a JSON list of StaticToken.
+func LoadTokens(path string) (*Tokens, error) {
+	jsonData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := []StaticToken{}
+	if err := json.Unmarshal(jsonData, &tokens); err != nil {
+		return nil, fmt.Errorf("reading tokens from %s: %v", path, err)
+	}
+	return NewTokens(tokens)
+}
+
+func NewTokens(tokens []StaticToken) (*Tokens, error) {
+	t := &Tokens{tokens: tokens}
+	for i, token := range tokens {
+		if token.Name == "" {
+			return nil, fmt.Errorf("token %d has no name", i)
+		}
+		switch {
+		case token.SHA256 != "":
+			hash, err := hex.DecodeString(strings.TrimSpace(token.SHA256))
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("token of %q: sha256 must be 64 hex digits", token.Name)
+			}
+			t.hashes = append(t.hashes, hash)
+		case token.Token != "":
+			hash := sha256.Sum256([]byte(token.Token))
+			t.hashes = append(t.hashes, hash[:])
+		default:
+			return nil, fmt.Errorf("token of %q has neither token nor sha256", token.Name)
+		}
+	}
+	return t, nil
+}
+
+func (t *Tokens) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := bearerToken(r)
+	// JWTs are left to the JWT authenticator
+	if !ok || strings.Count(token, ".") == 2 {
+		return nil, ErrNoCredentials
+	}
+	hash := sha256.Sum256([]byte(token))
+	for i, known := range t.hashes {
+		if subtle.ConstantTimeCompare(hash[:], known) == 1 {
+			st := t.tokens[i]
+			return &Principal{Name: st.Name, Team: st.Team, Roles: st.Roles, Method: "token"}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown API token: %w", ErrNotAccepted)
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestTokens(t *testing.T) {
+	hash := sha256.Sum256([]byte("hashed-secret"))
+	tokens, err := NewTokens([]StaticToken{
+		{Token: "clear-secret", Name: "ci", Team: "infra", Roles: []string{"admin"}},
+		{SHA256: hex.EncodeToString(hash[:]), Name: "bot", Team: "core"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		token   string
+		want    string
+		wantErr error
+	}{
+		{token: "clear-secret", want: "ci"},
+		{token: "hashed-secret", want: "bot"},
+		// The hash itself is not a token.
+		{token: hex.EncodeToString(hash[:]), wantErr: ErrNotAccepted},
+		{token: "clear-secre", wantErr: ErrNotAccepted},
+		{token: "a.b.c", wantErr: ErrNoCredentials},
+		{wantErr: ErrNoCredentials},
+	} {
+		p, err := tokens.Authenticate(request(tc.token, ""))
+		switch {
+		case tc.wantErr != nil && !errors.Is(err, tc.wantErr):
+			t.Errorf("token %q: got %v, %v, want %v", tc.token, p, err, tc.wantErr)
+		case tc.wantErr == nil && (err != nil || p.Name != tc.want || p.Method != "token"):
+			t.Errorf("token %q: got %v, %v, want %s", tc.token, p, err, tc.want)
+		}
+	}
+}
+
+func TestNewTokensRejectsBadEntries(t *testing.T) {
+	for _, token := range []StaticToken{
+		{Token: "secret"},
+		{Name: "ci"},
+		{SHA256: "abcd", Name: "ci"},
+		{SHA256: "zz" + hex.EncodeToString(make([]byte, 31)), Name: "ci"},
+	} {
+		if _, err := NewTokens([]StaticToken{token}); err == nil {
+			t.Errorf("NewTokens(%+v) succeeded", token)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Package cleanup runs release hooks on the devices of a released
+// reservation, such as restoring a golden configuration on DUTs or clearing
+// the sessions of ATEs, before they are given out again.
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lablrs/health"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Device is a device to clean up, with the reservation that released it.
+type Device struct {
+	Name        string
+	Attrs       map[string]string
+	Services    []health.Service
+	Reservation string
+}
+
+// Target returns the device as a target of the health package, e.g. for
+// gNMI calls.
+func (d Device) Target() health.Target {
+	return health.Target{Device: d.Name, Services: d.Services}
+}
+
+// service returns the host:port of a service of the device.
+func (d Device) service(name string) (string, bool) {
+	for _, svc := range d.Services {
+		if strings.EqualFold(svc.Name, name) {
+			return net.JoinHostPort(svc.Address, strconv.Itoa(svc.Port)), true
+		}
+	}
+	return "", false
+}
+
+// ErrSkipped is returned, possibly wrapped, by hooks with nothing to do on a
+// device, e.g. one without the service they use. The device is not failed.
+var ErrSkipped = errors.New("hook skipped")
+
+// Hook cleans up a device. It returns nil once the device is fit to be given
+// out again.
+type Hook interface {
+	Run(ctx context.Context, d Device) error
+}
+
+// HookFunc adapts a function to the Hook interface.
+type HookFunc func(ctx context.Context, d Device) error
+
+func (f HookFunc) Run(ctx context.Context, d Device) error {
+	return f(ctx, d)
+}
+
+// Rule runs a hook on the devices of the given types, or on every device
+// when Types is empty.
+type Rule struct {
+	Name  string
+	Types []string
+	Hook  Hook
+}
+
+func (r Rule) matches(d Device) bool {
+	if len(r.Types) == 0 {
+		return true
+	}
+	for _, t := range r.Types {
+		if strings.EqualFold(t, d.Attrs["type"]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Runner runs the hooks of the rules matching a device, in order, within
+// Timeout.
+type Runner struct {
+	Rules   []Rule
+	Timeout time.Duration
+}
+
+// Needed reports whether any hook applies to the device.
+func (r *Runner) Needed(d Device) bool {
+	for _, rule := range r.Rules {
+		if rule.matches(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run runs the hooks of a device and stops at the first that fails. Skipped
+// hooks are logged.
+func (r *Runner) Run(ctx context.Context, d Device) error {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+	for _, rule := range r.Rules {
+		if !rule.matches(d) {
+			continue
+		}
+		err := rule.Hook.Run(ctx, d)
+		if errors.Is(err, ErrSkipped) {
+			log.Printf("Cleanup of %s: %s skipped: %v", d.Name, rule.Name, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", rule.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"lablrs/health"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunSkipsHooksWithoutService(t *testing.T) {
+	ran := []string{}
+	record := func(name string) HookFunc {
+		return func(ctx context.Context, d Device) error {
+			ran = append(ran, name)
+			return nil
+		}
+	}
+	r := &Runner{Timeout: time.Second, Rules: []Rule{
+		{Name: "golden configuration", Types: []string{"DUT"}, Hook: GoldenConfig{Client: health.GNMI{}, Dir: t.TempDir()}},
+		{Name: "ATE session clear", Types: []string{"ATE", "TGEN"}, Hook: OTGClear{}},
+		{Name: "script", Hook: record("script")},
+	}}
+	for _, d := range []Device{
+		{Name: "dut1", Attrs: map[string]string{"type": "DUT"}},
+		{Name: "ate1", Attrs: map[string]string{"type": "ATE"}},
+		{Name: "tgen1", Attrs: map[string]string{"type": "TGEN"}},
+	} {
+		if err := r.Run(context.Background(), d); err != nil {
+			t.Errorf("Run(%s) = %v, want the hook skipped", d.Name, err)
+		}
+	}
+	if len(ran) != 3 {
+		t.Errorf("later hooks ran %d times, want 3", len(ran))
+	}
+}
+
+func TestRunStopsAtFailure(t *testing.T) {
+	ran := false
+	r := &Runner{Timeout: time.Second, Rules: []Rule{
+		{Name: "golden configuration", Hook: GoldenConfig{Dir: t.TempDir()}},
+		{Name: "script", Hook: HookFunc(func(ctx context.Context, d Device) error { ran = true; return nil })},
+	}}
+	d := Device{Name: "dut1", Services: []health.Service{{Name: "gnmi", Address: "127.0.0.1", Port: 9339}}}
+	err := r.Run(context.Background(), d)
+	if err == nil || !strings.Contains(err.Error(), "no golden configuration") || errors.Is(err, ErrSkipped) {
+		t.Errorf("Run = %v, want a missing golden configuration to fail", err)
+	}
+	if ran {
+		t.Error("hooks ran after a failure")
+	}
+}
+
+func TestScriptEnvironment(t *testing.T) {
+	t.Setenv("LRS_NETBOX_TOKEN", "secret")
+	out := filepath.Join(t.TempDir(), "env")
+	script := filepath.Join(t.TempDir(), "cleanup.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nenv > "+out+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	d := Device{
+		Name:        "dut1",
+		Attrs:       map[string]string{"vendor": "ARISTA"},
+		Services:    []health.Service{{Name: "gnmi", Address: "192.0.2.1", Port: 9339}},
+		Reservation: "r1",
+	}
+	if err := (Script{Path: script}).Run(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := string(content)
+	for _, want := range []string{"LRS_DEVICE=dut1\n", "LRS_RESERVATION=r1\n", "LRS_DEVICE_VENDOR=ARISTA\n", "LRS_SERVICE_GNMI=192.0.2.1:9339\n", "PATH="} {
+		if !strings.Contains(env, want) {
+			t.Errorf("script environment lacks %q:\n%s", want, env)
+		}
+	}
+	if strings.Contains(env, "secret") {
+		t.Errorf("script environment has the secrets of the service:\n%s", env)
+	}
+}
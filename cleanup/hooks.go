@@ -0,0 +1,100 @@
+package cleanup
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lablrs/health"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Script runs an executable with the device name as argument. The device is
+// also described by the environment: LRS_DEVICE, LRS_RESERVATION,
+// LRS_DEVICE_<ATTRIBUTE> for its attributes and LRS_SERVICE_<NAME> for the
+// host:port of its services. Apart from PATH, nothing of the environment of
+// the service, such as its secrets, is passed on.
+type Script struct {
+	Path string
+}
+
+func (s Script) Run(ctx context.Context, d Device) error {
+	cmd := exec.CommandContext(ctx, s.Path, d.Name)
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "LRS_DEVICE=" + d.Name, "LRS_RESERVATION=" + d.Reservation}
+	for k, v := range d.Attrs {
+		cmd.Env = append(cmd.Env, "LRS_DEVICE_"+envName(k)+"="+v)
+	}
+	for _, svc := range d.Services {
+		cmd.Env = append(cmd.Env, "LRS_SERVICE_"+envName(svc.Name)+"="+net.JoinHostPort(svc.Address, strconv.Itoa(svc.Port)))
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v: %s", s.Path, err, lastLine(out))
+	}
+	return nil
+}
+
+func envName(s string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_", " ", "_").Replace(s))
+}
+
+func lastLine(out []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return lines[len(lines)-1]
+}
+
+// GoldenConfig replaces the configuration of a DUT with its golden
+// configuration, the JSON IETF file named after the device in Dir, with a
+// gNMI Set. Devices without a gNMI service are skipped.
+type GoldenConfig struct {
+	Client health.GNMI
+	Dir    string
+}
+
+func (g GoldenConfig) Run(ctx context.Context, d Device) error {
+	if _, ok := d.service("gnmi"); !ok {
+		return fmt.Errorf("no gNMI service: %w", ErrSkipped)
+	}
+	config, err := ioutil.ReadFile(filepath.Join(g.Dir, d.Name+".json"))
+	if err != nil {
+		return fmt.Errorf("no golden configuration: %v", err)
+	}
+	return g.Client.Replace(ctx, d.Target(), config)
+}
+
+// OTGClear clears the sessions of an ATE by pushing an empty configuration to
+// its OTG service over HTTPS. Devices without an OTG service are skipped.
+type OTGClear struct {
+	InsecureSkipVerify bool
+}
+
+func (o OTGClear) Run(ctx context.Context, d Device) error {
+	addr, ok := d.service("otg")
+	if !ok {
+		return fmt.Errorf("no OTG service: %w", ErrSkipped)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://"+addr+"/config", bytes.NewBufferString("{}"))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("OTG config reset failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	opb "github.com/openconfig/ondatra/proto"
+	"google.golang.org/protobuf/encoding/prototext"
+)
+
+// Files written for Ondatra tests, to pass as -testbed and -binding.
+const (
+	testbedFile = "testbed.textproto"
+	bindingFile = "binding.textproto"
+)
+
+// vendorAliases maps inventory vendors to Ondatra vendors of another name.
+var vendorAliases = map[string]string{"KEYSIGHT": "IXIA"}
+
+// isATE reports whether an assigned device is a traffic generator.
+func isATE(d device) bool {
+	switch strings.ToUpper(d.Attrs["type"]) {
+	case "ATE", "TGEN", "OTG":
+		return true
+	}
+	return false
+}
+
+func ondatraVendor(vendor string) opb.Device_Vendor {
+	vendor = strings.ToUpper(vendor)
+	if alias, ok := vendorAliases[vendor]; ok {
+		vendor = alias
+	}
+	return opb.Device_Vendor(opb.Device_Vendor_value[vendor])
+}
+
+// ondatraSpeed converts an inventory speed, such as speed_100_gbps.
+func ondatraSpeed(speed string) opb.Port_Speed {
+	var gbps int
+	if _, err := fmt.Sscanf(speed, "speed_%d_gbps", &gbps); err != nil {
+		return opb.Port_SPEED_UNSPECIFIED
+	}
+	return opb.Port_Speed(opb.Port_Speed_value[fmt.Sprintf("S_%dGB", gbps)])
+}
+
+// localName strips the device from a "device:port" name.
+func localName(device, name string) string {
+	return strings.TrimPrefix(name, device+":")
+}
+
+// ondatraTestbed describes the requested topology of a testbed for Ondatra,
+// with the devices and ports named as in the request.
+func ondatraTestbed(tb testbed) *opb.Testbed {
+	out := &opb.Testbed{}
+	requested := map[string]string{}
+	for _, id := range sortedKeys(tb.Devices) {
+		d := tb.Devices[id]
+		dev := &opb.Device{Id: id, Vendor: ondatraVendor(d.Attrs["vendor"])}
+		if model := d.Attrs["model"]; model != "" {
+			dev.HardwareModelValue = &opb.Device_HardwareModel{HardwareModel: model}
+		}
+		for _, portID := range sortedKeys(d.Ports) {
+			p := d.Ports[portID]
+			dev.Ports = append(dev.Ports, &opb.Port{Id: localName(id, portID), Speed: ondatraSpeed(p.Attrs["speed"])})
+			requested[p.Name] = id + ":" + localName(id, portID)
+		}
+		if isATE(d) {
+			out.Ates = append(out.Ates, dev)
+		} else {
+			out.Duts = append(out.Duts, dev)
+		}
+	}
+	for _, l := range tb.Links {
+		out.Links = append(out.Links, &opb.Link{A: requested[l.Src], B: requested[l.Dst]})
+	}
+	return out
+}
+
+// staticBinding binds the requested devices and ports of a testbed to the
+// assigned ones, in the format of the static binding of featureprofiles.
+func staticBinding(tb testbed) string {
+	var b strings.Builder
+	for _, id := range sortedKeys(tb.Devices) {
+		d := tb.Devices[id]
+		kind := "dut"
+		if isATE(d) {
+			kind = "ate"
+		}
+		fmt.Fprintf(&b, "%s {\n  id: %q\n  name: %q\n", kind, id, d.Name)
+		for _, portID := range sortedKeys(d.Ports) {
+			fmt.Fprintf(&b, "  ports {\n    id: %q\n    name: %q\n  }\n", localName(id, portID), localName(d.Name, d.Ports[portID].Name))
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// writeBinding writes the Ondatra testbed and binding files of a testbed in
+// dir.
+func writeBinding(dir string, tb testbed) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	content, err := prototext.MarshalOptions{Multiline: true}.Marshal(ondatraTestbed(tb))
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, testbedFile), content, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, bindingFile), []byte(staticBinding(tb)), 0644)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	opb "github.com/openconfig/ondatra/proto"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+// goldenTestbed reads the testbed of testdata/testbed.json: a DUT and a TGEN
+// of vendor Keysight, linked twice.
+func goldenTestbed(t *testing.T) testbed {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join("testdata", "testbed.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := testbed{}
+	if err := json.Unmarshal(content, &tb); err != nil {
+		t.Fatal(err)
+	}
+	return tb
+}
+
+func TestOndatraTestbed(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("testdata", testbedFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &opb.Testbed{}
+	if err := prototext.Unmarshal(content, want); err != nil {
+		t.Fatal(err)
+	}
+	// prototext output is unstable on purpose: compare messages, not text.
+	if got := ondatraTestbed(goldenTestbed(t)); !proto.Equal(got, want) {
+		t.Errorf("ondatraTestbed() =\n%v\nwant\n%v", prototext.Format(got), prototext.Format(want))
+	}
+}
+
+func TestStaticBinding(t *testing.T) {
+	want, err := os.ReadFile(filepath.Join("testdata", bindingFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := staticBinding(goldenTestbed(t)); got != string(want) {
+		t.Errorf("staticBinding() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteBinding(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "binding")
+	if err := writeBinding(dir, goldenTestbed(t)); err != nil {
+		t.Fatalf("writeBinding() error: %v", err)
+	}
+	for _, name := range []string{testbedFile, bindingFile} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("writeBinding() did not write %s: %v", name, err)
+		}
+	}
+}
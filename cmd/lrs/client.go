@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// client calls the reservation service.
+type client struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+// apiError is an error answered by the service.
+type apiError struct {
+	Status  int
+	Code    string   `json:"code"`
+	Message string   `json:"error"`
+	Errors  []string `json:"errors"`
+}
+
+func (e *apiError) Error() string {
+	msg := strings.TrimSpace(e.Message)
+	if msg == "" {
+		msg = http.StatusText(e.Status)
+	}
+	if e.Code != "" {
+		msg += " (" + e.Code + ")"
+	}
+	for _, err := range e.Errors {
+		msg += "\n  " + err
+	}
+	return msg
+}
+
+// newClient returns a client of server authenticated by the token, if any,
+// and by a client certificate when cert and key are set. A ca file replaces
+// the system roots to verify the server.
+func newClient(server, token, ca, cert, key string) (*client, error) {
+	tlsConfig := &tls.Config{}
+	if ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", ca)
+		}
+	}
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &client{
+		server: strings.TrimSuffix(server, "/"),
+		token:  token,
+		http:   &http.Client{Transport: transport, Timeout: 10 * time.Minute},
+	}, nil
+}
+
+// do calls the service and decodes its JSON answer into out, unless out is
+// nil. It returns the status of the answer, and an *apiError for statuses
+// other than 2xx.
+func (c *client) do(method, path string, body, out interface{}) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(content)
+	}
+	req, err := http.NewRequest(method, c.server+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode/100 != 2 {
+		apiErr := &apiError{Status: resp.StatusCode}
+		json.Unmarshal(content, apiErr)
+		return resp.StatusCode, apiErr
+	}
+	if out != nil {
+		if err := json.Unmarshal(content, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,461 @@
+// Command lrs is the command-line client of the lab reservation service.
+//
+//	lrs [global flags] <command> [flags] [arguments]
+//
+// Reserve a testbed described by a topology file, waiting for it if the lab
+// is busy, and write the files to run Ondatra tests on it:
+//
+//	lrs reserve -wait -duration 4h -out /tmp/tb testbed.json
+//	go test ./... -args -testbed /tmp/tb/testbed.textproto -binding /tmp/tb/binding.textproto
+//	lrs release <id>
+//
+// The service is LRS_SERVER, or -server, and API tokens are read from
+// LRS_TOKEN or from -token-file.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+)
+
+// command is a subcommand of lrs.
+type command struct {
+	usage   string
+	summary string
+	run     func(c *client, args []string) error
+}
+
+// commands are set by init, since they refer to it through newFlagSet.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"reserve":   {"reserve [flags] [topology.json]", "reserve a testbed", runReserve},
+		"release":   {"release <id>", "release a reservation", runRelease},
+		"renew":     {"renew [flags] <id>", "extend the lease of a reservation", runRenew},
+		"list":      {"list [flags]", "list reservations", runList},
+		"show":      {"show [flags] <id>", "show a reservation and its testbed", runShow},
+		"inventory": {"inventory [flags]", "list the devices of the lab", runInventory},
+		"check":     {"check [flags] [topology.json]", "check whether a topology can be reserved now", runCheck},
+		"queue":     {"queue [flags]", "list the queued reservations", runQueue},
+	}
+}
+
+func envOr(name, value string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return value
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: lrs [global flags] <command> [flags] [arguments]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	names := sortedKeys(commands)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nGlobal flags:")
+	flag.PrintDefaults()
+}
+
+func main() {
+	server := flag.String("server", envOr("LRS_SERVER", "http://localhost:8080"), "URL of the reservation service, or LRS_SERVER")
+	tokenFile := flag.String("token-file", os.Getenv("LRS_TOKEN_FILE"), "file of the API token, or LRS_TOKEN_FILE; LRS_TOKEN gives the token itself")
+	ca := flag.String("ca", os.Getenv("LRS_CA"), "CA certificate of the service, or LRS_CA")
+	cert := flag.String("cert", os.Getenv("LRS_CERT"), "client certificate, or LRS_CERT")
+	key := flag.String("key", os.Getenv("LRS_KEY"), "key of the client certificate, or LRS_KEY")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "lrs: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	token := os.Getenv("LRS_TOKEN")
+	if *tokenFile != "" {
+		content, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "lrs:", err)
+			os.Exit(1)
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	c, err := newClient(*server, token, *ca, *cert, *key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "lrs:", err)
+		os.Exit(1)
+	}
+	if err := cmd.run(c, flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "lrs:", err)
+		os.Exit(1)
+	}
+}
+
+// newFlagSet returns the flags of a command.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: lrs %s\n\n%s.\n", commands[name].usage, strings.ToUpper(commands[name].summary[:1])+commands[name].summary[1:])
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// oneArg returns the only argument of a command.
+func oneArg(fs *flag.FlagSet, what string) (string, error) {
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("%s: expected one %s, see lrs %s -h", fs.Name(), what, fs.Name())
+	}
+	return fs.Arg(0), nil
+}
+
+// paramFlag collects template parameters given as name=value.
+type paramFlag map[string]interface{}
+
+func (p paramFlag) String() string { return "" }
+
+func (p paramFlag) Set(v string) error {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("%q is not name=value", v)
+	}
+	p[name] = value
+	return nil
+}
+
+// requestFlags are the flags of the commands sending reservation requests.
+type requestFlags struct {
+	template string
+	version  int
+	params   paramFlag
+	priority int
+	team     string
+	duration string
+	notify   string
+}
+
+func (r *requestFlags) register(fs *flag.FlagSet) {
+	r.params = paramFlag{}
+	fs.StringVar(&r.template, "template", "", "stored template to reserve instead of a topology file")
+	fs.IntVar(&r.version, "version", 0, "version of the template, the latest by default")
+	fs.Var(r.params, "param", "template parameter as name=value, may be repeated")
+	fs.IntVar(&r.priority, "priority", 0, "priority of the request, higher ones may preempt lower ones")
+	fs.StringVar(&r.team, "team", "", "team the reservation counts against, when not taken from the credentials")
+	fs.StringVar(&r.duration, "duration", "", "lease of the reservation, such as 4h, forever by default")
+	fs.StringVar(&r.notify, "notify-url", "", "URL called if the reservation is preempted")
+}
+
+// body builds a reservation request from a topology file, in the format of
+// testbed.json, or a template, and the flags.
+func (r *requestFlags) body(fs *flag.FlagSet) (map[string]interface{}, error) {
+	body := map[string]interface{}{}
+	switch {
+	case fs.NArg() > 1:
+		return nil, fmt.Errorf("%s: expected at most one topology file", fs.Name())
+	case fs.NArg() == 1:
+		content, err := os.ReadFile(fs.Arg(0))
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(content, &body); err != nil {
+			return nil, fmt.Errorf("%s: %v", fs.Arg(0), err)
+		}
+	case r.template == "":
+		return nil, fmt.Errorf("%s: a topology file or -template is required", fs.Name())
+	}
+	if r.template != "" {
+		body["template"] = r.template
+	}
+	if r.version != 0 {
+		body["version"] = r.version
+	}
+	if len(r.params) > 0 {
+		body["params"] = map[string]interface{}(r.params)
+	}
+	if r.priority != 0 {
+		body["priority"] = r.priority
+	}
+	if r.team != "" {
+		body["team"] = r.team
+	}
+	if r.duration != "" {
+		body["duration"] = r.duration
+	}
+	if r.notify != "" {
+		body["notify_url"] = r.notify
+	}
+	return body, nil
+}
+
+// getReservation returns a reservation, and its JSON as answered.
+func getReservation(c *client, id string) (reservation, json.RawMessage, error) {
+	var raw json.RawMessage
+	if _, err := c.do("GET", "/reservations/"+url.PathEscape(id), nil, &raw); err != nil {
+		return reservation{}, nil, err
+	}
+	r := reservation{}
+	err := json.Unmarshal(raw, &r)
+	return r, raw, err
+}
+
+// waitActive polls a reservation until its testbed is handed out. It gives
+// up, releasing the reservation, when ctx is done.
+func waitActive(ctx context.Context, c *client, id string, poll time.Duration) (reservation, json.RawMessage, error) {
+	for {
+		r, raw, err := getReservation(c, id)
+		if err != nil {
+			return r, raw, err
+		}
+		switch r.Status {
+		case "active":
+			return r, raw, nil
+		case "released", "preempted":
+			return r, raw, fmt.Errorf("reservation %s was %s while waiting for its testbed", id, r.Status)
+		}
+		select {
+		case <-ctx.Done():
+			if _, err := c.do("DELETE", "/reservations/"+url.PathEscape(id), nil, nil); err != nil {
+				return r, raw, fmt.Errorf("gave up waiting for reservation %s, and could not release it: %v", id, err)
+			}
+			return r, raw, fmt.Errorf("gave up waiting for reservation %s, released it", id)
+		case <-time.After(poll):
+		}
+	}
+}
+
+// showReservation prints a reservation, and writes the Ondatra files of its
+// testbed to dir once it is active.
+func showReservation(r reservation, raw json.RawMessage, asJSON bool, dir string) error {
+	if asJSON {
+		printJSON(raw)
+	} else {
+		printReservation(os.Stdout, r)
+	}
+	if dir == "" {
+		return nil
+	}
+	if r.Status != "active" {
+		return fmt.Errorf("reservation %s is %s, the binding files are written once it is active", r.ID, r.Status)
+	}
+	if err := writeBinding(dir, r.Testbed); err != nil {
+		return err
+	}
+	if !asJSON {
+		fmt.Printf("\nWrote %s/%s and %s/%s\n", dir, testbedFile, dir, bindingFile)
+	}
+	return nil
+}
+
+func runReserve(c *client, args []string) error {
+	fs := newFlagSet("reserve")
+	req := requestFlags{}
+	req.register(fs)
+	wait := fs.Bool("wait", false, "queue the request if it cannot be satisfied yet, and wait until the testbed is handed out")
+	timeout := fs.Duration("timeout", 0, "with -wait, how long to wait before giving up and releasing the reservation, forever when 0")
+	poll := fs.Duration("poll", 5*time.Second, "with -wait, how often to check the reservation")
+	dir := fs.String("out", "", "directory to write the Ondatra testbed and binding files to")
+	asJSON := fs.Bool("json", false, "print the reservation as JSON")
+	fs.Parse(args)
+	body, err := req.body(fs)
+	if err != nil {
+		return err
+	}
+	if *wait {
+		body["wait"] = true
+	}
+	answer := testbed{}
+	if _, err := c.do("POST", "/reserve", body, &answer); err != nil {
+		return err
+	}
+	if answer.Status != "active" && *wait {
+		if !*asJSON {
+			fmt.Fprintf(os.Stderr, "Reservation %s is %s, waiting for its testbed...\n", answer.ReservationID, answer.Status)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if *timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *timeout)
+			defer cancel()
+		}
+		r, raw, err := waitActive(ctx, c, answer.ReservationID, *poll)
+		if err != nil {
+			return err
+		}
+		return showReservation(r, raw, *asJSON, *dir)
+	}
+	r, raw, err := getReservation(c, answer.ReservationID)
+	if err != nil {
+		return err
+	}
+	return showReservation(r, raw, *asJSON, *dir)
+}
+
+func runCheck(c *client, args []string) error {
+	fs := newFlagSet("check")
+	req := requestFlags{}
+	req.register(fs)
+	asJSON := fs.Bool("json", false, "print the testbed that would be assigned as JSON")
+	fs.Parse(args)
+	body, err := req.body(fs)
+	if err != nil {
+		return err
+	}
+	body["dry_run"] = true
+	var raw json.RawMessage
+	if _, err := c.do("POST", "/reserve", body, &raw); err != nil {
+		return err
+	}
+	if *asJSON {
+		printJSON(raw)
+		return nil
+	}
+	answer := dryRun{}
+	if err := json.Unmarshal(raw, &answer); err != nil {
+		return err
+	}
+	fmt.Println("The topology can be reserved now, as:")
+	fmt.Println()
+	printTestbed(os.Stdout, answer.Testbed)
+	if len(answer.Preempts) > 0 {
+		fmt.Printf("\nIt would preempt %s\n", strings.Join(answer.Preempts, ", "))
+	}
+	return nil
+}
+
+func runRelease(c *client, args []string) error {
+	fs := newFlagSet("release")
+	fs.Parse(args)
+	id, err := oneArg(fs, "reservation ID")
+	if err != nil {
+		return err
+	}
+	if _, err := c.do("DELETE", "/reservations/"+url.PathEscape(id), nil, nil); err != nil {
+		return err
+	}
+	fmt.Printf("Reservation %s released\n", id)
+	return nil
+}
+
+func runRenew(c *client, args []string) error {
+	fs := newFlagSet("renew")
+	duration := fs.Duration("duration", time.Hour, "how long the reservation lasts from now on")
+	fs.Parse(args)
+	id, err := oneArg(fs, "reservation ID")
+	if err != nil {
+		return err
+	}
+	r := reservation{}
+	if _, err := c.do("POST", "/reservations/"+url.PathEscape(id)+"/renew", map[string]string{"duration": duration.String()}, &r); err != nil {
+		return err
+	}
+	fmt.Printf("Reservation %s expires %s\n", id, formatTime(r.Expires))
+	return nil
+}
+
+func runShow(c *client, args []string) error {
+	fs := newFlagSet("show")
+	dir := fs.String("out", "", "directory to write the Ondatra testbed and binding files to")
+	asJSON := fs.Bool("json", false, "print the reservation as JSON")
+	fs.Parse(args)
+	id, err := oneArg(fs, "reservation ID")
+	if err != nil {
+		return err
+	}
+	r, raw, err := getReservation(c, id)
+	if err != nil {
+		return err
+	}
+	return showReservation(r, raw, *asJSON, *dir)
+}
+
+func runList(c *client, args []string) error {
+	fs := newFlagSet("list")
+	status := fs.String("status", "", "only list reservations of this status, such as active")
+	user := fs.String("user", "", "only list reservations of this user")
+	team := fs.String("team", "", "only list reservations of this team")
+	asJSON := fs.Bool("json", false, "print the reservations as JSON")
+	fs.Parse(args)
+	path := "/reservations"
+	if *status != "" {
+		path += "?status=" + url.QueryEscape(*status)
+	}
+	list := []reservation{}
+	if _, err := c.do("GET", path, nil, &list); err != nil {
+		return err
+	}
+	selected := []reservation{}
+	for _, r := range list {
+		if (*user == "" || r.User == *user) && (*team == "" || r.Team == *team) {
+			selected = append(selected, r)
+		}
+	}
+	if *asJSON {
+		content, _ := json.Marshal(selected)
+		printJSON(content)
+		return nil
+	}
+	printReservations(os.Stdout, selected)
+	return nil
+}
+
+func runQueue(c *client, args []string) error {
+	fs := newFlagSet("queue")
+	asJSON := fs.Bool("json", false, "print the queue as JSON")
+	fs.Parse(args)
+	var raw json.RawMessage
+	if _, err := c.do("GET", "/queue", nil, &raw); err != nil {
+		return err
+	}
+	if *asJSON {
+		printJSON(raw)
+		return nil
+	}
+	list := []reservation{}
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return err
+	}
+	printQueue(os.Stdout, list)
+	return nil
+}
+
+func runInventory(c *client, args []string) error {
+	fs := newFlagSet("inventory")
+	deviceType := fs.String("type", "", "only list devices of this type, such as DUT")
+	state := fs.String("state", "", "only list devices in this state: free, reserved, cleaning, drained or quarantined")
+	asJSON := fs.Bool("json", false, "print the devices as JSON")
+	fs.Parse(args)
+	list := []inventoryDevice{}
+	if _, err := c.do("GET", "/inventory", nil, &list); err != nil {
+		return err
+	}
+	selected := []inventoryDevice{}
+	for _, d := range list {
+		if (*deviceType == "" || strings.EqualFold(d.Attrs["type"], *deviceType)) && (*state == "" || d.State == *state) {
+			selected = append(selected, d)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].Name < selected[j].Name })
+	if *asJSON {
+		content, _ := json.Marshal(selected)
+		printJSON(content)
+		return nil
+	}
+	printInventory(os.Stdout, selected)
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// printJSON prints an answer of the service indented.
+func printJSON(raw json.RawMessage) {
+	var out bytes.Buffer
+	if err := json.Indent(&out, raw, "", "    "); err != nil {
+		os.Stdout.Write(raw)
+	} else {
+		out.WriteTo(os.Stdout)
+	}
+	fmt.Println()
+}
+
+func newTable(w io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// printTestbed prints the devices, ports and links assigned to a testbed.
+func printTestbed(w io.Writer, tb testbed) {
+	names := sortedKeys(tb.Devices)
+	t := newTable(w)
+	fmt.Fprintln(t, "DEVICE\tASSIGNED\tTYPE\tVENDOR")
+	for _, name := range names {
+		d := tb.Devices[name]
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\n", name, d.Name, orDash(d.Attrs["type"]), orDash(d.Attrs["vendor"]))
+	}
+	t.Flush()
+	fmt.Fprintln(w)
+	t = newTable(w)
+	fmt.Fprintln(t, "PORT\tASSIGNED\tSPEED")
+	for _, name := range names {
+		ports := tb.Devices[name].Ports
+		for _, portName := range sortedKeys(ports) {
+			p := ports[portName]
+			fmt.Fprintf(t, "%s\t%s\t%s\n", portName, p.Name, orDash(p.Attrs["speed"]))
+		}
+	}
+	t.Flush()
+	if len(tb.Links) > 0 {
+		fmt.Fprintln(w)
+		t = newTable(w)
+		fmt.Fprintln(t, "LINK SRC\tLINK DST")
+		for _, l := range tb.Links {
+			fmt.Fprintf(t, "%s\t%s\n", l.Src, l.Dst)
+		}
+		t.Flush()
+	}
+	if len(tb.UnmetPreferences) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Unmet preferences:")
+		for _, p := range tb.UnmetPreferences {
+			where := p.Device
+			if p.Port != "" {
+				where = p.Port
+			}
+			fmt.Fprintf(w, "  %s: %s=%s\n", where, p.Name, p.Value)
+		}
+	}
+}
+
+// printReservation prints the state of a reservation and its testbed.
+func printReservation(w io.Writer, r reservation) {
+	fmt.Fprintf(w, "Reservation %s is %s", r.ID, r.Status)
+	if r.User != "" || r.Team != "" {
+		fmt.Fprintf(w, " (user %s, team %s)", orDash(r.User), orDash(r.Team))
+	}
+	fmt.Fprintln(w)
+	if r.Expires != nil {
+		fmt.Fprintf(w, "Expires %s\n", formatTime(r.Expires))
+	}
+	if r.ReleaseAt != nil {
+		fmt.Fprintf(w, "Preempted by %s, released at %s\n", r.PreemptedBy, formatTime(r.ReleaseAt))
+	}
+	if len(r.Testbed.Devices) > 0 {
+		fmt.Fprintln(w)
+		printTestbed(w, r.Testbed)
+	}
+}
+
+func printReservations(w io.Writer, list []reservation) {
+	t := newTable(w)
+	fmt.Fprintln(t, "ID\tSTATUS\tUSER\tTEAM\tPRIORITY\tDEVICES\tCREATED\tEXPIRES")
+	for _, r := range list {
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", r.ID, r.Status, orDash(r.User), orDash(r.Team), r.Priority,
+			orDash(strings.Join(r.Devices, ",")), formatTime(&r.Created), formatTime(r.Expires))
+	}
+	t.Flush()
+}
+
+func printQueue(w io.Writer, list []reservation) {
+	t := newTable(w)
+	fmt.Fprintln(t, "POSITION\tID\tUSER\tTEAM\tPRIORITY\tQUEUED")
+	for i, r := range list {
+		fmt.Fprintf(t, "%d\t%s\t%s\t%s\t%d\t%s\n", i+1, r.ID, orDash(r.User), orDash(r.Team), r.Priority, formatTime(&r.Created))
+	}
+	t.Flush()
+}
+
+func printInventory(w io.Writer, list []inventoryDevice) {
+	t := newTable(w)
+	fmt.Fprintln(t, "DEVICE\tTYPE\tVENDOR\tSTATE\tFREE PORTS\tRESERVATIONS")
+	for _, d := range list {
+		free := 0
+		for _, p := range d.Ports {
+			if p.Attrs["reserved"] != "yes" {
+				free++
+			}
+		}
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%d/%d\t%s\n", d.Name, orDash(d.Attrs["type"]), orDash(d.Attrs["vendor"]), d.State,
+			free, len(d.Ports), orDash(strings.Join(d.Reservations, ",")))
+	}
+	t.Flush()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,67 @@
+package main
+
+import "time"
+
+// The answers of the service, with the fields the client uses.
+
+type testbed struct {
+	Devices          map[string]device `json:"devices"`
+	Links            []link            `json:"links"`
+	Cost             float64           `json:"cost,omitempty"`
+	UnmetPreferences []unmetPreference `json:"unmet_preferences,omitempty"`
+	ReservationID    string            `json:"reservation_id,omitempty"`
+	Status           string            `json:"status,omitempty"`
+}
+
+type device struct {
+	Name  string            `json:"name"`
+	Attrs map[string]string `json:"attributes"`
+	Ports map[string]port   `json:"ports"`
+}
+
+type port struct {
+	Name  string            `json:"name"`
+	Attrs map[string]string `json:"attributes"`
+}
+
+type link struct {
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+}
+
+type unmetPreference struct {
+	Device string `json:"device"`
+	Port   string `json:"port,omitempty"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+}
+
+type reservation struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Priority    int        `json:"priority"`
+	User        string     `json:"user,omitempty"`
+	Team        string     `json:"team"`
+	Created     time.Time  `json:"created"`
+	Started     *time.Time `json:"started,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	ReleaseAt   *time.Time `json:"release_at,omitempty"`
+	PreemptedBy string     `json:"preempted_by,omitempty"`
+	Devices     []string   `json:"devices"`
+	Ports       []string   `json:"ports"`
+	Testbed     testbed    `json:"testbed"`
+}
+
+type inventoryDevice struct {
+	Name         string            `json:"name"`
+	Attrs        map[string]string `json:"attributes"`
+	State        string            `json:"state"`
+	Reservations []string          `json:"reservations,omitempty"`
+	Ports        []port            `json:"ports"`
+}
+
+// dryRun is the answer to a request with dry_run.
+type dryRun struct {
+	Testbed  testbed  `json:"testbed"`
+	Preempts []string `json:"preempts"`
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"lablrs/auth"
+)
+
+// Config is the effective configuration of the server.
+type Config struct {
+	Listen        string
+	DataDir       string
+	NetboxURL     string
+	NetboxToken   string
+	TLSCert       string
+	TLSKey        string
+	ClientCA      string
+	TokensFile    string
+	JWT           auth.JWTConfig
+	PolicyFile    string
+	QuotasFile    string
+	SolveTimeout  time.Duration
+	Placement     string
+	PreemptGrace  time.Duration
+	QueueTTL      time.Duration
+	MaxLease      time.Duration
+	HealthProbe   string
+	HealthTimeout time.Duration
+	// HealthRecheckAfter is how long a device that failed its health check
+	// is avoided before it is probed again.
+	HealthRecheckAfter    time.Duration
+	HealthQuarantineAfter int
+	HealthRetries         int
+	HealthFailUnchecked   bool
+	GNMIPlaintext         bool
+	GNMIInsecure          bool
+	GNMIUsername          string
+	GNMIPassword          string
+	LinkVerify            bool
+	LinkStrict            bool
+	LinkRecheckAfter      time.Duration
+	GoldenConfigDir       string
+	DUTCleanupScript      string
+	ATECleanupScript      string
+	OTGClear              bool
+	OTGInsecure           bool
+	CleanupTimeout        time.Duration
+	CleanupAlertURL       string
+	WebhooksFile          string
+	WebhookAttempts       int
+	WebhookBackoff        time.Duration
+	AuditFile             string
+	settings              []*setting
+	settingsByKey         map[string]*setting
+}
+
+// setting is one configuration value. It is read from, in increasing order of
+// precedence, its default, the configuration file, the environment and the
+// command line. Secrets cannot be given on the command line, where they would
+// be visible to other users of the host.
+type setting struct {
+	key    string // dotted path in the configuration file
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	value  string
+	source string
+}
+
+func configSettings() []*setting {
+	return []*setting{
+		{key: "listen", env: "LRS_LISTEN", flag: "listen", value: ":8080", usage: "address the API listens on"},
+		{key: "data_dir", env: "LRS_DATA_DIR", flag: "data-dir", value: ".", usage: "directory of the inventory, output and template files"},
+		{key: "netbox.url", env: "LRS_NETBOX_URL", flag: "netbox-url", usage: "NetBox API URL, such as http://netbox:8000/api/"},
+		{key: "netbox.token", env: "LRS_NETBOX_TOKEN", secret: true, usage: "NetBox API token"},
+		{key: "netbox.token_file", env: "LRS_NETBOX_TOKEN_FILE", flag: "netbox-token-file", usage: "file holding the NetBox API token"},
+		{key: "tls.cert", env: "LRS_TLS_CERT", flag: "tls-cert", usage: "TLS certificate of the server"},
+		{key: "tls.key", env: "LRS_TLS_KEY", flag: "tls-key", usage: "TLS key of the server"},
+		{key: "tls.client_ca", env: "LRS_TLS_CLIENT_CA", flag: "client-ca", usage: "CA certificates authenticating client certificates"},
+		{key: "auth.tokens_file", env: "LRS_AUTH_TOKENS_FILE", flag: "tokens", usage: "file of static API tokens"},
+		{key: "auth.jwks_file", env: "LRS_AUTH_JWKS_FILE", flag: "jwks", usage: "JWKS file of the keys signing OIDC tokens"},
+		{key: "auth.jwt_issuer", env: "LRS_AUTH_JWT_ISSUER", flag: "jwt-issuer", usage: "required issuer of OIDC tokens"},
+		{key: "auth.jwt_audience", env: "LRS_AUTH_JWT_AUDIENCE", flag: "jwt-audience", usage: "required audience of OIDC tokens"},
+		{key: "auth.jwt_name_claim", env: "LRS_AUTH_JWT_NAME_CLAIM", flag: "jwt-name-claim", value: "preferred_username", usage: "OIDC token claim naming the user"},
+		{key: "auth.jwt_team_claim", env: "LRS_AUTH_JWT_TEAM_CLAIM", flag: "jwt-team-claim", value: "groups", usage: "OIDC token claim naming the team of the user"},
+		{key: "auth.jwt_roles_claim", env: "LRS_AUTH_JWT_ROLES_CLAIM", flag: "jwt-roles-claim", value: "roles", usage: "OIDC token claim listing the roles of the user"},
+		{key: "policy.rbac", env: "LRS_POLICY_RBAC", flag: "policy", usage: "RBAC policy file"},
+		{key: "policy.quotas", env: "LRS_POLICY_QUOTAS", flag: "quotas", usage: "file of per team and per user quotas, quotas.json in the data directory by default"},
+		{key: "solve.timeout", env: "LRS_SOLVE_TIMEOUT", flag: "solve-timeout", value: "30s", usage: "maximum time spent finding an assignment for one request"},
+		{key: "solve.placement", env: "LRS_SOLVE_PLACEMENT", flag: "placement", value: placementFirstFit, usage: "device placement policy: first-fit or pack"},
+		{key: "solve.preempt_grace", env: "LRS_SOLVE_PREEMPT_GRACE", flag: "preempt-grace", value: "0s", usage: "time preempted reservations keep their testbed before it is handed over"},
+		{key: "solve.queue_ttl", env: "LRS_SOLVE_QUEUE_TTL", flag: "queue-ttl", value: "24h", usage: "time a reservation may wait in the queue, 0 for ever"},
+		{key: "solve.max_lease", env: "LRS_SOLVE_MAX_LEASE", flag: "max-lease", value: "0s", usage: "longest lease a reservation gets at once, when made or renewed, 0 for no limit"},
+		{key: "health.probe", env: "LRS_HEALTH_PROBE", flag: "health-probe", usage: "health check of assigned devices: tcp, gnmi, or empty for none"},
+		{key: "health.timeout", env: "LRS_HEALTH_TIMEOUT", flag: "health-timeout", value: "5s", usage: "maximum time of the health check of one device"},
+		{key: "health.recheck_after", env: "LRS_HEALTH_RECHECK_AFTER", flag: "health-recheck-after", value: "5m", usage: "time a device failing its health check is avoided"},
+		{key: "health.quarantine_after", env: "LRS_HEALTH_QUARANTINE_AFTER", flag: "health-quarantine-after", value: "3", usage: "consecutive failed health checks quarantining a device, 0 for never"},
+		{key: "health.retries", env: "LRS_HEALTH_RETRIES", flag: "health-retries", value: "2", usage: "times a testbed is solved again without devices failing their health check"},
+		{key: "health.fail_unchecked", env: "LRS_HEALTH_FAIL_UNCHECKED", flag: "health-fail-unchecked", value: "false", usage: "fail the health check of devices without any service to probe"},
+		{key: "health.gnmi_plaintext", env: "LRS_HEALTH_GNMI_PLAINTEXT", flag: "health-gnmi-plaintext", value: "false", usage: "probe gNMI without TLS"},
+		{key: "health.gnmi_insecure", env: "LRS_HEALTH_GNMI_INSECURE", flag: "health-gnmi-insecure", value: "false", usage: "accept any TLS certificate of gNMI services"},
+		{key: "health.gnmi_username", env: "LRS_HEALTH_GNMI_USERNAME", flag: "health-gnmi-username", usage: "username of gNMI health checks"},
+		{key: "health.gnmi_password", env: "LRS_HEALTH_GNMI_PASSWORD", secret: true, usage: "password of gNMI health checks"},
+		{key: "events.webhooks_file", env: "LRS_EVENTS_WEBHOOKS_FILE", flag: "webhooks", usage: "file of the webhooks receiving reservation and device events"},
+		{key: "events.webhook_attempts", env: "LRS_EVENTS_WEBHOOK_ATTEMPTS", flag: "webhook-attempts", value: "5", usage: "attempts to deliver an event to a webhook"},
+		{key: "events.webhook_backoff", env: "LRS_EVENTS_WEBHOOK_BACKOFF", flag: "webhook-backoff", value: "1s", usage: "wait before retrying a webhook delivery, doubled on each retry"},
+		{key: "audit.file", env: "LRS_AUDIT_FILE", flag: "audit-file", usage: "append-only audit log of reservations, audit.jsonl in the data directory by default"},
+		{key: "links.verify", env: "LRS_LINKS_VERIFY", flag: "verify-links", value: "false", usage: "verify assigned links against the LLDP neighbors of their devices, over gNMI"},
+		{key: "links.strict", env: "LRS_LINKS_STRICT", flag: "links-strict", value: "false", usage: "fail links whose ports see no LLDP neighbor"},
+		{key: "cleanup.golden_config_dir", env: "LRS_CLEANUP_GOLDEN_CONFIG_DIR", flag: "golden-config-dir", usage: "directory of the golden configurations of DUTs, restored with gNMI on release"},
+		{key: "cleanup.dut_script", env: "LRS_CLEANUP_DUT_SCRIPT", flag: "dut-cleanup-script", usage: "script run on the DUTs of released reservations"},
+		{key: "cleanup.ate_script", env: "LRS_CLEANUP_ATE_SCRIPT", flag: "ate-cleanup-script", usage: "script run on the ATEs of released reservations"},
+		{key: "cleanup.otg_clear", env: "LRS_CLEANUP_OTG_CLEAR", flag: "otg-clear", value: "false", usage: "clear the OTG sessions of the ATEs of released reservations"},
+		{key: "cleanup.otg_insecure", env: "LRS_CLEANUP_OTG_INSECURE", flag: "otg-insecure", value: "false", usage: "accept any TLS certificate of OTG services"},
+		{key: "cleanup.timeout", env: "LRS_CLEANUP_TIMEOUT", flag: "cleanup-timeout", value: "10m", usage: "maximum time of the cleanup of one device"},
+		{key: "cleanup.alert_url", env: "LRS_CLEANUP_ALERT_URL", flag: "cleanup-alert-url", usage: "URL alerted when a device is quarantined after a failed cleanup"},
+		{key: "links.recheck_after", env: "LRS_LINKS_RECHECK_AFTER", flag: "links-recheck-after", value: "1h", usage: "time the ports of a miscabled link are avoided, 0 for until cleared"},
+	}
+}
+
+// loadConfig reads the configuration from the file named by -config or
+// LRS_CONFIG, the environment and the command line, and validates it.
+func loadConfig(args []string) (*Config, error) {
+	cfg := &Config{settings: configSettings(), settingsByKey: map[string]*setting{}}
+	fs := flag.NewFlagSet("lrs", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("LRS_CONFIG"), "configuration file")
+	flagValues := map[string]*string{}
+	for _, s := range cfg.settings {
+		s.source = "default"
+		cfg.settingsByKey[s.key] = s
+		if s.flag != "" {
+			flagValues[s.flag] = fs.String(s.flag, s.value, s.usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.readFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range cfg.settings {
+		if v, ok := os.LookupEnv(s.env); ok {
+			s.value, s.source = v, "env "+s.env
+		}
+	}
+	byFlag := map[string]*setting{}
+	for _, s := range cfg.settings {
+		byFlag[s.flag] = s
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if s, ok := byFlag[f.Name]; ok {
+			s.value, s.source = *flagValues[f.Name], "flag -"+f.Name
+		}
+	})
+	if err := cfg.build(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readFile reads a JSON configuration file. Sections nest settings, e.g.
+// {"netbox": {"url": "..."}} sets netbox.url.
+func (cfg *Config) readFile(path string) error {
+	jsonData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading configuration: %v", err)
+	}
+	tree := map[string]interface{}{}
+	if err := json.Unmarshal(jsonData, &tree); err != nil {
+		return fmt.Errorf("reading configuration from %s: %v", path, err)
+	}
+	values := map[string]string{}
+	flatten("", tree, values)
+	for key, v := range values {
+		s, ok := cfg.settingsByKey[key]
+		if !ok {
+			return fmt.Errorf("configuration %s: unknown setting %q", path, key)
+		}
+		s.value, s.source = v, "file "+path
+	}
+	return nil
+}
+
+// flatten collects the settings of a configuration file. Numbers are written
+// out in full, 1e6 as 1000000, for the settings to parse them as counts.
+func flatten(prefix string, tree map[string]interface{}, values map[string]string) {
+	for k, v := range tree {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			flatten(prefix+k+".", v, values)
+		case float64:
+			values[prefix+k] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			values[prefix+k] = fmt.Sprint(v)
+		}
+	}
+}
+
+func (cfg *Config) get(key string) string {
+	return cfg.settingsByKey[key].value
+}
+
+// build parses and validates the settings, reporting every problem at once.
+func (cfg *Config) build() error {
+	problems := []string{}
+	cfg.Listen = cfg.get("listen")
+	cfg.DataDir = cfg.get("data_dir")
+	cfg.NetboxURL = cfg.get("netbox.url")
+	cfg.NetboxToken = cfg.get("netbox.token")
+	cfg.TLSCert = cfg.get("tls.cert")
+	cfg.TLSKey = cfg.get("tls.key")
+	cfg.ClientCA = cfg.get("tls.client_ca")
+	cfg.TokensFile = cfg.get("auth.tokens_file")
+	cfg.JWT = auth.JWTConfig{
+		JWKSFile:   cfg.get("auth.jwks_file"),
+		Issuer:     cfg.get("auth.jwt_issuer"),
+		Audience:   cfg.get("auth.jwt_audience"),
+		NameClaim:  cfg.get("auth.jwt_name_claim"),
+		TeamClaim:  cfg.get("auth.jwt_team_claim"),
+		RolesClaim: cfg.get("auth.jwt_roles_claim"),
+	}
+	cfg.PolicyFile = cfg.get("policy.rbac")
+	cfg.QuotasFile = cfg.get("policy.quotas")
+	cfg.Placement = cfg.get("solve.placement")
+	cfg.HealthProbe = cfg.get("health.probe")
+	cfg.GNMIUsername = cfg.get("health.gnmi_username")
+	cfg.GNMIPassword = cfg.get("health.gnmi_password")
+	cfg.GoldenConfigDir = cfg.get("cleanup.golden_config_dir")
+	cfg.DUTCleanupScript = cfg.get("cleanup.dut_script")
+	cfg.ATECleanupScript = cfg.get("cleanup.ate_script")
+	cfg.CleanupAlertURL = cfg.get("cleanup.alert_url")
+	cfg.WebhooksFile = cfg.get("events.webhooks_file")
+	cfg.AuditFile = cfg.get("audit.file")
+
+	if cfg.Listen == "" {
+		problems = append(problems, "listen: an address is required")
+	}
+	if info, err := os.Stat(cfg.DataDir); err != nil || !info.IsDir() {
+		problems = append(problems, fmt.Sprintf("data_dir: %q is not a directory", cfg.DataDir))
+	}
+	if u, err := url.Parse(cfg.NetboxURL); cfg.NetboxURL == "" || err != nil || u.Scheme == "" || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("netbox.url: %q is not an absolute URL", cfg.NetboxURL))
+	}
+	if tokenFile := cfg.get("netbox.token_file"); tokenFile != "" {
+		if cfg.NetboxToken != "" {
+			problems = append(problems, "netbox.token and netbox.token_file are both set")
+		} else if token, err := ioutil.ReadFile(tokenFile); err != nil {
+			problems = append(problems, fmt.Sprintf("netbox.token_file: %v", err))
+		} else {
+			cfg.NetboxToken = strings.TrimSpace(string(token))
+		}
+	}
+	if cfg.NetboxToken == "" {
+		problems = append(problems, "netbox.token: a token is required, from LRS_NETBOX_TOKEN or netbox.token_file")
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		problems = append(problems, "tls.cert and tls.key must be given together")
+	}
+	if cfg.ClientCA != "" && cfg.TLSCert == "" {
+		problems = append(problems, "tls.client_ca needs tls.cert and tls.key")
+	}
+	for _, key := range []string{"tls.cert", "tls.key", "tls.client_ca", "auth.tokens_file", "auth.jwks_file", "policy.rbac", "cleanup.golden_config_dir", "cleanup.dut_script", "cleanup.ate_script", "events.webhooks_file"} {
+		if path := cfg.get(key); path != "" {
+			if _, err := os.Stat(path); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+			}
+		}
+	}
+	var err error
+	if cfg.SolveTimeout, err = time.ParseDuration(cfg.get("solve.timeout")); err != nil || cfg.SolveTimeout <= 0 {
+		problems = append(problems, fmt.Sprintf("solve.timeout: %q is not a positive duration", cfg.get("solve.timeout")))
+	}
+	if cfg.PreemptGrace, err = time.ParseDuration(cfg.get("solve.preempt_grace")); err != nil || cfg.PreemptGrace < 0 {
+		problems = append(problems, fmt.Sprintf("solve.preempt_grace: %q is not a duration", cfg.get("solve.preempt_grace")))
+	}
+	if cfg.QueueTTL, err = time.ParseDuration(cfg.get("solve.queue_ttl")); err != nil || cfg.QueueTTL < 0 {
+		problems = append(problems, fmt.Sprintf("solve.queue_ttl: %q is not a duration", cfg.get("solve.queue_ttl")))
+	}
+	if cfg.MaxLease, err = time.ParseDuration(cfg.get("solve.max_lease")); err != nil || cfg.MaxLease < 0 {
+		problems = append(problems, fmt.Sprintf("solve.max_lease: %q is not a duration", cfg.get("solve.max_lease")))
+	}
+	if cfg.Placement != placementFirstFit && cfg.Placement != placementPack {
+		problems = append(problems, fmt.Sprintf("solve.placement: unknown placement policy %q", cfg.Placement))
+	}
+	switch cfg.HealthProbe {
+	case healthProbeNone, healthProbeTCP, healthProbeGNMI:
+	default:
+		problems = append(problems, fmt.Sprintf("health.probe: unknown probe %q", cfg.HealthProbe))
+	}
+	if cfg.HealthTimeout, err = time.ParseDuration(cfg.get("health.timeout")); err != nil || cfg.HealthTimeout <= 0 {
+		problems = append(problems, fmt.Sprintf("health.timeout: %q is not a positive duration", cfg.get("health.timeout")))
+	}
+	if cfg.HealthRecheckAfter, err = time.ParseDuration(cfg.get("health.recheck_after")); err != nil || cfg.HealthRecheckAfter < 0 {
+		problems = append(problems, fmt.Sprintf("health.recheck_after: %q is not a duration", cfg.get("health.recheck_after")))
+	}
+	if cfg.HealthQuarantineAfter, err = strconv.Atoi(cfg.get("health.quarantine_after")); err != nil || cfg.HealthQuarantineAfter < 0 {
+		problems = append(problems, fmt.Sprintf("health.quarantine_after: %q is not a count", cfg.get("health.quarantine_after")))
+	}
+	if cfg.HealthRetries, err = strconv.Atoi(cfg.get("health.retries")); err != nil || cfg.HealthRetries < 0 {
+		problems = append(problems, fmt.Sprintf("health.retries: %q is not a count", cfg.get("health.retries")))
+	}
+	if cfg.HealthFailUnchecked, err = strconv.ParseBool(cfg.get("health.fail_unchecked")); err != nil {
+		problems = append(problems, fmt.Sprintf("health.fail_unchecked: %q is not a boolean", cfg.get("health.fail_unchecked")))
+	}
+	if cfg.GNMIPlaintext, err = strconv.ParseBool(cfg.get("health.gnmi_plaintext")); err != nil {
+		problems = append(problems, fmt.Sprintf("health.gnmi_plaintext: %q is not a boolean", cfg.get("health.gnmi_plaintext")))
+	}
+	if cfg.GNMIInsecure, err = strconv.ParseBool(cfg.get("health.gnmi_insecure")); err != nil {
+		problems = append(problems, fmt.Sprintf("health.gnmi_insecure: %q is not a boolean", cfg.get("health.gnmi_insecure")))
+	}
+	if cfg.LinkVerify, err = strconv.ParseBool(cfg.get("links.verify")); err != nil {
+		problems = append(problems, fmt.Sprintf("links.verify: %q is not a boolean", cfg.get("links.verify")))
+	}
+	if cfg.LinkStrict, err = strconv.ParseBool(cfg.get("links.strict")); err != nil {
+		problems = append(problems, fmt.Sprintf("links.strict: %q is not a boolean", cfg.get("links.strict")))
+	}
+	if cfg.LinkRecheckAfter, err = time.ParseDuration(cfg.get("links.recheck_after")); err != nil || cfg.LinkRecheckAfter < 0 {
+		problems = append(problems, fmt.Sprintf("links.recheck_after: %q is not a duration", cfg.get("links.recheck_after")))
+	}
+	if cfg.OTGClear, err = strconv.ParseBool(cfg.get("cleanup.otg_clear")); err != nil {
+		problems = append(problems, fmt.Sprintf("cleanup.otg_clear: %q is not a boolean", cfg.get("cleanup.otg_clear")))
+	}
+	if cfg.OTGInsecure, err = strconv.ParseBool(cfg.get("cleanup.otg_insecure")); err != nil {
+		problems = append(problems, fmt.Sprintf("cleanup.otg_insecure: %q is not a boolean", cfg.get("cleanup.otg_insecure")))
+	}
+	if cfg.CleanupTimeout, err = time.ParseDuration(cfg.get("cleanup.timeout")); err != nil || cfg.CleanupTimeout <= 0 {
+		problems = append(problems, fmt.Sprintf("cleanup.timeout: %q is not a positive duration", cfg.get("cleanup.timeout")))
+	}
+	if u, err := url.Parse(cfg.CleanupAlertURL); cfg.CleanupAlertURL != "" && (err != nil || u.Scheme == "" || u.Host == "") {
+		problems = append(problems, fmt.Sprintf("cleanup.alert_url: %q is not an absolute URL", cfg.CleanupAlertURL))
+	}
+	if cfg.WebhookAttempts, err = strconv.Atoi(cfg.get("events.webhook_attempts")); err != nil || cfg.WebhookAttempts < 1 {
+		problems = append(problems, fmt.Sprintf("events.webhook_attempts: %q is not a positive count", cfg.get("events.webhook_attempts")))
+	}
+	if cfg.WebhookBackoff, err = time.ParseDuration(cfg.get("events.webhook_backoff")); err != nil || cfg.WebhookBackoff < 0 {
+		problems = append(problems, fmt.Sprintf("events.webhook_backoff: %q is not a duration", cfg.get("events.webhook_backoff")))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// report writes the effective settings and where each comes from, with
+// secrets redacted.
+func (cfg *Config) report(w io.Writer) {
+	settings := append([]*setting{}, cfg.settings...)
+	sort.Slice(settings, func(i, j int) bool { return settings[i].key < settings[j].key })
+	fmt.Fprintln(w, "Effective configuration:")
+	for _, s := range settings {
+		value := s.value
+		if s.secret && value != "" {
+			value = "<redacted>"
+		}
+		if value == "" {
+			value = "-"
+		}
+		fmt.Fprintf(w, "  %-22s %-40s (%s)\n", s.key, value, s.source)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigNumbers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	content := `{"netbox": {"url": "http://netbox/api/", "token": "secret"}, "health": {"quarantine_after": 1e6, "retries": 3}, "events": {"webhook_attempts": 10}}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig([]string{"-config", path})
+	if err != nil {
+		t.Fatalf("loadConfig() error: %v", err)
+	}
+	if cfg.HealthQuarantineAfter != 1000000 || cfg.HealthRetries != 3 || cfg.WebhookAttempts != 10 {
+		t.Errorf("counts = %d, %d, %d, want 1000000, 3, 10", cfg.HealthQuarantineAfter, cfg.HealthRetries, cfg.WebhookAttempts)
+	}
+	// The quotas are looked for in the data directory unless configured.
+	if cfg.QuotasFile != "" {
+		t.Errorf("QuotasFile = %q, want none by default", cfg.QuotasFile)
+	}
+}
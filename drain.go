@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"lablrs/audit"
+	"lablrs/auth"
+	"lablrs/events"
+	"lablrs/utils"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	graph "github.com/openconfig/ondatra/binding/portgraph"
+)
+
+// drains holds the drain of each drained device. It is guarded by
+// inventoryMu.
+var drains = map[string]*Drain{}
+
+// Drain takes a device, or some of its ports, out of service. Drained devices
+// and ports are not given to new reservations, while the reservations already
+// holding them go on until released. A drain may be limited to a maintenance
+// window from Start to End; without End it lasts until the device is
+// undrained.
+type Drain struct {
+	Device  string     `json:"device"`
+	Ports   []string   `json:"ports,omitempty"`
+	Reason  string     `json:"reason,omitempty"`
+	By      string     `json:"by"`
+	Created time.Time  `json:"created"`
+	Start   *time.Time `json:"start,omitempty"`
+	End     *time.Time `json:"end,omitempty"`
+	// Reservations lists the reservations still holding the device when it
+	// was drained.
+	Reservations []string `json:"reservations,omitempty"`
+}
+
+// active reports whether the drain is in effect at the given time.
+func (d *Drain) active(now time.Time) bool {
+	return (d.Start == nil || !now.Before(*d.Start)) && (d.End == nil || now.Before(*d.End))
+}
+
+// wholeDevice reports whether the drain covers the device rather than some
+// of its ports.
+func (d *Drain) wholeDevice() bool {
+	return len(d.Ports) == 0
+}
+
+// details describes the drain in events.
+func (d *Drain) details() map[string]string {
+	details := map[string]string{"by": d.By}
+	if d.Reason != "" {
+		details["reason"] = d.Reason
+	}
+	if len(d.Ports) > 0 {
+		details["ports"] = strings.Join(d.Ports, ",")
+	}
+	if d.End != nil {
+		details["end"] = d.End.Format(time.RFC3339)
+	}
+	return details
+}
+
+// drainExclusions adds the drained devices and ports to the exclusions of an
+// inventory view. The caller must hold inventoryMu.
+func drainExclusions(excludedNodes map[*graph.ConcreteNode]bool, excludedPorts map[*graph.ConcretePort]bool) {
+	now := time.Now()
+	for name, d := range drains {
+		node, ok := inventoryNodes[name]
+		if !ok || !d.active(now) {
+			continue
+		}
+		if d.wholeDevice() {
+			excludedNodes[node] = true
+			continue
+		}
+		for _, port := range d.Ports {
+			if p, ok := inventoryPorts[name+":"+port]; ok {
+				excludedPorts[p] = true
+			}
+		}
+	}
+}
+
+// inMaintenance reports whether a device is drained as a whole at the moment.
+// The caller must hold inventoryMu.
+func inMaintenance(device string) bool {
+	d, ok := drains[device]
+	return ok && d.wholeDevice() && d.active(time.Now())
+}
+
+// holdingReservations lists the reservations holding a device. The caller
+// must hold inventoryMu.
+func holdingReservations(device string) []string {
+	ids := []string{}
+	for _, r := range reservations {
+		if !r.holds() && r.Status != statusPending {
+			continue
+		}
+		for _, name := range r.Devices {
+			if name == device {
+				ids = append(ids, r.ID)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// netboxState is the NetBox state of a device back in service: reserved if
+// a reservation holds it, available otherwise. The caller must hold
+// inventoryMu.
+func netboxState(device string) string {
+	if len(holdingReservations(device)) > 0 {
+		return utils.StateReserved
+	}
+	return utils.StateAvailable
+}
+
+// DrainRequest is the body of a drain request. Without Ports the whole device
+// is drained.
+type DrainRequest struct {
+	Ports  []string   `json:"ports,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+	Start  *time.Time `json:"start,omitempty"`
+	End    *time.Time `json:"end,omitempty"`
+}
+
+func drainDevice(c *gin.Context) {
+	request := DrainRequest{}
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+	}
+	name := c.Param("name")
+	now := time.Now()
+	if request.Start != nil && request.End != nil && !request.End.After(*request.Start) {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "maintenance window must end after it starts"})
+		return
+	}
+	if request.End != nil && !request.End.After(now) {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "maintenance window is already over"})
+		return
+	}
+
+	inventoryMu.Lock()
+	if _, ok := inventoryNodes[name]; !ok {
+		inventoryMu.Unlock()
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("device %q not found", name)})
+		return
+	}
+	for _, port := range request.Ports {
+		if _, ok := inventoryPorts[name+":"+port]; !ok {
+			inventoryMu.Unlock()
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("device %q has no port %q", name, port)})
+			return
+		}
+	}
+	d := &Drain{
+		Device:       name,
+		Ports:        request.Ports,
+		Reason:       request.Reason,
+		By:           auth.PrincipalOf(c).Name,
+		Created:      now,
+		Start:        request.Start,
+		End:          request.End,
+		Reservations: holdingReservations(name),
+	}
+	drains[name] = d
+	inventoryMu.Unlock()
+
+	if d.Start != nil && d.Start.After(now) {
+		time.AfterFunc(d.Start.Sub(now), func() { startDrain(d) })
+	} else {
+		startDrain(d)
+	}
+	if d.End != nil {
+		time.AfterFunc(d.End.Sub(now), func() { endDrain(d) })
+	}
+	c.IndentedJSON(http.StatusOK, d)
+}
+
+// restoreDeviceStates takes out of service again, after a restart, the
+// devices NetBox shows in maintenance, quarantined or being cleaned up: a
+// device in maintenance is drained, and a quarantined device or one whose
+// cleanup was interrupted is quarantined until released.
+func restoreDeviceStates() {
+	now := time.Now()
+	quarantined := map[string]error{}
+	inventoryMu.Lock()
+	for name, device := range inventoryConfig.Devices {
+		switch device.State {
+		case utils.StateMaintenance:
+			if _, ok := drains[name]; !ok {
+				drains[name] = &Drain{Device: name, Reason: "in maintenance in NetBox at startup", By: audit.System, Created: now}
+			}
+		case utils.StateQuarantined:
+			quarantined[name] = fmt.Errorf("quarantined in NetBox at startup")
+		case utils.StateCleaning:
+			quarantined[name] = fmt.Errorf("cleanup interrupted by a restart")
+		}
+	}
+	inventoryMu.Unlock()
+	for name, reason := range quarantined {
+		log.Printf("Device %s: %v", name, reason)
+		healthChecker.Quarantine(name, reason)
+	}
+}
+
+// startDrain marks a drained device in maintenance in NetBox when its drain
+// takes effect, unless the drain was lifted or replaced in the meantime.
+func startDrain(d *Drain) {
+	inventoryMu.RLock()
+	current := drains[d.Device] == d
+	inventoryMu.RUnlock()
+	if !current {
+		return
+	}
+	publishDevice(events.DeviceDrained, d.Device, d.details())
+	if d.wholeDevice() {
+		setNetboxState([]string{d.Device}, utils.StateMaintenance)
+	}
+}
+
+// endDrain lifts a drain at the end of its maintenance window, unless it was
+// lifted or replaced in the meantime.
+func endDrain(d *Drain) {
+	inventoryMu.Lock()
+	if drains[d.Device] != d {
+		inventoryMu.Unlock()
+		return
+	}
+	undrainLocked(d)
+}
+
+// undrainLocked lifts a drain, puts the device back in service in NetBox and
+// lets queued reservations use it. The caller must hold inventoryMu, which is
+// released.
+func undrainLocked(d *Drain) {
+	delete(drains, d.Device)
+	state := netboxState(d.Device)
+	publishDevice(events.DeviceUndrained, d.Device, d.details())
+	inventoryMu.Unlock()
+	if d.wholeDevice() {
+		setNetboxState([]string{d.Device}, state)
+	}
+	go dispatchQueue()
+}
+
+func undrainDevice(c *gin.Context) {
+	name := c.Param("name")
+	inventoryMu.Lock()
+	d, ok := drains[name]
+	if !ok {
+		inventoryMu.Unlock()
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("device %q is not drained", name)})
+		return
+	}
+	undrainLocked(d)
+	c.IndentedJSON(http.StatusOK, d)
+}
+
+func listDrains(c *gin.Context) {
+	inventoryMu.RLock()
+	list := []Drain{}
+	for _, name := range sortedKeys(drains) {
+		list = append(list, *drains[name])
+	}
+	inventoryMu.RUnlock()
+	c.IndentedJSON(http.StatusOK, list)
+}
@@ -0,0 +1,154 @@
+// Package events publishes the lifecycle events of reservations and devices
+// to in-process subscribers, such as server-sent event streams, and to
+// webhooks.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	Reserved           = "reserved"
+	Pending            = "pending"
+	Queued             = "queued"
+	Preempted          = "preempted"
+	Released           = "released"
+	Expired            = "expired"
+	Renewed            = "renewed"
+	DeviceDrained      = "device_drained"
+	DeviceUndrained    = "device_undrained"
+	DeviceQuarantined  = "device_quarantined"
+	InventoryRefreshed = "inventory_refreshed"
+)
+
+// Event is something that happened to a reservation or to devices.
+type Event struct {
+	ID          uint64            `json:"id"`
+	Type        string            `json:"type"`
+	Time        time.Time         `json:"time"`
+	Reservation string            `json:"reservation,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Team        string            `json:"team,omitempty"`
+	Devices     []string          `json:"devices,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+}
+
+// Bus hands published events to its subscribers and keeps the latest ones
+// for subscribers catching up.
+type Bus struct {
+	mu          sync.Mutex
+	next        uint64
+	history     []Event
+	keep        int
+	subscribers map[*Subscription]bool
+}
+
+// NewBus returns a bus keeping the latest keep events.
+func NewBus(keep int) *Bus {
+	return &Bus{next: 1, keep: keep, subscribers: map[*Subscription]bool{}}
+}
+
+// Subscription receives the events of a bus on C. A subscriber too slow to
+// keep up is dropped, and C closed, unless it subscribed to lose its oldest
+// events instead.
+type Subscription struct {
+	C       <-chan Event
+	c       chan Event
+	types   map[string]bool
+	dropped func(Event)
+}
+
+func (s *Subscription) wants(e Event) bool {
+	return len(s.types) == 0 || s.types[e.Type]
+}
+
+// Publish numbers an event and hands it to the subscribers. It never blocks,
+// so events may be published with locks held.
+func (b *Bus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e.ID = b.next
+	b.next++
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.history = append(b.history, e)
+	if len(b.history) > b.keep {
+		b.history = b.history[len(b.history)-b.keep:]
+	}
+	for s := range b.subscribers {
+		if !s.wants(e) {
+			continue
+		}
+		select {
+		case s.c <- e:
+			continue
+		default:
+		}
+		if s.dropped == nil {
+			delete(b.subscribers, s)
+			close(s.c)
+			continue
+		}
+		// The bus is the only sender, so once the oldest event is out the
+		// send cannot block.
+		select {
+		case old := <-s.c:
+			s.dropped(old)
+		default:
+		}
+		s.c <- e
+	}
+}
+
+// Subscribe subscribes to the events of the given types, or to every event
+// without types. Kept events after the one numbered since are delivered
+// first.
+func (b *Bus) Subscribe(types []string, since uint64, buffer int) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := &Subscription{types: map[string]bool{}}
+	for _, t := range types {
+		s.types[t] = true
+	}
+	backlog := []Event{}
+	for _, e := range b.history {
+		if since > 0 && e.ID > since && s.wants(e) {
+			backlog = append(backlog, e)
+		}
+	}
+	s.c = make(chan Event, buffer+len(backlog))
+	s.C = s.c
+	for _, e := range backlog {
+		s.c <- e
+	}
+	b.subscribers[s] = true
+	return s
+}
+
+// SubscribeDroppingOldest subscribes to the events of the given types, or to
+// every event without types, keeping up to buffer events. When the buffer is
+// full the oldest event is lost to make room, and dropped is called with it,
+// the bus locked.
+func (b *Bus) SubscribeDroppingOldest(types []string, buffer int, dropped func(Event)) *Subscription {
+	if buffer < 1 {
+		buffer = 1
+	}
+	s := b.Subscribe(types, 0, buffer)
+	b.mu.Lock()
+	s.dropped = dropped
+	b.mu.Unlock()
+	return s
+}
+
+// Unsubscribe stops the events of a subscription and closes its channel.
+func (b *Bus) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[s] {
+		delete(b.subscribers, s)
+		close(s.c)
+	}
+}
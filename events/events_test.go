@@ -0,0 +1,110 @@
+package events
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	bus := NewBus(10)
+	s := bus.Subscribe(nil, 0, 2)
+	for i := 0; i < 3; i++ {
+		bus.Publish(Event{Type: Reserved})
+	}
+	got := 0
+	for range s.C {
+		got++
+	}
+	if got != 2 {
+		t.Errorf("got %d events before the channel closed, want 2", got)
+	}
+}
+
+func TestSubscribeDroppingOldest(t *testing.T) {
+	bus := NewBus(10)
+	dropped := []uint64{}
+	s := bus.SubscribeDroppingOldest([]string{Reserved}, 2, func(e Event) { dropped = append(dropped, e.ID) })
+	for i := 0; i < 5; i++ {
+		bus.Publish(Event{Type: Reserved})
+		bus.Publish(Event{Type: Released})
+	}
+	if len(dropped) != 3 || dropped[0] != 1 || dropped[2] != 5 {
+		t.Errorf("dropped %v, want events 1, 3 and 5", dropped)
+	}
+	for _, want := range []uint64{7, 9} {
+		if e := <-s.C; e.ID != want {
+			t.Errorf("got event %d, want %d", e.ID, want)
+		}
+	}
+	bus.Publish(Event{Type: Reserved})
+	if e := <-s.C; e.ID != 11 {
+		t.Errorf("got event %d after catching up, want 11", e.ID)
+	}
+}
+
+func TestLaggingWebhookKeepsReceivingEvents(t *testing.T) {
+	unblock := make(chan struct{})
+	var mu sync.Mutex
+	received := []uint64{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		json.NewDecoder(r.Body).Decode(&e)
+		mu.Lock()
+		received = append(received, e.ID)
+		first := len(received) == 1
+		mu.Unlock()
+		if first {
+			<-unblock
+		}
+	}))
+	defer server.Close()
+
+	bus := NewBus(10)
+	drops := 0
+	d := &Dispatcher{
+		Webhooks: []Webhook{{URL: server.URL}},
+		Attempts: 1,
+		OnDrop:   func(h Webhook, e Event) { drops++ },
+	}
+	d.Start(bus)
+	bus.Publish(Event{Type: Reserved})
+	// Wait for the first delivery to hold the webhook back.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("first event not delivered")
+		}
+	}
+	extra := 10
+	for i := 0; i < webhookBuffer+extra; i++ {
+		bus.Publish(Event{Type: Reserved})
+	}
+	close(unblock)
+	last := uint64(1 + webhookBuffer + extra)
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n, got := len(received), received[len(received)-1]
+		mu.Unlock()
+		if got == last {
+			if n != 1+webhookBuffer {
+				t.Errorf("received %d events, want %d", n, 1+webhookBuffer)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("last event received is %d, want %d", got, last)
+		}
+	}
+	if drops != extra {
+		t.Errorf("OnDrop called %d times, want %d", drops, extra)
+	}
+}
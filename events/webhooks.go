@@ -0,0 +1,139 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Webhook is an endpoint receiving events as JSON POSTs. When Secret is set,
+// deliveries are signed: X-LRS-Signature is "sha256=" followed by the hex
+// HMAC-SHA256, keyed by Secret, of X-LRS-Timestamp, a dot and the body.
+type Webhook struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"`
+	Types  []string `json:"types,omitempty"`
+}
+
+// LoadWebhooks reads a JSON list of webhooks.
+func LoadWebhooks(path string) ([]Webhook, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hooks := []Webhook{}
+	if err := json.Unmarshal(content, &hooks); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, h := range hooks {
+		if h.URL == "" {
+			return nil, fmt.Errorf("%s: webhook without a url", path)
+		}
+	}
+	return hooks, nil
+}
+
+// Sign returns the signature of a delivery.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher delivers the events of a bus to webhooks. A delivery failing
+// with a network error, a 429 or a 5xx status is retried up to Attempts
+// times in all, waiting Backoff and then twice as long after each attempt.
+// Each webhook gets its events in order, and a webhook that is down does not
+// hold back the others. A webhook falling behind by more than webhookBuffer
+// events loses the oldest ones; OnDrop, if set, is told of each.
+type Dispatcher struct {
+	Webhooks []Webhook
+	Attempts int
+	Backoff  time.Duration
+	Client   *http.Client
+	OnDrop   func(h Webhook, e Event)
+}
+
+// webhookBuffer is how many events may wait for a webhook before its oldest
+// ones are dropped.
+const webhookBuffer = 1000
+
+// Start subscribes each webhook to the bus.
+func (d *Dispatcher) Start(bus *Bus) {
+	for _, h := range d.Webhooks {
+		h := h
+		dropped := 0
+		s := bus.SubscribeDroppingOldest(h.Types, webhookBuffer, func(e Event) {
+			dropped++
+			log.Printf("Error: webhook %s fell behind, dropped event %d (%s), %d dropped so far", h.URL, e.ID, e.Type, dropped)
+			if d.OnDrop != nil {
+				d.OnDrop(h, e)
+			}
+		})
+		go func() {
+			for e := range s.C {
+				d.deliver(h, e)
+			}
+		}()
+	}
+}
+
+func (d *Dispatcher) deliver(h Webhook, e Event) {
+	body, _ := json.Marshal(e)
+	wait := d.Backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := d.post(h, e, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= d.Attempts {
+			log.Printf("Error delivering event %d to webhook %s: %v", e.ID, h.URL, err)
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// post makes one delivery attempt and reports whether a failure is worth
+// retrying.
+func (d *Dispatcher) post(h Webhook, e Event, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-LRS-Event", e.Type)
+	req.Header.Set("X-LRS-Delivery", strconv.FormatUint(e.ID, 10))
+	req.Header.Set("X-LRS-Timestamp", strconv.FormatInt(timestamp, 10))
+	if h.Secret != "" {
+		req.Header.Set("X-LRS-Signature", Sign(h.Secret, timestamp, body))
+	}
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"lablrs/events"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// eventBus carries the lifecycle events of reservations and devices to the
+// event streams and webhooks.
+var eventBus = events.NewBus(1000)
+
+// streamKeepalive is how often an idle event stream gets a comment, so that
+// proxies keep it open.
+const streamKeepalive = 30 * time.Second
+
+// ownerName names the user of a reservation, or else its owner.
+func ownerName(r *Reservation) string {
+	if r.User == "" && r.Owner != nil {
+		return r.Owner.Name
+	}
+	return r.User
+}
+
+// publishReservation publishes an event of a reservation. The caller must
+// hold inventoryMu.
+func publishReservation(typ string, r *Reservation, details map[string]string) {
+	eventBus.Publish(events.Event{
+		Type:        typ,
+		Reservation: r.ID,
+		Owner:       ownerName(r),
+		Team:        r.Team,
+		Devices:     append([]string{}, r.Devices...),
+		Details:     details,
+	})
+}
+
+// publishDevice publishes an event of a device, or of the inventory without
+// a device.
+func publishDevice(typ, device string, details map[string]string) {
+	e := events.Event{Type: typ, Details: details}
+	if device != "" {
+		e.Devices = []string{device}
+	}
+	eventBus.Publish(e)
+}
+
+// streamEvents streams events as server-sent events. The types query
+// parameter limits the stream to a comma separated list of event types.
+// Clients reconnecting with Last-Event-ID, or the since query parameter, get
+// the recent events they missed first.
+func streamEvents(c *gin.Context) {
+	types := []string{}
+	for _, t := range strings.Split(c.Query("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	lastID := c.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.Query("since")
+	}
+	var since uint64
+	if lastID != "" {
+		var err error
+		if since, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid event ID %q", lastID)})
+			return
+		}
+	}
+	sub := eventBus.Subscribe(types, since, 100)
+	defer eventBus.Unsubscribe(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// Clients wait for the headers before reading events
+	c.Writer.WriteHeader(http.StatusOK)
+	c.Writer.Flush()
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				return false
+			}
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+			return true
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
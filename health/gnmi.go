@@ -0,0 +1,89 @@
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	gpb "github.com/openconfig/gnmi/proto/gnmi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// GNMI checks that the gNMI service of a device answers a Capabilities call.
+// The call is made over TLS unless Plaintext is set; InsecureSkipVerify
+// accepts the self-signed certificates devices often have. Username and
+// Password are sent as gRPC metadata when set.
+type GNMI struct {
+	Plaintext          bool
+	InsecureSkipVerify bool
+	Username           string
+	Password           string
+}
+
+func (p GNMI) Probe(ctx context.Context, t Target) error {
+	addr, ok := gnmiAddress(t)
+	if !ok {
+		return fmt.Errorf("no gNMI service: %w", ErrNoService)
+	}
+	return p.call(ctx, addr, func(ctx context.Context, c gpb.GNMIClient) error {
+		if _, err := c.Capabilities(ctx, &gpb.CapabilityRequest{}); err != nil {
+			return fmt.Errorf("gNMI Capabilities failed: %v", err)
+		}
+		return nil
+	})
+}
+
+// Replace replaces the whole configuration of a device with config, in JSON
+// IETF encoding, with a gNMI Set.
+func (p GNMI) Replace(ctx context.Context, t Target, config []byte) error {
+	addr, ok := gnmiAddress(t)
+	if !ok {
+		return fmt.Errorf("%s has no gNMI service", t.Device)
+	}
+	return p.call(ctx, addr, func(ctx context.Context, c gpb.GNMIClient) error {
+		_, err := c.Set(ctx, &gpb.SetRequest{
+			Replace: []*gpb.Update{{
+				Path: &gpb.Path{},
+				Val:  &gpb.TypedValue{Value: &gpb.TypedValue_JsonIetfVal{JsonIetfVal: config}},
+			}},
+		})
+		if err != nil {
+			return fmt.Errorf("gNMI Set failed: %v", err)
+		}
+		return nil
+	})
+}
+
+// gnmiAddress returns the address of the gNMI service of a device.
+func gnmiAddress(t Target) (string, bool) {
+	for _, s := range t.Services {
+		if strings.EqualFold(s.Name, "gnmi") {
+			return net.JoinHostPort(s.Address, strconv.Itoa(s.Port)), true
+		}
+	}
+	return "", false
+}
+
+// call connects to the gNMI service at addr for the duration of f, which is
+// given a context carrying the credentials.
+func (p GNMI) call(ctx context.Context, addr string, f func(context.Context, gpb.GNMIClient) error) error {
+	creds := insecure.NewCredentials()
+	if !p.Plaintext {
+		creds = credentials.NewTLS(&tls.Config{InsecureSkipVerify: p.InsecureSkipVerify})
+	}
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if p.Username != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "username", p.Username, "password", p.Password)
+	}
+	return f(ctx, gpb.NewGNMIClient(conn))
+}
@@ -0,0 +1,162 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	gpb "github.com/openconfig/gnmi/proto/gnmi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakeGNMI is a gNMI server answering the LLDP neighbors of its ports, as one
+// JSON container or leaf by leaf.
+type fakeGNMI struct {
+	gpb.UnimplementedGNMIServer
+	neighbors map[string][]Neighbor
+	leafwise  bool
+	username  string
+	replaced  []byte
+}
+
+func (s *fakeGNMI) Capabilities(ctx context.Context, req *gpb.CapabilityRequest) (*gpb.CapabilityResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if u := md.Get("username"); len(u) > 0 {
+		s.username = u[0]
+	}
+	return &gpb.CapabilityResponse{GNMIVersion: "0.10.0"}, nil
+}
+
+func (s *fakeGNMI) Set(ctx context.Context, req *gpb.SetRequest) (*gpb.SetResponse, error) {
+	s.replaced = req.GetReplace()[0].GetVal().GetJsonIetfVal()
+	return &gpb.SetResponse{}, nil
+}
+
+func (s *fakeGNMI) Get(ctx context.Context, req *gpb.GetRequest) (*gpb.GetResponse, error) {
+	elems := req.GetPath()[0].GetElem()
+	if len(elems) != 4 || elems[0].GetName() != "lldp" || elems[3].GetName() != "neighbors" {
+		return nil, status.Error(codes.NotFound, "unknown path")
+	}
+	port := elems[2].GetKey()["name"]
+	neighbors := s.neighbors[port]
+	notification := &gpb.Notification{Prefix: &gpb.Path{Elem: elems}}
+	if s.leafwise {
+		for i, n := range neighbors {
+			for leaf, value := range map[string]string{"system-name": n.SystemName, "port-id": n.PortID} {
+				notification.Update = append(notification.Update, &gpb.Update{
+					Path: &gpb.Path{Elem: []*gpb.PathElem{{Name: "neighbor", Key: map[string]string{"id": strconv.Itoa(i)}}, {Name: "state"}, {Name: leaf}}},
+					Val:  &gpb.TypedValue{Value: &gpb.TypedValue_StringVal{StringVal: value}},
+				})
+			}
+		}
+		return &gpb.GetResponse{Notification: []*gpb.Notification{notification}}, nil
+	}
+	list := []map[string]interface{}{}
+	for i, n := range neighbors {
+		list = append(list, map[string]interface{}{"id": strconv.Itoa(i), "state": map[string]interface{}{
+			"openconfig-lldp:system-name": n.SystemName,
+			"openconfig-lldp:port-id":     n.PortID,
+		}})
+	}
+	value, _ := json.Marshal(map[string]interface{}{"openconfig-lldp:neighbor": list})
+	notification.Update = []*gpb.Update{{Path: &gpb.Path{}, Val: &gpb.TypedValue{Value: &gpb.TypedValue_JsonIetfVal{JsonIetfVal: value}}}}
+	return &gpb.GetResponse{Notification: []*gpb.Notification{notification}}, nil
+}
+
+// serveGNMI serves a fake gNMI server in the background and returns a target
+// of the device reaching it.
+func serveGNMI(t *testing.T, device string, s *fakeGNMI) Target {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	gpb.RegisterGNMIServer(server, s)
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+	return Target{Device: device, Services: []Service{{Name: "gnmi", Address: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port}}}
+}
+
+func TestGNMIProbeAndReplace(t *testing.T) {
+	s := &fakeGNMI{}
+	target := serveGNMI(t, "dut1", s)
+	client := GNMI{Plaintext: true, Username: "admin", Password: "secret"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Probe(ctx, target); err != nil {
+		t.Fatalf("Probe: %v", err)
+	}
+	if s.username != "admin" {
+		t.Errorf("username = %q, want admin", s.username)
+	}
+	if err := client.Replace(ctx, target, []byte(`{"system":{}}`)); err != nil {
+		t.Fatalf("Replace: %v", err)
+	}
+	if string(s.replaced) != `{"system":{}}` {
+		t.Errorf("replaced config = %s", s.replaced)
+	}
+	if err := client.Probe(ctx, Target{Device: "ate1"}); !errors.Is(err, ErrNoService) {
+		t.Errorf("Probe without gNMI = %v, want ErrNoService", err)
+	}
+}
+
+func TestGNMIProbeUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	target := Target{Device: "dut1", Services: []Service{{Name: "gnmi", Address: "127.0.0.1", Port: port}}}
+	if err := (GNMI{Plaintext: true}).Probe(ctx, target); err == nil || errors.Is(err, ErrNoService) {
+		t.Errorf("Probe of a closed port = %v, want a failure", err)
+	}
+}
+
+func TestVerifyLinksOverGNMI(t *testing.T) {
+	for _, leafwise := range []bool{false, true} {
+		for _, tc := range []struct {
+			name    string
+			seen    map[string][]Neighbor // by port of dut1
+			strict  bool
+			wantErr string
+		}{
+			{name: "good", seen: map[string][]Neighbor{"e0": {{SystemName: "dut2.lab.example", PortID: "e1"}}}},
+			{name: "swapped", seen: map[string][]Neighbor{"e0": {{SystemName: "dut2", PortID: "e2"}}}, wantErr: "dut1:e0 sees dut2:e2 instead of dut2:e1"},
+			{name: "missing", seen: map[string][]Neighbor{}},
+			{name: "missing strict", seen: map[string][]Neighbor{}, strict: true, wantErr: "dut1:e0 sees no LLDP neighbor"},
+		} {
+			dut1 := serveGNMI(t, "dut1", &fakeGNMI{neighbors: tc.seen, leafwise: leafwise})
+			dut2 := serveGNMI(t, "dut2", &fakeGNMI{neighbors: map[string][]Neighbor{"e1": {{SystemName: "dut1", PortID: "e0"}}}, leafwise: leafwise})
+			ate := Target{Device: "ate1"}
+			v := &LinkVerifier{Source: GNMI{Plaintext: true}, Timeout: 5 * time.Second, Strict: tc.strict}
+			links := []Link{
+				{A: Endpoint{dut1, "e0"}, B: Endpoint{dut2, "e1"}},
+				// ATEs have no gNMI service: only the DUT end is checked.
+				{A: Endpoint{ate, "p0"}, B: Endpoint{dut2, "e1"}},
+			}
+			bad := v.Verify(context.Background(), links[:1])
+			err := bad[links[0].String()]
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("%s (leafwise %v): %v", tc.name, leafwise, err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Errorf("%s (leafwise %v): got %v, want %q", tc.name, leafwise, err, tc.wantErr)
+			}
+			if bad := v.Verify(context.Background(), links[1:]); len(bad) != 1 {
+				t.Errorf("%s (leafwise %v): ATE link = %v, want dut2:e1 to see dut1 instead of ate1", tc.name, leafwise, bad)
+			}
+		}
+	}
+}
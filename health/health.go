@@ -0,0 +1,232 @@
+// Package health probes devices before they are handed out. A Checker runs a
+// Prober against candidate devices, remembers recent failures so the solver
+// can avoid those devices, and quarantines devices that keep failing.
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Service is a management service of a device, such as gNMI or SSH.
+type Service struct {
+	Name     string
+	Address  string
+	Port     int
+	Protocol string
+}
+
+// Target is a device to probe.
+type Target struct {
+	Device   string
+	Services []Service
+}
+
+// ErrNoService is returned, possibly wrapped, by probers finding no service
+// of a device to probe.
+var ErrNoService = errors.New("no service to probe")
+
+// Prober checks that a device is usable. It returns nil for a healthy device,
+// and ErrNoService when it has nothing to probe.
+type Prober interface {
+	Probe(ctx context.Context, t Target) error
+}
+
+// ProberFunc adapts a function to the Prober interface, e.g. to fake probes.
+type ProberFunc func(ctx context.Context, t Target) error
+
+func (f ProberFunc) Probe(ctx context.Context, t Target) error {
+	return f(ctx, t)
+}
+
+// All is a Prober requiring every one of its probers to succeed. Probers
+// with nothing to probe are skipped; All returns ErrNoService only when none
+// of them had anything to probe.
+type All []Prober
+
+func (a All) Probe(ctx context.Context, t Target) error {
+	var unchecked error
+	checked := false
+	for _, p := range a {
+		err := p.Probe(ctx, t)
+		if errors.Is(err, ErrNoService) {
+			unchecked = err
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		checked = true
+	}
+	if checked {
+		return nil
+	}
+	return unchecked
+}
+
+// DeviceHealth is what the checker knows of a device.
+type DeviceHealth struct {
+	Device      string    `json:"device"`
+	Failures    int       `json:"consecutive_failures"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastChecked time.Time `json:"last_checked"`
+	Quarantined bool      `json:"quarantined"`
+	// Unchecked is set when the device had no service to probe.
+	Unchecked bool `json:"unchecked,omitempty"`
+}
+
+// Checker probes devices and keeps their health. A device that failed its
+// last probe is unhealthy until RecheckAfter has passed; after
+// QuarantineAfter consecutive failures it is quarantined until released.
+// Without a Prober devices are only quarantined through Quarantine. A device
+// with no service to probe passes, reported as unchecked, unless
+// FailUnchecked is set.
+type Checker struct {
+	Prober          Prober
+	Timeout         time.Duration
+	RecheckAfter    time.Duration
+	QuarantineAfter int
+	FailUnchecked   bool
+	// OnQuarantine is called, without locks held, when a device is
+	// quarantined.
+	OnQuarantine func(device string)
+
+	mu      sync.Mutex
+	devices map[string]*DeviceHealth
+}
+
+// Check probes the targets in parallel and returns the error of each device
+// that failed.
+func (c *Checker) Check(ctx context.Context, targets []Target) map[string]error {
+	type result struct {
+		device string
+		err    error
+	}
+	results := make(chan result, len(targets))
+	for _, t := range targets {
+		go func(t Target) {
+			probeCtx, cancel := context.WithTimeout(ctx, c.Timeout)
+			defer cancel()
+			results <- result{t.Device, c.Prober.Probe(probeCtx, t)}
+		}(t)
+	}
+	failed := map[string]error{}
+	quarantined := []string{}
+	c.mu.Lock()
+	if c.devices == nil {
+		c.devices = map[string]*DeviceHealth{}
+	}
+	for range targets {
+		r := <-results
+		h, ok := c.devices[r.device]
+		if !ok {
+			h = &DeviceHealth{Device: r.device}
+			c.devices[r.device] = h
+		}
+		h.LastChecked = time.Now()
+		h.Unchecked = errors.Is(r.err, ErrNoService)
+		if h.Unchecked && !c.FailUnchecked {
+			h.Failures, h.LastError = 0, r.err.Error()
+			continue
+		}
+		if r.err == nil {
+			h.Failures, h.LastError = 0, ""
+			continue
+		}
+		failed[r.device] = r.err
+		h.Failures++
+		h.LastError = r.err.Error()
+		if c.QuarantineAfter > 0 && h.Failures >= c.QuarantineAfter && !h.Quarantined {
+			h.Quarantined = true
+			quarantined = append(quarantined, r.device)
+		}
+	}
+	c.mu.Unlock()
+	if c.OnQuarantine != nil {
+		for _, device := range quarantined {
+			c.OnQuarantine(device)
+		}
+	}
+	return failed
+}
+
+// Quarantine quarantines a device that failed otherwise than by its probe,
+// e.g. its cleanup after a release.
+func (c *Checker) Quarantine(device string, reason error) {
+	c.mu.Lock()
+	if c.devices == nil {
+		c.devices = map[string]*DeviceHealth{}
+	}
+	h, ok := c.devices[device]
+	if !ok {
+		h = &DeviceHealth{Device: device}
+		c.devices[device] = h
+	}
+	h.LastError = reason.Error()
+	h.LastChecked = time.Now()
+	quarantined := !h.Quarantined
+	h.Quarantined = true
+	c.mu.Unlock()
+	if quarantined && c.OnQuarantine != nil {
+		c.OnQuarantine(device)
+	}
+}
+
+// Unhealthy reports whether a device is quarantined or recently failed.
+func (c *Checker) Unhealthy(device string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.devices[device]
+	if !ok {
+		return false
+	}
+	return h.Quarantined || (h.Failures > 0 && time.Since(h.LastChecked) < c.RecheckAfter)
+}
+
+// Quarantined reports whether a device is quarantined.
+func (c *Checker) Quarantined(device string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.devices[device]
+	return ok && h.Quarantined
+}
+
+// Release lifts the quarantine of a device. It returns false if the device
+// was not quarantined.
+func (c *Checker) Release(device string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.devices[device]
+	if !ok || !h.Quarantined {
+		return false
+	}
+	delete(c.devices, device)
+	return true
+}
+
+// Status lists the devices that were probed, by name.
+func (c *Checker) Status() []DeviceHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := []DeviceHealth{}
+	for _, h := range c.devices {
+		list = append(list, *h)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Device < list[j].Device })
+	return list
+}
+
+// Summary describes the failures returned by Check.
+func Summary(failed map[string]error) string {
+	msgs := []string{}
+	for device, err := range failed {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", device, err))
+	}
+	sort.Strings(msgs)
+	return strings.Join(msgs, "; ")
+}
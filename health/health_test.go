@@ -0,0 +1,199 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// failing returns a prober failing for the given devices.
+func failing(devices ...string) ProberFunc {
+	bad := map[string]bool{}
+	for _, d := range devices {
+		bad[d] = true
+	}
+	return func(ctx context.Context, t Target) error {
+		if bad[t.Device] {
+			return errors.New("unreachable")
+		}
+		return nil
+	}
+}
+
+func targets(devices ...string) []Target {
+	list := []Target{}
+	for _, d := range devices {
+		list = append(list, Target{Device: d})
+	}
+	return list
+}
+
+func TestCheckQuarantinesAfterConsecutiveFailures(t *testing.T) {
+	quarantined := []string{}
+	c := &Checker{
+		Prober:          failing("bad"),
+		Timeout:         time.Second,
+		RecheckAfter:    time.Hour,
+		QuarantineAfter: 3,
+		OnQuarantine:    func(device string) { quarantined = append(quarantined, device) },
+	}
+	for i := 1; i <= 4; i++ {
+		failed := c.Check(context.Background(), targets("bad", "good"))
+		if _, ok := failed["bad"]; !ok || len(failed) != 1 {
+			t.Fatalf("check %d: failed = %v, want only bad", i, failed)
+		}
+		wantQuarantined := 0
+		if i >= 3 {
+			wantQuarantined = 1
+		}
+		if len(quarantined) != wantQuarantined {
+			t.Errorf("check %d: quarantined %v, want %d device", i, quarantined, wantQuarantined)
+		}
+	}
+	if !c.Unhealthy("bad") || c.Unhealthy("good") {
+		t.Errorf("Unhealthy(bad), Unhealthy(good) = %v, %v, want true, false", c.Unhealthy("bad"), c.Unhealthy("good"))
+	}
+	if !c.Release("bad") {
+		t.Fatal("Release(bad) = false, want true")
+	}
+	if c.Unhealthy("bad") {
+		t.Error("bad still unhealthy after its release")
+	}
+	if c.Release("good") {
+		t.Error("Release(good) = true for a device never quarantined")
+	}
+}
+
+func TestCheckSuccessResetsFailures(t *testing.T) {
+	bad := true
+	c := &Checker{
+		Prober: ProberFunc(func(ctx context.Context, t Target) error {
+			if bad {
+				return errors.New("unreachable")
+			}
+			return nil
+		}),
+		Timeout:         time.Second,
+		RecheckAfter:    time.Hour,
+		QuarantineAfter: 2,
+	}
+	c.Check(context.Background(), targets("d"))
+	bad = false
+	c.Check(context.Background(), targets("d"))
+	bad = true
+	c.Check(context.Background(), targets("d"))
+	if status := c.Status(); len(status) != 1 || status[0].Failures != 1 || status[0].Quarantined {
+		t.Errorf("Status() = %+v, want one failure and no quarantine", status)
+	}
+}
+
+func TestUnhealthyUntilRecheckAfter(t *testing.T) {
+	c := &Checker{Prober: failing("bad"), Timeout: time.Second, RecheckAfter: 50 * time.Millisecond}
+	c.Check(context.Background(), targets("bad"))
+	if !c.Unhealthy("bad") {
+		t.Fatal("device not unhealthy right after failing its check")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if c.Unhealthy("bad") {
+		t.Error("device still unhealthy after recheck_after")
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	c := &Checker{
+		Prober: ProberFunc(func(ctx context.Context, t Target) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+		Timeout:      20 * time.Millisecond,
+		RecheckAfter: time.Hour,
+	}
+	failed := c.Check(context.Background(), targets("slow"))
+	if !errors.Is(failed["slow"], context.DeadlineExceeded) {
+		t.Errorf("failed[slow] = %v, want %v", failed["slow"], context.DeadlineExceeded)
+	}
+}
+
+func TestUncheckedDevices(t *testing.T) {
+	noService := ProberFunc(func(ctx context.Context, t Target) error { return ErrNoService })
+	c := &Checker{Prober: noService, Timeout: time.Second, RecheckAfter: time.Hour, QuarantineAfter: 1}
+	if failed := c.Check(context.Background(), targets("d")); len(failed) != 0 {
+		t.Errorf("failed = %v, want none", failed)
+	}
+	if status := c.Status(); len(status) != 1 || !status[0].Unchecked || status[0].Quarantined {
+		t.Errorf("Status() = %+v, want d unchecked", status)
+	}
+
+	c = &Checker{Prober: noService, Timeout: time.Second, RecheckAfter: time.Hour, QuarantineAfter: 1, FailUnchecked: true}
+	if failed := c.Check(context.Background(), targets("d")); !errors.Is(failed["d"], ErrNoService) {
+		t.Errorf("failed = %v, want d failing with %v", failed, ErrNoService)
+	}
+	if !c.Unhealthy("d") {
+		t.Error("unchecked device healthy with FailUnchecked")
+	}
+}
+
+func TestAll(t *testing.T) {
+	ok := ProberFunc(func(ctx context.Context, t Target) error { return nil })
+	noService := ProberFunc(func(ctx context.Context, t Target) error { return ErrNoService })
+	bad := failing("d")
+	for _, tc := range []struct {
+		name string
+		all  All
+		want error
+	}{
+		{"all pass", All{ok, ok}, nil},
+		{"one has nothing to probe", All{noService, ok}, nil},
+		{"none has anything to probe", All{noService, noService}, ErrNoService},
+		{"one fails", All{ok, noService, bad}, errors.New("unreachable")},
+	} {
+		err := tc.all.Probe(context.Background(), Target{Device: "d"})
+		if (err == nil) != (tc.want == nil) || (err != nil && err.Error() != tc.want.Error()) {
+			t.Errorf("%s: Probe() = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	open := listener.Addr().(*net.TCPAddr).Port
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	service := func(name string, port int) Service {
+		return Service{Name: name, Address: "127.0.0.1", Port: port, Protocol: "tcp"}
+	}
+	for _, tc := range []struct {
+		name     string
+		services []Service
+		names    []string
+		wantErr  bool
+		noneErr  bool
+	}{
+		{name: "open", services: []Service{service("ssh", open)}},
+		{name: "closed", services: []Service{service("ssh", open), service("gnmi", closedPort)}, wantErr: true},
+		{name: "closed but not checked", services: []Service{service("ssh", open), service("gnmi", closedPort)}, names: []string{"ssh"}},
+		{name: "no service", noneErr: true},
+		{name: "udp only", services: []Service{{Name: "snmp", Address: "127.0.0.1", Port: 161, Protocol: "udp"}}, noneErr: true},
+	} {
+		err := TCP{Names: tc.names}.Probe(context.Background(), Target{Device: "d", Services: tc.services})
+		switch {
+		case tc.noneErr:
+			if !errors.Is(err, ErrNoService) {
+				t.Errorf("%s: Probe() = %v, want %v", tc.name, err, ErrNoService)
+			}
+		case tc.wantErr != (err != nil):
+			t.Errorf("%s: Probe() = %v, want error %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
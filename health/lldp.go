@@ -0,0 +1,243 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	gpb "github.com/openconfig/gnmi/proto/gnmi"
+)
+
+// Neighbor is an LLDP neighbor seen on a port.
+type Neighbor struct {
+	SystemName      string `json:"system_name,omitempty"`
+	PortID          string `json:"port_id,omitempty"`
+	PortDescription string `json:"port_description,omitempty"`
+}
+
+// ErrNoNeighbors is returned by neighbor sources that cannot query a device,
+// e.g. one without a gNMI service.
+var ErrNoNeighbors = errors.New("no neighbor source for the device")
+
+// NeighborSource reports the LLDP neighbors a device sees on one of its
+// ports.
+type NeighborSource interface {
+	Neighbors(ctx context.Context, t Target, port string) ([]Neighbor, error)
+}
+
+// Endpoint is one end of a link.
+type Endpoint struct {
+	Target Target
+	Port   string
+}
+
+// Link is a cable between two ports, as the inventory has it.
+type Link struct {
+	A, B Endpoint
+}
+
+func (l Link) String() string {
+	return fmt.Sprintf("%s:%s-%s:%s", l.A.Target.Device, l.A.Port, l.B.Target.Device, l.B.Port)
+}
+
+// LinkVerifier checks that links are cabled as the inventory has them, from
+// the LLDP neighbors each end reports. A link is bad when an end sees a
+// neighbor on the port other than the other end. Ends seeing no neighbor at
+// all, such as ports of ATEs not running LLDP, only fail the link when Strict
+// is set.
+type LinkVerifier struct {
+	Source  NeighborSource
+	Timeout time.Duration
+	Strict  bool
+}
+
+// Verify checks the links in parallel and returns the error of each bad one,
+// by link name.
+func (v *LinkVerifier) Verify(ctx context.Context, links []Link) map[string]error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	bad := map[string]error{}
+	for _, l := range links {
+		wg.Add(1)
+		go func(l Link) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, v.Timeout)
+			defer cancel()
+			if err := v.verify(ctx, l); err != nil {
+				mu.Lock()
+				bad[l.String()] = err
+				mu.Unlock()
+			}
+		}(l)
+	}
+	wg.Wait()
+	return bad
+}
+
+func (v *LinkVerifier) verify(ctx context.Context, l Link) error {
+	for _, ends := range [][2]Endpoint{{l.A, l.B}, {l.B, l.A}} {
+		local, peer := ends[0], ends[1]
+		neighbors, err := v.Source.Neighbors(ctx, local.Target, local.Port)
+		if errors.Is(err, ErrNoNeighbors) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%s: %v", local.Target.Device, local.Port, err)
+		}
+		if len(neighbors) == 0 {
+			if v.Strict {
+				return fmt.Errorf("%s:%s sees no LLDP neighbor", local.Target.Device, local.Port)
+			}
+			continue
+		}
+		found := false
+		for _, n := range neighbors {
+			if n.matches(peer) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			n := neighbors[0]
+			return fmt.Errorf("%s:%s sees %s:%s instead of %s:%s", local.Target.Device, local.Port, n.SystemName, n.portName(), peer.Target.Device, peer.Port)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the neighbor is the endpoint. The system name may be
+// a fully qualified name of the device, and the port may be named by its ID
+// or its description.
+func (n Neighbor) matches(e Endpoint) bool {
+	device := strings.ToLower(e.Target.Device)
+	system := strings.ToLower(n.SystemName)
+	if system != device && !strings.HasPrefix(system, device+".") {
+		return false
+	}
+	return strings.EqualFold(n.PortID, e.Port) || strings.EqualFold(n.PortDescription, e.Port)
+}
+
+func (n Neighbor) portName() string {
+	if n.PortID != "" {
+		return n.PortID
+	}
+	return n.PortDescription
+}
+
+// Neighbors gets the state of the LLDP neighbors of a port with a gNMI Get of
+// /lldp/interfaces/interface[name=port]/neighbors. Devices may answer with the
+// container as JSON or leaf by leaf.
+func (p GNMI) Neighbors(ctx context.Context, t Target, port string) ([]Neighbor, error) {
+	addr, ok := gnmiAddress(t)
+	if !ok {
+		return nil, ErrNoNeighbors
+	}
+	var resp *gpb.GetResponse
+	err := p.call(ctx, addr, func(ctx context.Context, c gpb.GNMIClient) error {
+		var err error
+		resp, err = c.Get(ctx, &gpb.GetRequest{
+			Path: []*gpb.Path{{Elem: []*gpb.PathElem{
+				{Name: "lldp"},
+				{Name: "interfaces"},
+				{Name: "interface", Key: map[string]string{"name": port}},
+				{Name: "neighbors"},
+			}}},
+			Type:     gpb.GetRequest_STATE,
+			Encoding: gpb.Encoding_JSON_IETF,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("gNMI Get failed: %v", err)
+	}
+	return parseNeighbors(resp)
+}
+
+// parseNeighbors reads the LLDP neighbors of a GetResponse. Updates holding
+// JSON are searched for neighbor states; scalar updates are grouped by the
+// neighbor id in their path.
+func parseNeighbors(resp *gpb.GetResponse) ([]Neighbor, error) {
+	neighbors := []Neighbor{}
+	byID := map[string]*Neighbor{}
+	ids := []string{}
+	for _, notification := range resp.GetNotification() {
+		for _, update := range notification.GetUpdate() {
+			path := append(append([]*gpb.PathElem{}, notification.GetPrefix().GetElem()...), update.GetPath().GetElem()...)
+			switch v := update.GetVal().GetValue().(type) {
+			case *gpb.TypedValue_JsonIetfVal, *gpb.TypedValue_JsonVal:
+				raw := update.GetVal().GetJsonIetfVal()
+				if raw == nil {
+					raw = update.GetVal().GetJsonVal()
+				}
+				var tree interface{}
+				if err := json.Unmarshal(raw, &tree); err != nil {
+					return nil, fmt.Errorf("bad JSON value: %v", err)
+				}
+				neighbors = append(neighbors, jsonNeighbors(tree)...)
+			case *gpb.TypedValue_StringVal:
+				id, leaf := "", ""
+				for _, e := range path {
+					if e.GetName() == "neighbor" {
+						id = e.GetKey()["id"]
+					}
+					leaf = e.GetName()
+				}
+				n, ok := byID[id]
+				if !ok {
+					n = &Neighbor{}
+					byID[id] = n
+					ids = append(ids, id)
+				}
+				n.set(leaf, v.StringVal)
+			}
+		}
+	}
+	for _, id := range ids {
+		neighbors = append(neighbors, *byID[id])
+	}
+	return neighbors, nil
+}
+
+// set sets a leaf of the LLDP neighbor state.
+func (n *Neighbor) set(leaf, value string) {
+	switch leaf {
+	case "system-name":
+		n.SystemName = value
+	case "port-id":
+		n.PortID = value
+	case "port-description":
+		n.PortDescription = value
+	}
+}
+
+// jsonNeighbors finds the neighbor states of a JSON tree, the objects with a
+// system-name or port-id. Member names may be qualified by their module.
+func jsonNeighbors(tree interface{}) []Neighbor {
+	neighbors := []Neighbor{}
+	switch t := tree.(type) {
+	case []interface{}:
+		for _, v := range t {
+			neighbors = append(neighbors, jsonNeighbors(v)...)
+		}
+	case map[string]interface{}:
+		n := Neighbor{}
+		found := false
+		for k, v := range t {
+			leaf := k[strings.LastIndex(k, ":")+1:]
+			if s, ok := v.(string); ok && (leaf == "system-name" || leaf == "port-id" || leaf == "port-description") {
+				n.set(leaf, s)
+				found = true
+				continue
+			}
+			neighbors = append(neighbors, jsonNeighbors(v)...)
+		}
+		if found {
+			neighbors = append(neighbors, n)
+		}
+	}
+	return neighbors
+}
@@ -0,0 +1,52 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// TCP checks that the services of a device accept TCP connections. Names
+// limits the check to the services of these names, such as "gnmi" and "ssh";
+// when empty every service but those over UDP is checked. A device without
+// any of these services fails with ErrNoService.
+type TCP struct {
+	Names []string
+}
+
+func (p TCP) Probe(ctx context.Context, t Target) error {
+	var dialer net.Dialer
+	checked := false
+	for _, s := range t.Services {
+		if !p.checks(s) {
+			continue
+		}
+		checked = true
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(s.Address, strconv.Itoa(s.Port)))
+		if err != nil {
+			return fmt.Errorf("%s service unreachable: %v", s.Name, err)
+		}
+		conn.Close()
+	}
+	if !checked {
+		return ErrNoService
+	}
+	return nil
+}
+
+func (p TCP) checks(s Service) bool {
+	if s.Port == 0 || strings.EqualFold(s.Protocol, "udp") {
+		return false
+	}
+	if len(p.Names) == 0 {
+		return true
+	}
+	for _, name := range p.Names {
+		if strings.EqualFold(name, s.Name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"lablrs/events"
+	"lablrs/health"
+	"lablrs/utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthChecker probes the devices of an assignment before it is handed out,
+// and keeps the quarantined devices. Without a prober devices are not checked.
+var healthChecker = &health.Checker{}
+
+// Health probes of assigned devices.
+const (
+	healthProbeNone = ""
+	healthProbeTCP  = "tcp"
+	healthProbeGNMI = "gnmi"
+)
+
+// healthRetries is how many times a testbed is solved again when devices of
+// the assignment fail their health checks.
+var healthRetries = 2
+
+// newHealthChecker returns the checker configured by cfg, without a prober if
+// health checks are disabled.
+func newHealthChecker(cfg *Config) *health.Checker {
+	var prober health.Prober
+	switch cfg.HealthProbe {
+	case healthProbeTCP:
+		prober = health.TCP{}
+	case healthProbeGNMI:
+		prober = health.All{health.TCP{}, gnmiClient(cfg)}
+	}
+	return &health.Checker{
+		Prober:          prober,
+		Timeout:         cfg.HealthTimeout,
+		RecheckAfter:    cfg.HealthRecheckAfter,
+		QuarantineAfter: cfg.HealthQuarantineAfter,
+		FailUnchecked:   cfg.HealthFailUnchecked,
+		OnQuarantine:    quarantineInNetbox,
+	}
+}
+
+// gnmiClient returns the gNMI client configured by cfg.
+func gnmiClient(cfg *Config) health.GNMI {
+	return health.GNMI{
+		Plaintext:          cfg.GNMIPlaintext,
+		InsecureSkipVerify: cfg.GNMIInsecure,
+		Username:           cfg.GNMIUsername,
+		Password:           cfg.GNMIPassword,
+	}
+}
+
+// checkHealth probes devices with their services from the inventory and
+// returns the error of each unhealthy one.
+func checkHealth(ctx context.Context, devices []string) map[string]error {
+	if healthChecker.Prober == nil {
+		return nil
+	}
+	inventoryMu.RLock()
+	targets := []health.Target{}
+	for _, name := range devices {
+		targets = append(targets, healthTarget(name))
+	}
+	inventoryMu.RUnlock()
+	return healthChecker.Check(ctx, targets)
+}
+
+// healthTarget returns a device with its services from the inventory. The
+// caller must hold inventoryMu.
+func healthTarget(device string) health.Target {
+	t := health.Target{Device: device}
+	for _, s := range inventoryConfig.Devices[device].Services {
+		t.Services = append(t.Services, health.Service{Name: s.Name, Address: s.Address, Port: s.Port, Protocol: s.Protocol})
+	}
+	return t
+}
+
+// quarantineInNetbox marks a quarantined device in NetBox and publishes its
+// quarantine.
+func quarantineInNetbox(device string) {
+	publishDevice(events.DeviceQuarantined, device, nil)
+	setNetboxState([]string{device}, utils.StateQuarantined)
+}
+
+func listHealth(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, healthChecker.Status())
+}
+
+func unquarantineDevice(c *gin.Context) {
+	name := c.Param("name")
+	if !healthChecker.Release(name) {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("device %q is not quarantined", name)})
+		return
+	}
+	inventoryMu.RLock()
+	state := netboxState(name)
+	if inMaintenance(name) {
+		state = utils.StateMaintenance
+	}
+	inventoryMu.RUnlock()
+	setNetboxState([]string{name}, state)
+	go dispatchQueue()
+	c.IndentedJSON(http.StatusOK, gin.H{"device": name, "quarantined": false})
+}
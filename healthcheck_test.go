@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"lablrs/auth"
+	"lablrs/health"
+	"lablrs/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useInventory loads an inventory given as JSON for the duration of a test.
+func useInventory(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadInventory(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// useProber checks the health of devices with prober for the duration of a
+// test.
+func useProber(t *testing.T, prober health.Prober) {
+	saved := healthChecker
+	healthChecker = &health.Checker{Prober: prober, Timeout: time.Second, RecheckAfter: time.Hour, QuarantineAfter: 3}
+	t.Cleanup(func() { healthChecker = saved })
+}
+
+const twoDUTs = `{"devices": {
+	"d1": {"attributes": {"type": "DUT"}, "interfaces": [{"name": "e0"}]},
+	"d2": {"attributes": {"type": "DUT"}, "interfaces": [{"name": "e0"}]}
+}, "links": []}`
+
+func oneDUTReservation(t *testing.T) *Reservation {
+	t.Helper()
+	testbedConfig, err := ConvertData(InputData{Devices: []InputDevice{{Name: "dut", Interfaces: []InputInterface{{Name: "p"}}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newReservation(ReserveRequest{}, testbedConfig, auth.Anonymous)
+}
+
+func TestSolveReservationReselectsUnhealthyDevices(t *testing.T) {
+	useInventory(t, twoDUTs)
+	var mu sync.Mutex
+	probed := []string{}
+	// The first device probed fails
+	useProber(t, health.ProberFunc(func(ctx context.Context, target health.Target) error {
+		mu.Lock()
+		defer mu.Unlock()
+		probed = append(probed, target.Device)
+		if target.Device == probed[0] {
+			return errors.New("unreachable")
+		}
+		return nil
+	}))
+
+	_, sol, snapshot, err := solveReservation(context.Background(), oneDUTReservation(t), false, true)
+	if err != nil {
+		t.Fatalf("solveReservation() error: %v", err)
+	}
+	devices, _ := assignedResources(snapshot.translate(sol.assignment))
+	if len(probed) != 2 || probed[0] == probed[1] {
+		t.Fatalf("probed %v, want both devices once", probed)
+	}
+	if len(devices) != 1 || devices[0] != probed[1] {
+		t.Errorf("assigned %v, want %s, the device that passed its check", devices, probed[1])
+	}
+	if !healthChecker.Unhealthy(probed[0]) {
+		t.Errorf("%s failed its check but is not unhealthy", probed[0])
+	}
+}
+
+func TestSolveReservationGivesUpAfterRetries(t *testing.T) {
+	useInventory(t, twoDUTs)
+	useProber(t, health.ProberFunc(func(ctx context.Context, target health.Target) error {
+		return errors.New("unreachable")
+	}))
+	saved := healthRetries
+	healthRetries = 0
+	defer func() { healthRetries = saved }()
+
+	_, _, _, err := solveReservation(context.Background(), oneDUTReservation(t), false, true)
+	if err == nil {
+		t.Fatal("solveReservation() succeeded with every device failing its check")
+	}
+	unhealthy := 0
+	for _, d := range []string{"d1", "d2"} {
+		if healthChecker.Unhealthy(d) {
+			unhealthy++
+		}
+	}
+	if unhealthy != 1 {
+		t.Errorf("%d devices unhealthy, want 1 with no retry", unhealthy)
+	}
+}
+
+func TestSolveReservationSkipsUnhealthyDevices(t *testing.T) {
+	useInventory(t, twoDUTs)
+	useProber(t, health.ProberFunc(func(ctx context.Context, target health.Target) error {
+		return nil
+	}))
+	healthChecker.Quarantine("d1", errors.New("cleanup failed"))
+
+	for i := 0; i < 5; i++ {
+		_, sol, snapshot, err := solveReservation(context.Background(), oneDUTReservation(t), false, true)
+		if err != nil {
+			t.Fatalf("solveReservation() error: %v", err)
+		}
+		if devices, _ := assignedResources(snapshot.translate(sol.assignment)); len(devices) != 1 || devices[0] != "d2" {
+			t.Fatalf("assigned %v while d1 is quarantined, want d2", devices)
+		}
+	}
+}
+
+func TestSolveReservationWithoutProbes(t *testing.T) {
+	useInventory(t, twoDUTs)
+	probed := 0
+	useProber(t, health.ProberFunc(func(ctx context.Context, target health.Target) error {
+		probed++
+		return errors.New("unreachable")
+	}))
+
+	if _, _, _, err := solveReservation(context.Background(), oneDUTReservation(t), false, false); err != nil {
+		t.Fatalf("solveReservation() without probes error: %v", err)
+	}
+	if probed != 0 {
+		t.Errorf("probed %d devices in a dry run, want none", probed)
+	}
+	for _, d := range []string{"d1", "d2"} {
+		if healthChecker.Unhealthy(d) {
+			t.Errorf("%s unhealthy after a dry run", d)
+		}
+	}
+}
+
+func TestHealthTargetServices(t *testing.T) {
+	useInventory(t, `{"devices": {
+		"d1": {"attributes": {"type": "DUT"}, "interfaces": [{"name": "e0"}],
+			"services": [{"name": "gnmi", "address_family": "ipv4", "address": "192.0.2.1", "protocol": "tcp", "port": 9339}]}
+	}, "links": []}`)
+	inventoryMu.RLock()
+	target := healthTarget("d1")
+	inventoryMu.RUnlock()
+	want := health.Service{Name: "gnmi", Address: "192.0.2.1", Port: 9339, Protocol: "tcp"}
+	if len(target.Services) != 1 || target.Services[0] != want {
+		t.Errorf("healthTarget(d1).Services = %+v, want [%+v]", target.Services, want)
+	}
+}
+
+func TestUnquarantineKeepsMaintenance(t *testing.T) {
+	useInventory(t, twoDUTs)
+	netboxStates := useNetbox(t)
+	useProber(t, health.ProberFunc(func(ctx context.Context, target health.Target) error {
+		return nil
+	}))
+	inventoryMu.Lock()
+	saved := drains
+	drains = map[string]*Drain{"d1": {Device: "d1", By: "alice"}}
+	inventoryMu.Unlock()
+	t.Cleanup(func() {
+		inventoryMu.Lock()
+		drains = saved
+		inventoryMu.Unlock()
+	})
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/devices/:name/unquarantine", unquarantineDevice)
+
+	for _, tc := range []struct{ device, state string }{
+		{"d1", utils.StateMaintenance},
+		{"d2", utils.StateAvailable},
+	} {
+		healthChecker.Quarantine(tc.device, errors.New("cleanup failed"))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/devices/"+tc.device+"/unquarantine", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unquarantining %s = %d %s, want 200", tc.device, w.Code, w.Body)
+		}
+		if state := netboxStates()[tc.device]; state != tc.state {
+			t.Errorf("%s is %q in NetBox once out of quarantine, want %q", tc.device, state, tc.state)
+		}
+	}
+}
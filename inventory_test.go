@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lablrs/audit"
+	"lablrs/events"
+)
+
+func TestRefreshKeepsHeldDevices(t *testing.T) {
+	useInventory(t, twoDUTs)
+	r := useReservation(t, "r1")
+	inventoryMu.Lock()
+	r.Devices, r.Ports = []string{"d1"}, []string{"d1:e0"}
+	claim(r)
+	inventoryMu.Unlock()
+
+	// NetBox now has d1 reserved: inventory.json leaves it out.
+	dir := t.TempDir()
+	path, globalPath := filepath.Join(dir, "inventory.json"), filepath.Join(dir, "inventory_global.json")
+	os.WriteFile(path, []byte(`{"devices": {"d2": {"attributes": {"type": "DUT"}, "interfaces": [{"name": "e0"}]}}, "links": []}`), 0644)
+	os.WriteFile(globalPath, []byte(twoDUTs), 0644)
+	if err := loadInventoryKeeping(path, globalPath); err != nil {
+		t.Fatal(err)
+	}
+	inventoryMu.RLock()
+	node, ok := inventoryNodes["d1"]
+	reserved := ok && node.Attrs["reserved"] == "yes" && inventoryPorts["d1:e0"].Attrs["reserved"] == "yes"
+	inventoryMu.RUnlock()
+	if !reserved {
+		t.Fatal("d1, held by r1, is not in the refreshed inventory as reserved")
+	}
+
+	inventoryMu.Lock()
+	releaseLocked(r, events.Released, audit.System)
+	inventoryMu.Unlock()
+	inventoryMu.RLock()
+	free := node.Attrs["reserved"] == "no"
+	inventoryMu.RUnlock()
+	if !free {
+		t.Error("d1 is not free again after its release")
+	}
+
+	// Devices reserved in NetBox by no reservation stay out.
+	if err := loadInventoryKeeping(path, globalPath); err != nil {
+		t.Fatal(err)
+	}
+	inventoryMu.RLock()
+	_, ok = inventoryNodes["d1"]
+	inventoryMu.RUnlock()
+	if ok {
+		t.Error("d1, reserved in NetBox but held by no reservation, is in the inventory")
+	}
+}
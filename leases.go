@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"lablrs/audit"
+	"lablrs/auth"
+	"lablrs/events"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxLease is the longest lease a reservation gets at once, unlimited when
+// zero. Longer durations asked for are cut down to it.
+var maxLease time.Duration
+
+// capLease returns the lease given for a requested duration.
+func capLease(lease time.Duration) time.Duration {
+	if maxLease > 0 && lease > maxLease {
+		return maxLease
+	}
+	return lease
+}
+
+// extendLease makes a reservation expire at expires. The caller must hold
+// inventoryMu.
+func extendLease(r *Reservation, expires time.Time) {
+	r.Expires = &expires
+	if r.expiry != nil {
+		r.expiry.Stop()
+	}
+	id := r.ID
+	r.expiry = time.AfterFunc(time.Until(expires), func() { expireReservation(id) })
+}
+
+// expireReservation releases a reservation whose lease ended, unless it was
+// renewed meanwhile.
+func expireReservation(id string) {
+	inventoryMu.Lock()
+	r, ok := reservations[id]
+	if !ok || r.Status == statusReleased || r.Expires == nil || time.Now().Before(*r.Expires) {
+		inventoryMu.Unlock()
+		return
+	}
+	changes := releaseLocked(r, events.Expired, audit.System)
+	inventoryMu.Unlock()
+	changes.apply()
+	go dispatchQueue()
+}
+
+// RenewRequest is the body of a lease renewal: the reservation lasts for
+// Duration, up to maxLease, from now on.
+type RenewRequest struct {
+	Duration string `json:"duration"`
+}
+
+func renewReservation(c *gin.Context) {
+	request := RenewRequest{}
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+	lease, err := time.ParseDuration(request.Duration)
+	if err != nil || lease <= 0 {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("duration: %q is not a positive duration", request.Duration)})
+		return
+	}
+	principal := auth.PrincipalOf(c)
+	inventoryMu.Lock()
+	defer inventoryMu.Unlock()
+	r, ok := reservations[c.Param("id")]
+	switch {
+	case !ok:
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("reservation %q not found", c.Param("id"))})
+		return
+	case !policy.Allowed(principal, releasePermissions(principal, r)...):
+		c.IndentedJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%q is not allowed to renew reservation %q", principal.Name, r.ID)})
+		return
+	case r.Status == statusReleased || r.Status == statusQueued:
+		c.IndentedJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("reservation %q is %s", r.ID, r.Status)})
+		return
+	case r.Expires == nil:
+		c.IndentedJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("reservation %q has no lease to renew", r.ID)})
+		return
+	}
+	extendLease(r, time.Now().Add(capLease(lease)))
+	recordReservation(events.Renewed, principal.Name, r, map[string]string{"expires": r.Expires.Format(time.RFC3339)})
+	c.IndentedJSON(http.StatusOK, *r)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"lablrs/audit"
+	"lablrs/events"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useReservation adds an active reservation holding nothing for the
+// duration of a test.
+func useReservation(t *testing.T, id string) *Reservation {
+	t.Helper()
+	inventoryMu.Lock()
+	saved := reservations
+	r := &Reservation{ID: id, Status: statusActive, Created: time.Now()}
+	reservations = map[string]*Reservation{id: r}
+	inventoryMu.Unlock()
+	t.Cleanup(func() {
+		inventoryMu.Lock()
+		if r.expiry != nil {
+			r.expiry.Stop()
+		}
+		reservations = saved
+		inventoryMu.Unlock()
+	})
+	return r
+}
+
+// statusOf returns the status of a reservation.
+func statusOf(r *Reservation) string {
+	inventoryMu.RLock()
+	defer inventoryMu.RUnlock()
+	return r.Status
+}
+
+func TestExtendLeaseExpiresReservation(t *testing.T) {
+	r := useReservation(t, "r1")
+	sub := eventBus.Subscribe([]string{events.Expired}, 0, 10)
+	defer eventBus.Unsubscribe(sub)
+
+	inventoryMu.Lock()
+	extendLease(r, time.Now().Add(20*time.Millisecond))
+	inventoryMu.Unlock()
+	select {
+	case e := <-sub.C:
+		if e.Reservation != "r1" {
+			t.Errorf("expired %s, want r1", e.Reservation)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reservation did not expire")
+	}
+	if status := statusOf(r); status != statusReleased {
+		t.Errorf("status after expiry = %s, want %s", status, statusReleased)
+	}
+}
+
+func TestExtendLeaseReplacesTheExpiry(t *testing.T) {
+	r := useReservation(t, "r1")
+	inventoryMu.Lock()
+	extendLease(r, time.Now().Add(20*time.Millisecond))
+	extendLease(r, time.Now().Add(time.Hour))
+	inventoryMu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	if status := statusOf(r); status != statusActive {
+		t.Errorf("status after extending the lease = %s, want %s", status, statusActive)
+	}
+}
+
+func TestExpireReservationSkipsRenewedReservations(t *testing.T) {
+	r := useReservation(t, "r1")
+	later := time.Now().Add(time.Hour)
+	r.Expires = &later
+	// A timer of an earlier lease firing after the renewal
+	expireReservation("r1")
+	if status := statusOf(r); status != statusActive {
+		t.Fatalf("status of a renewed reservation = %s, want %s", status, statusActive)
+	}
+	earlier := time.Now().Add(-time.Second)
+	inventoryMu.Lock()
+	r.Expires = &earlier
+	inventoryMu.Unlock()
+	expireReservation("r1")
+	if status := statusOf(r); status != statusReleased {
+		t.Errorf("status after the lease ended = %s, want %s", status, statusReleased)
+	}
+}
+
+func TestRenewReservation(t *testing.T) {
+	log, err := audit.Open(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := auditLog
+	auditLog = log
+	t.Cleanup(func() { auditLog = saved })
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/reservations/:id/renew", renewReservation)
+	renew := func(id, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/reservations/"+id+"/renew", strings.NewReader(body)))
+		return w
+	}
+
+	r := useReservation(t, "r1")
+	if w := renew("r1", `{"duration": "1h"}`); w.Code != http.StatusConflict {
+		t.Errorf("renewing without a lease = %d %s, want 409", w.Code, w.Body)
+	}
+	inventoryMu.Lock()
+	extendLease(r, time.Now().Add(time.Minute))
+	inventoryMu.Unlock()
+	for _, tc := range []struct {
+		id, body string
+		want     int
+	}{
+		{"r1", `{"duration": "soon"}`, http.StatusBadRequest},
+		{"r1", `{"duration": "-1h"}`, http.StatusBadRequest},
+		{"r2", `{"duration": "1h"}`, http.StatusNotFound},
+		{"r1", `{"duration": "2h"}`, http.StatusOK},
+	} {
+		if w := renew(tc.id, tc.body); w.Code != tc.want {
+			t.Errorf("renewing %s with %s = %d %s, want %d", tc.id, tc.body, w.Code, w.Body, tc.want)
+		}
+	}
+	inventoryMu.RLock()
+	expires := *r.Expires
+	inventoryMu.RUnlock()
+	if d := time.Until(expires); d < 119*time.Minute || d > 2*time.Hour {
+		t.Errorf("renewed lease ends in %v, want 2h", d)
+	}
+	entries := []audit.Entry{}
+	log.Scan(audit.Filter{Action: audit.Renewed}, func(e audit.Entry) bool {
+		entries = append(entries, e)
+		return true
+	})
+	if len(entries) != 1 || entries[0].Reservation != "r1" {
+		t.Errorf("renewals recorded: %+v, want one of r1", entries)
+	}
+
+	inventoryMu.Lock()
+	changes := releaseLocked(r, events.Released, audit.System)
+	inventoryMu.Unlock()
+	changes.apply()
+	if w := renew("r1", `{"duration": "1h"}`); w.Code != http.StatusConflict {
+		t.Errorf("renewing a released reservation = %d %s, want 409", w.Code, w.Body)
+	}
+}
+
+func TestRenewReservationCapsLease(t *testing.T) {
+	saved := maxLease
+	maxLease = 4 * time.Hour
+	t.Cleanup(func() { maxLease = saved })
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/reservations/:id/renew", renewReservation)
+	r := useReservation(t, "r1")
+	inventoryMu.Lock()
+	extendLease(r, time.Now().Add(time.Minute))
+	inventoryMu.Unlock()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/reservations/r1/renew", strings.NewReader(`{"duration": "720h"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("renewing for 720h = %d %s, want 200", w.Code, w.Body)
+	}
+	inventoryMu.RLock()
+	expires := *r.Expires
+	inventoryMu.RUnlock()
+	if d := time.Until(expires); d < 239*time.Minute || d > 4*time.Hour {
+		t.Errorf("renewed lease ends in %v, want the 4h maximum", d)
+	}
+}
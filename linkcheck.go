@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"lablrs/health"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	graph "github.com/openconfig/ondatra/binding/portgraph"
+)
+
+// linkVerifier checks the cabling of the links of an assignment against LLDP
+// before it is handed out. Without it links are not checked.
+var linkVerifier *health.LinkVerifier
+
+// linkRecheckAfter is how long the ports of a bad link are kept out of
+// assignments, 0 meaning until cleared.
+var linkRecheckAfter time.Duration
+
+// badLinks holds the links found cabled otherwise than in the inventory, by
+// name. It is guarded by inventoryMu.
+var badLinks = map[string]*BadLink{}
+
+// BadLink is a link of the inventory that LLDP contradicts. Its ports are not
+// given to new reservations.
+type BadLink struct {
+	Link     string    `json:"link"`
+	Ports    []string  `json:"ports"`
+	Error    string    `json:"error"`
+	Detected time.Time `json:"detected"`
+}
+
+// expired reports whether the link is due to be used, and checked, again.
+func (b *BadLink) expired(now time.Time) bool {
+	return linkRecheckAfter > 0 && now.Sub(b.Detected) >= linkRecheckAfter
+}
+
+// newLinkVerifier returns the link verifier configured by cfg, or nil if links
+// are not verified.
+func newLinkVerifier(cfg *Config) *health.LinkVerifier {
+	if !cfg.LinkVerify {
+		return nil
+	}
+	return &health.LinkVerifier{Source: gnmiClient(cfg), Timeout: cfg.HealthTimeout, Strict: cfg.LinkStrict}
+}
+
+// linkExclusions adds the ports of bad links to the exclusions of an
+// inventory view. The caller must hold inventoryMu.
+func linkExclusions(excludedPorts map[*graph.ConcretePort]bool) {
+	now := time.Now()
+	for _, b := range badLinks {
+		if b.expired(now) {
+			continue
+		}
+		for _, name := range b.Ports {
+			if p, ok := inventoryPorts[name]; ok {
+				excludedPorts[p] = true
+			}
+		}
+	}
+}
+
+// assignedLinks returns the links of the inventory an assignment uses for the
+// links of its testbed.
+func assignedLinks(testbed *graph.AbstractGraph, assignment *graph.Assignment) []health.Link {
+	inventoryMu.RLock()
+	defer inventoryMu.RUnlock()
+	links := []health.Link{}
+	for _, edge := range testbed.Edges {
+		src, srcOK := assignment.Port2Port[edge.Src]
+		dst, dstOK := assignment.Port2Port[edge.Dst]
+		if !srcOK || !dstOK {
+			continue
+		}
+		links = append(links, health.Link{A: linkEndpoint(src), B: linkEndpoint(dst)})
+	}
+	return links
+}
+
+// linkEndpoint returns the device and port name of an inventory port. The
+// caller must hold inventoryMu.
+func linkEndpoint(p *graph.ConcretePort) health.Endpoint {
+	device := p.Desc[:strings.LastIndex(p.Desc, ":")]
+	return health.Endpoint{Target: healthTarget(device), Port: configPortsToPorts[p].Name}
+}
+
+// verifyLinks checks the links against LLDP, records the bad ones and returns
+// their errors by link name.
+func verifyLinks(ctx context.Context, links []health.Link) map[string]error {
+	if linkVerifier == nil || len(links) == 0 {
+		return nil
+	}
+	failed := linkVerifier.Verify(ctx, links)
+	now := time.Now()
+	inventoryMu.Lock()
+	for _, l := range links {
+		name := l.String()
+		err, ok := failed[name]
+		if !ok {
+			continue
+		}
+		badLinks[name] = &BadLink{
+			Link:     name,
+			Ports:    []string{l.A.Target.Device + ":" + l.A.Port, l.B.Target.Device + ":" + l.B.Port},
+			Error:    err.Error(),
+			Detected: now,
+		}
+	}
+	inventoryMu.Unlock()
+	return failed
+}
+
+func listBadLinks(c *gin.Context) {
+	inventoryMu.RLock()
+	now := time.Now()
+	list := []BadLink{}
+	for _, b := range badLinks {
+		if !b.expired(now) {
+			list = append(list, *b)
+		}
+	}
+	inventoryMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Link < list[j].Link })
+	c.IndentedJSON(http.StatusOK, list)
+}
+
+// clearBadLinks forgets the bad links, e.g. once they are recabled, so that
+// their ports are given out again.
+func clearBadLinks(c *gin.Context) {
+	inventoryMu.Lock()
+	cleared := len(badLinks)
+	badLinks = map[string]*BadLink{}
+	inventoryMu.Unlock()
+	go dispatchQueue()
+	c.IndentedJSON(http.StatusOK, gin.H{"cleared": cleared})
+}
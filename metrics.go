@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"lablrs/utils"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// collector is a metric family that can write itself in the Prometheus text
+// exposition format.
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+var collectors []collector
+
+func register(c collector) {
+	collectors = append(collectors, c)
+}
+
+var solveDuration = newHistogramVec(
+	"lrs_solve_duration_seconds",
+	"Time spent finding an assignment for a reservation request, by outcome.",
+	[]string{"outcome"},
+	[]float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 120},
+)
+
+var graphSolveDuration = newHistogramVec(
+	"lrs_graph_solve_duration_seconds",
+	"Duration of single solver runs, by result.",
+	[]string{"result"},
+	[]float64{0.001, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60},
+)
+
+var reservationRequests = newCounterVec(
+	"lrs_reservation_requests_total",
+	"Reservation requests, by outcome.",
+	[]string{"outcome"},
+)
+
+var netboxDuration = newHistogramVec(
+	"lrs_netbox_request_duration_seconds",
+	"Duration of NetBox API calls, by method and endpoint.",
+	[]string{"method", "endpoint"},
+	[]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+)
+
+var netboxErrors = newCounterVec(
+	"lrs_netbox_request_errors_total",
+	"NetBox API calls that failed or returned an error status, by method and endpoint.",
+	[]string{"method", "endpoint"},
+)
+
+var webhookDrops = newCounterVec(
+	"lrs_webhook_dropped_events_total",
+	"Events a webhook lost by falling behind, by webhook URL.",
+	[]string{"url"},
+)
+
+func init() {
+	register(solveDuration)
+	register(graphSolveDuration)
+	register(reservationRequests)
+	register(netboxDuration)
+	register(netboxErrors)
+	register(webhookDrops)
+	register(&gaugeVecFunc{name: "lrs_devices", help: "Devices of the inventory, by state, type and vendor.", labels: []string{"state", "type", "vendor"}, samples: deviceSamples})
+	register(&gaugeVecFunc{name: "lrs_ports", help: "Ports of the inventory, by state, device type and speed.", labels: []string{"state", "device_type", "speed"}, samples: portSamples})
+	register(&gaugeVecFunc{name: "lrs_reservations", help: "Reservations, by status.", labels: []string{"status"}, samples: reservationSamples})
+	register(&gaugeFunc{name: "lrs_queue_depth", help: "Reservations waiting in the queue.", value: func() float64 {
+		inventoryMu.RLock()
+		defer inventoryMu.RUnlock()
+		return float64(len(queued()))
+	}})
+	register(&gaugeFunc{name: "lrs_netbox_pending_states", help: "Devices whose state NetBox failed to take, waiting to be set again.", value: func() float64 {
+		return float64(len(utils.PendingDeviceStates()))
+	}})
+	register(&gaugeFunc{name: "lrs_abandoned_graph_solves", help: "Solver runs still going after their request timed out.", value: func() float64 {
+		return float64(abandonedSolves.Load())
+	}})
+	register(inventoryGauge("lrs_fragmentation_ratio", "Share of unreserved ports stranded on reserved devices.", func(f fragmentation) float64 { return f.fragmentedShare }))
+	register(inventoryGauge("lrs_stranded_ports", "Unreserved ports of reserved devices.", func(f fragmentation) float64 { return float64(f.strandedPorts) }))
+	register(inventoryGauge("lrs_free_devices", "Devices with every port free.", func(f fragmentation) float64 { return float64(f.freeDevices) }))
+	register(inventoryGauge("lrs_partially_used_devices", "Usable devices with some of their ports reserved.", func(f fragmentation) float64 { return float64(f.partiallyUsed) }))
+}
+
+// gaugeFunc is a gauge whose value is computed when metrics are scraped.
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.name, g.help, g.name, g.name, g.value())
+}
+
+// inventoryGauge returns a gauge reporting one figure of the inventory
+// fragmentation.
+func inventoryGauge(name, help string, figure func(fragmentation) float64) *gaugeFunc {
+	return &gaugeFunc{name: name, help: help, value: func() float64 {
+		inventoryMu.RLock()
+		defer inventoryMu.RUnlock()
+		return figure(inventoryFragmentation())
+	}}
+}
+
+// gaugeVecFunc is a family of gauges whose series are computed when metrics
+// are scraped.
+type gaugeVecFunc struct {
+	name    string
+	help    string
+	labels  []string
+	samples func() []sample
+}
+
+// sample is the value of one series of a family.
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+func (g *gaugeVecFunc) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	samples := g.samples()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labelValues, "\xff") < strings.Join(samples[j].labelValues, "\xff")
+	})
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s{%s} %g\n", g.name, labelPairs(g.labels, s.labelValues), s.value)
+	}
+}
+
+// labelEscaper escapes label values as the text exposition format wants:
+// only backslashes, double quotes and newlines.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelPairs formats the labels of a series.
+func labelPairs(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+// seriesKey identifies a series of a family by its label values.
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// counterVec is a family of counters partitioned by the values of its
+// labels.
+type counterVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	series map[string]*sample
+}
+
+func newCounterVec(name, help string, labels []string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, series: map[string]*sample{}}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[seriesKey(labelValues)]
+	if !ok {
+		s = &sample{labelValues: labelValues}
+		c.series[seriesKey(labelValues)] = s
+	}
+	s.value++
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s{%s} %g\n", c.name, labelPairs(c.labels, s.labelValues), s.value)
+	}
+}
+
+// histogramVec is a family of histograms partitioned by the values of its
+// labels.
+type histogramVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative
+	sum         float64
+	count       uint64
+}
+
+func newHistogramVec(name, help string, labels []string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[seriesKey(labelValues)]
+	if !ok {
+		s = &histogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[seriesKey(labelValues)] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) observeSince(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		label := labelPairs(h.labels, s.labelValues)
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", h.name, label, bound, cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, label, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", h.name, label, s.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, label, s.count)
+	}
+}
+
+// observeOutcome records the outcome of a reservation request that was
+// solved.
+func observeOutcome(outcome string, start time.Time) {
+	solveDuration.observeSince(start, outcome)
+	reservationRequests.inc(outcome)
+}
+
+// observeNetbox records a NetBox API call. Its status is 0 if it failed
+// without a response.
+func observeNetbox(method, endpoint string, d time.Duration, status int) {
+	netboxDuration.observe(d.Seconds(), method, endpoint)
+	if status == 0 || status >= 400 {
+		netboxErrors.inc(method, endpoint)
+	}
+}
+
+// Device states of the inventory metrics.
+const (
+	metricStateFree        = "free"
+	metricStateReserved    = "reserved"
+	metricStateCleaning    = "cleaning"
+	metricStateDrained     = "drained"
+	metricStateQuarantined = "quarantined"
+)
+
+// deviceState is the state of a device in the inventory metrics. The caller
+// must hold inventoryMu.
+func deviceState(name string) string {
+	_, dirty := cleaning[name]
+	switch {
+	case healthChecker.Quarantined(name):
+		return metricStateQuarantined
+	case inMaintenance(name):
+		return metricStateDrained
+	case dirty:
+		return metricStateCleaning
+	case len(holdingReservations(name)) > 0:
+		return metricStateReserved
+	}
+	return metricStateFree
+}
+
+// countSamples turns counts by series key into samples.
+func countSamples(counts map[string]*sample) []sample {
+	samples := []sample{}
+	for _, s := range counts {
+		samples = append(samples, *s)
+	}
+	return samples
+}
+
+// countSample adds one to the sample of the given label values.
+func countSample(counts map[string]*sample, labelValues ...string) {
+	s, ok := counts[seriesKey(labelValues)]
+	if !ok {
+		s = &sample{labelValues: labelValues}
+		counts[seriesKey(labelValues)] = s
+	}
+	s.value++
+}
+
+func deviceSamples() []sample {
+	inventoryMu.RLock()
+	defer inventoryMu.RUnlock()
+	counts := map[string]*sample{}
+	for _, node := range inventory.Nodes {
+		countSample(counts, deviceState(node.Desc), node.Attrs["type"], node.Attrs["vendor"])
+	}
+	return countSamples(counts)
+}
+
+func portSamples() []sample {
+	inventoryMu.RLock()
+	defer inventoryMu.RUnlock()
+	counts := map[string]*sample{}
+	for _, node := range inventory.Nodes {
+		for _, port := range node.Ports {
+			state := metricStateFree
+			if port.Attrs["reserved"] == "yes" {
+				state = metricStateReserved
+			}
+			countSample(counts, state, node.Attrs["type"], port.Attrs["speed"])
+		}
+	}
+	return countSamples(counts)
+}
+
+func reservationSamples() []sample {
+	inventoryMu.RLock()
+	defer inventoryMu.RUnlock()
+	counts := map[string]*sample{}
+	for _, r := range reservations {
+		countSample(counts, r.Status)
+	}
+	return countSamples(counts)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func metrics(c *gin.Context) {
+	var b strings.Builder
+	for _, m := range collectors {
+		m.writeTo(&b)
+	}
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
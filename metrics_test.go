@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"lablrs/health"
+)
+
+func TestLabelPairsEscaping(t *testing.T) {
+	got := labelPairs([]string{"a", "b"}, []string{"C:\\lab \"x\"\nnext", "tab\there é"})
+	want := `a="C:\\lab \"x\"\nnext",b="tab	here é"`
+	if got != want {
+		t.Errorf("labelPairs() = %s, want %s", got, want)
+	}
+}
+
+func TestDeviceStateQuarantinedOnlyWhenQuarantined(t *testing.T) {
+	useInventory(t, twoDUTs)
+	useProber(t, health.ProberFunc(func(ctx context.Context, target health.Target) error {
+		return errors.New("unreachable")
+	}))
+	healthChecker.Check(context.Background(), []health.Target{{Device: "d1"}})
+	healthChecker.Quarantine("d2", errors.New("cleanup failed"))
+
+	inventoryMu.RLock()
+	defer inventoryMu.RUnlock()
+	if !healthChecker.Unhealthy("d1") {
+		t.Fatal("d1 failed its check but is not unhealthy")
+	}
+	if state := deviceState("d1"); state != metricStateFree {
+		t.Errorf("state of d1, unhealthy but not quarantined = %s, want %s", state, metricStateFree)
+	}
+	if state := deviceState("d2"); state != metricStateQuarantined {
+		t.Errorf("state of d2 = %s, want %s", state, metricStateQuarantined)
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"lablrs/audit"
+	"lablrs/events"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	graph "github.com/openconfig/ondatra/binding/portgraph"
+)
+
+// unassignedTeam is the team of requests that do not name one.
+const unassignedTeam = "unassigned"
+
+// quotaWindow is the period over which device-hours are counted.
+const quotaWindow = 7 * 24 * time.Hour
+
+var quotas QuotaConfig
+
+// Quota limits what a user or team may hold at once, and the device-hours it
+// may use over a week. Zero limits are not enforced. MaxDevicesByType is keyed
+// by the "type" attribute of devices, such as DUT, ATE or TGEN.
+type Quota struct {
+	MaxDevices            int            `json:"max_devices,omitempty"`
+	MaxPorts              int            `json:"max_ports,omitempty"`
+	MaxDevicesByType      map[string]int `json:"max_devices_by_type,omitempty"`
+	MaxDeviceHoursPerWeek float64        `json:"max_device_hours_per_week,omitempty"`
+}
+
+// QuotaConfig holds the quotas of teams and users. Default applies to every
+// team without a quota of its own; users without a quota are only limited by
+// the quota of their team.
+type QuotaConfig struct {
+	Default *Quota           `json:"default,omitempty"`
+	Teams   map[string]Quota `json:"teams,omitempty"`
+	Users   map[string]Quota `json:"users,omitempty"`
+}
+
+// loadQuotas reads the quota configuration. Without a file no quota is
+// enforced.
+func loadQuotas(path string) error {
+	jsonData, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(jsonData, &quotas); err != nil {
+		return fmt.Errorf("reading quotas from %s: %v", path, err)
+	}
+	return nil
+}
+
+func teamOf(team string) string {
+	if team == "" {
+		return unassignedTeam
+	}
+	return team
+}
+
+func (q QuotaConfig) team(team string) (Quota, bool) {
+	if quota, ok := q.Teams[team]; ok {
+		return quota, true
+	}
+	if q.Default != nil {
+		return *q.Default, true
+	}
+	return Quota{}, false
+}
+
+func (q QuotaConfig) user(user string) (Quota, bool) {
+	quota, ok := q.Users[user]
+	return quota, ok && user != ""
+}
+
+// Usage is what a user or team holds, and the device-hours it used over the
+// last week.
+type Usage struct {
+	Devices         int            `json:"devices"`
+	Ports           int            `json:"ports"`
+	DevicesByType   map[string]int `json:"devices_by_type"`
+	DeviceHoursWeek float64        `json:"device_hours_week"`
+}
+
+func newUsage() Usage {
+	return Usage{DevicesByType: map[string]int{}}
+}
+
+// addHeld counts devices and ports as held. The caller must hold inventoryMu.
+func (u *Usage) addHeld(devices, ports []string) {
+	u.Devices += len(devices)
+	u.Ports += len(ports)
+	for _, name := range devices {
+		if node, ok := inventoryNodes[name]; ok && node.Attrs["type"] != "" {
+			u.DevicesByType[node.Attrs["type"]]++
+		}
+	}
+}
+
+// add counts a reservation. Pending reservations count as holding their
+// testbed, since it is set aside for them. The caller must hold inventoryMu.
+func (u *Usage) add(r *Reservation, now time.Time) {
+	if r.holds() || r.Status == statusPending {
+		u.addHeld(r.Devices, r.Ports)
+	}
+	if r.Started == nil {
+		return
+	}
+	start, end := *r.Started, now
+	if r.Released != nil {
+		end = *r.Released
+	}
+	if windowStart := now.Add(-quotaWindow); start.Before(windowStart) {
+		start = windowStart
+	}
+	if end.After(start) {
+		u.DeviceHoursWeek += float64(len(r.Devices)) * end.Sub(start).Hours()
+	}
+}
+
+// usageOf sums the usage of the reservations matching match. The caller must
+// hold inventoryMu.
+func usageOf(match func(*Reservation) bool) Usage {
+	u := newUsage()
+	now := time.Now()
+	for _, r := range reservations {
+		if match(r) {
+			u.add(r, now)
+		}
+	}
+	return u
+}
+
+// exceeded returns an error naming the first limit of the quota that the
+// usage goes over. Device-hours are exceeded once the limit is reached, since
+// a new reservation starts with none.
+func (q Quota) exceeded(owner string, u Usage) error {
+	if q.MaxDevices > 0 && u.Devices > q.MaxDevices {
+		return fmt.Errorf("%s would hold %d devices, over its quota of %d", owner, u.Devices, q.MaxDevices)
+	}
+	if q.MaxPorts > 0 && u.Ports > q.MaxPorts {
+		return fmt.Errorf("%s would hold %d ports, over its quota of %d", owner, u.Ports, q.MaxPorts)
+	}
+	for _, deviceType := range sortedKeys(q.MaxDevicesByType) {
+		if limit := q.MaxDevicesByType[deviceType]; limit > 0 && u.DevicesByType[deviceType] > limit {
+			return fmt.Errorf("%s would hold %d %s devices, over its quota of %d", owner, u.DevicesByType[deviceType], deviceType, limit)
+		}
+	}
+	if q.MaxDeviceHoursPerWeek > 0 && u.DeviceHoursWeek >= q.MaxDeviceHoursPerWeek {
+		return fmt.Errorf("%s used %.1f device-hours this week, its quota is %g", owner, u.DeviceHoursWeek, q.MaxDeviceHoursPerWeek)
+	}
+	return nil
+}
+
+// checkQuota verifies that the team and user of a reservation stay within
+// their quotas when given the devices and ports. The caller must hold
+// inventoryMu.
+func checkQuota(r *Reservation, devices, ports []string) error {
+	return checkQuotaWith(r, func(u *Usage) { u.addHeld(devices, ports) })
+}
+
+// checkRequestQuota verifies that the team and user of a reservation may
+// hold as many devices and ports as it requests, and the devices of each type
+// it is sure to get, before its testbed is solved. The caller must hold
+// inventoryMu.
+func checkRequestQuota(r *Reservation) error {
+	devices, ports := 0, 0
+	for _, device := range r.testbedConfig.Devices {
+		devices++
+		ports += len(device.Ports)
+	}
+	byType := requestedTypes(r.testbedConfig)
+	return checkQuotaWith(r, func(u *Usage) {
+		u.Devices += devices
+		u.Ports += ports
+		for deviceType, n := range byType {
+			u.DevicesByType[deviceType] += n
+		}
+	})
+}
+
+// requestedTypes counts by type the devices of a testbed that only inventory
+// devices of that type can satisfy, judging by their attributes and number of
+// ports. Devices of the testbed that devices of several types could satisfy
+// are not counted. The caller must hold inventoryMu.
+func requestedTypes(testbedConfig Testbed) map[string]int {
+	counts := map[string]int{}
+	for _, device := range testbedConfig.Devices {
+		types := map[string]bool{}
+		for _, node := range inventory.Nodes {
+			if mayAssign(device, node) {
+				types[node.Attrs["type"]] = true
+			}
+		}
+		if len(types) != 1 {
+			continue
+		}
+		for deviceType := range types {
+			if deviceType != "" {
+				counts[deviceType]++
+			}
+		}
+	}
+	return counts
+}
+
+// mayAssign reports whether an inventory device has the attributes and
+// enough ports for a device of a testbed, whether reserved or not.
+func mayAssign(device BDevice, node *graph.ConcreteNode) bool {
+	if len(device.Ports) > len(node.Ports) {
+		return false
+	}
+	for name, value := range device.Attrs {
+		if name != "reserved" && node.Attrs[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// checkQuotaWith verifies that the team and user of a reservation stay
+// within their quotas when add counts what the reservation gets on top of
+// their usage. The caller must hold inventoryMu.
+func checkQuotaWith(r *Reservation, add func(*Usage)) error {
+	if quota, ok := quotas.team(r.Team); ok {
+		u := usageOf(func(other *Reservation) bool { return other != r && other.Team == r.Team })
+		add(&u)
+		if err := quota.exceeded(fmt.Sprintf("team %q", r.Team), u); err != nil {
+			return err
+		}
+	}
+	if quota, ok := quotas.user(r.User); ok {
+		u := usageOf(func(other *Reservation) bool { return other != r && other.User == r.User })
+		add(&u)
+		if err := quota.exceeded(fmt.Sprintf("user %q", r.User), u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// share is the part of its quota a team currently holds, or the number of
+// devices it holds when it has no device quota. The caller must hold
+// inventoryMu.
+func share(team string) float64 {
+	u := usageOf(func(r *Reservation) bool { return r.Team == team })
+	if quota, ok := quotas.team(team); ok && quota.MaxDevices > 0 {
+		return float64(u.Devices) / float64(quota.MaxDevices)
+	}
+	return float64(u.Devices)
+}
+
+// enqueue records a reservation waiting for resources or quota.
+func enqueue(r *Reservation) {
+	inventoryMu.Lock()
+	defer inventoryMu.Unlock()
+	r.Status = statusQueued
+	r.Testbed = Testbed{ReservationID: r.ID, Status: statusQueued}
+	reservations[r.ID] = r
+	recordReservation(events.Queued, r.Owner.Name, r, nil)
+}
+
+// queued lists the queued reservations in the order they are served: higher
+// priority first, then the team holding the smallest share of its quota, then
+// the oldest request. The caller must hold inventoryMu.
+func queued() []*Reservation {
+	list := []*Reservation{}
+	shares := map[string]float64{}
+	for _, r := range reservations {
+		if r.Status == statusQueued {
+			list = append(list, r)
+			shares[r.Team] = share(r.Team)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if shares[a.Team] != shares[b.Team] {
+			return shares[a.Team] < shares[b.Team]
+		}
+		return a.Created.Before(b.Created)
+	})
+	return list
+}
+
+// queueTTL is how long a reservation may wait in the queue, forever when
+// zero.
+var queueTTL time.Duration
+
+// Bounds of the work of a dispatch of the queue. The queued reservations a
+// dispatch does not get to wait for the next one, dispatchInterval later at
+// the latest.
+const (
+	maxDispatchSolves = 8
+	dispatchInterval  = time.Minute
+)
+
+// dispatchMu serializes dispatches of the queue. dispatchWaiting is set while
+// a dispatch waits for dispatchMu: that dispatch will see every change made
+// until it starts, so no other needs to wait.
+var (
+	dispatchMu      sync.Mutex
+	dispatchWaiting atomic.Bool
+)
+
+// dispatchQueue hands testbeds to the queued reservations that can now be
+// satisfied within their quota, in queue order, after dropping those queued
+// for longer than queueTTL. Reservations over their quota are not solved, and
+// at most maxDispatchSolves are. Testbeds are solved without reserveMu, which
+// is only held to check that a testbed is still free and to commit it.
+func dispatchQueue() {
+	if !dispatchWaiting.CompareAndSwap(false, true) {
+		return
+	}
+	dispatchMu.Lock()
+	defer dispatchMu.Unlock()
+	dispatchWaiting.Store(false)
+
+	expireQueued()
+	inventoryMu.RLock()
+	waiting := queued()
+	inventoryMu.RUnlock()
+	solves := 0
+	for _, r := range waiting {
+		if solves == maxDispatchSolves {
+			break
+		}
+		inventoryMu.RLock()
+		overQuota := r.Status != statusQueued || checkRequestQuota(r) != nil
+		inventoryMu.RUnlock()
+		if overQuota {
+			continue
+		}
+		solves++
+		ctx, cancel := context.WithTimeout(context.Background(), solveTimeout)
+		_, sol, snapshot, err := solveReservation(ctx, r, false, true)
+		cancel()
+		if err != nil {
+			continue
+		}
+		commitQueued(r, sol, snapshot.translate(sol.assignment))
+	}
+}
+
+// commitQueued hands a testbed to a queued reservation, unless the
+// reservation was canceled while it was solved, or part of the testbed was
+// taken or became unusable meanwhile.
+func commitQueued(r *Reservation, sol *solution, assignment *graph.Assignment) {
+	reserveMu.Lock()
+	defer reserveMu.Unlock()
+	devices, ports := assignedResources(assignment)
+	inventoryMu.RLock()
+	ready := r.Status == statusQueued && assignmentAvailable(r.Owner, assignment) && checkQuota(r, devices, ports) == nil
+	inventoryMu.RUnlock()
+	if ready {
+		commitReservation(r, sol, assignment, nil, audit.System)
+	}
+}
+
+// expireQueued drops the reservations queued for longer than queueTTL.
+func expireQueued() {
+	if queueTTL == 0 {
+		return
+	}
+	now := time.Now()
+	changes := netboxChanges{}
+	inventoryMu.Lock()
+	for _, r := range reservations {
+		if r.Status == statusQueued && now.Sub(r.Created) > queueTTL {
+			expired := releaseLocked(r, events.Expired, audit.System)
+			changes.released = append(changes.released, expired.released...)
+			changes.reserved = append(changes.reserved, expired.reserved...)
+			changes.cleanup = append(changes.cleanup, expired.cleanup...)
+		}
+	}
+	inventoryMu.Unlock()
+	changes.apply()
+}
+
+// dispatchPeriodically dispatches the queue every dispatchInterval.
+func dispatchPeriodically() {
+	for range time.Tick(dispatchInterval) {
+		dispatchQueue()
+	}
+}
+
+func listQueue(c *gin.Context) {
+	inventoryMu.RLock()
+	list := []Reservation{}
+	for _, r := range queued() {
+		list = append(list, *r)
+	}
+	inventoryMu.RUnlock()
+	c.IndentedJSON(http.StatusOK, list)
+}
+
+// QuotaUsage reports the usage of a team or user against its quota.
+type QuotaUsage struct {
+	Name  string `json:"name"`
+	Usage Usage  `json:"usage"`
+	Quota *Quota `json:"quota,omitempty"`
+}
+
+func getUsage(c *gin.Context) {
+	inventoryMu.RLock()
+	defer inventoryMu.RUnlock()
+	teams := map[string]bool{}
+	users := map[string]bool{}
+	for name := range quotas.Teams {
+		teams[name] = true
+	}
+	for name := range quotas.Users {
+		users[name] = true
+	}
+	for _, r := range reservations {
+		teams[r.Team] = true
+		if r.User != "" {
+			users[r.User] = true
+		}
+	}
+	teamUsage := []QuotaUsage{}
+	for _, name := range sortedKeys(teams) {
+		entry := QuotaUsage{Name: name, Usage: usageOf(func(r *Reservation) bool { return r.Team == name })}
+		if quota, ok := quotas.team(name); ok {
+			entry.Quota = &quota
+		}
+		teamUsage = append(teamUsage, entry)
+	}
+	userUsage := []QuotaUsage{}
+	for _, name := range sortedKeys(users) {
+		entry := QuotaUsage{Name: name, Usage: usageOf(func(r *Reservation) bool { return r.User == name })}
+		if quota, ok := quotas.user(name); ok {
+			entry.Quota = &quota
+		}
+		userUsage = append(userUsage, entry)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"teams": teamUsage, "users": userUsage})
+}
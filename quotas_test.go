@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useQuotas enforces quotas for the duration of a test.
+func useQuotas(t *testing.T, q QuotaConfig) {
+	saved := quotas
+	quotas = q
+	t.Cleanup(func() { quotas = saved })
+}
+
+func TestQuotaLimitsDeviceTypes(t *testing.T) {
+	useInventory(t, `{"devices": {
+		"d1": {"attributes": {"type": "DUT", "vendor": "A"}, "interfaces": [{"name": "e0"}]},
+		"d2": {"attributes": {"type": "DUT", "vendor": "K"}, "interfaces": [{"name": "e0"}]},
+		"a1": {"attributes": {"type": "ATE", "vendor": "K"}, "interfaces": [{"name": "e0"}, {"name": "e1"}]},
+		"a2": {"attributes": {"type": "ATE", "vendor": "K"}, "interfaces": [{"name": "e0"}, {"name": "e1"}]}
+	}, "links": []}`)
+	useQuotas(t, QuotaConfig{Teams: map[string]Quota{"core": {MaxDevicesByType: map[string]int{"ATE": 1}}}})
+	held := useReservation(t, "held")
+	held.Team, held.Devices, held.Ports = "core", []string{"a1"}, []string{"a1:e0"}
+
+	for _, tc := range []struct {
+		vendor string
+		ports  int
+		over   bool
+	}{
+		// Only ATEs have two ports: a second ATE for core.
+		{"K", 2, true},
+		{"", 2, true},
+		// Vendor K makes DUTs too, and vendor A only DUTs.
+		{"K", 1, false},
+		{"A", 1, false},
+	} {
+		device := InputDevice{Name: "dev", Vendor: tc.vendor}
+		for i := 0; i < tc.ports; i++ {
+			device.Interfaces = append(device.Interfaces, InputInterface{Name: fmt.Sprintf("p%d", i)})
+		}
+		testbedConfig, err := ConvertData(InputData{Devices: []InputDevice{device}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &Reservation{ID: "new", Team: "core", testbedConfig: testbedConfig}
+		inventoryMu.RLock()
+		err = checkRequestQuota(r)
+		inventoryMu.RUnlock()
+		if over := err != nil; over != tc.over {
+			t.Errorf("vendor %q with %d ports: checkRequestQuota() error = %v, want over quota: %v", tc.vendor, tc.ports, err, tc.over)
+		}
+		if err != nil && !strings.Contains(err.Error(), "ATE") {
+			t.Errorf("checkRequestQuota() error = %v, want the ATE limit", err)
+		}
+	}
+
+	// Once solved, the devices the testbed gets are counted by type.
+	r := &Reservation{ID: "new", Team: "core"}
+	inventoryMu.RLock()
+	errATE, errDUT := checkQuota(r, []string{"a2"}, nil), checkQuota(r, []string{"d2"}, nil)
+	inventoryMu.RUnlock()
+	if errATE == nil || errDUT != nil {
+		t.Errorf("checkQuota() with a2: %v, with d2: %v, want only a2, a second ATE, over quota", errATE, errDUT)
+	}
+}
+
+func TestQueueServesSmallestShareFirst(t *testing.T) {
+	useInventory(t, twoDUTs)
+	useQuotas(t, QuotaConfig{Default: &Quota{MaxDevices: 4}, Teams: map[string]Quota{"large": {MaxDevices: 20}}})
+	held := useReservation(t, "held")
+	held.Team, held.Devices = "busy", []string{"d1", "d2"}
+	inventoryMu.Lock()
+	reservations["held-large"] = &Reservation{ID: "held-large", Team: "large", Status: statusActive, Devices: []string{"x1", "x2"}}
+	inventoryMu.Unlock()
+
+	start := time.Now()
+	inventoryMu.Lock()
+	for i, r := range []*Reservation{
+		{ID: "busy-old", Team: "busy"},
+		{ID: "idle", Team: "idle"},
+		{ID: "large", Team: "large"},
+		{ID: "busy-urgent", Team: "busy", Priority: 1},
+	} {
+		r.Status = statusQueued
+		r.Created = start.Add(time.Duration(i) * time.Second)
+		reservations[r.ID] = r
+	}
+	order := []string{}
+	for _, r := range queued() {
+		order = append(order, r.ID)
+	}
+	inventoryMu.Unlock()
+
+	// busy and large hold as many devices, but busy half its quota of 4 and
+	// large a tenth of its 20: higher priority first, then the smallest
+	// share, then the oldest.
+	if want := "[busy-urgent idle large busy-old]"; fmt.Sprint(order) != want {
+		t.Errorf("queue order %v, want %s", order, want)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"lablrs/audit"
+	"lablrs/cleanup"
+	"lablrs/events"
+	"lablrs/utils"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	graph "github.com/openconfig/ondatra/binding/portgraph"
+)
+
+// cleaner runs the release hooks of the devices of released reservations.
+// Without it devices are given out again as soon as they are released.
+var cleaner *cleanup.Runner
+
+// cleanupAlertURL receives an alert when a device is quarantined because its
+// cleanup failed.
+var cleanupAlertURL string
+
+// cleaning holds the devices being cleaned up, with the reservation that
+// released them. It is guarded by inventoryMu.
+var cleaning = map[string]string{}
+
+// Device types of the inventory the release hooks are chosen by. NetBox
+// names ATEs either ATE or TGEN.
+var (
+	dutTypes = []string{"DUT"}
+	ateTypes = []string{"ATE", "TGEN"}
+)
+
+// newCleaner returns the release hooks configured by cfg, or nil if there
+// are none. DUTs get their golden configuration back, then their script run;
+// ATEs get their sessions cleared, then their script run.
+func newCleaner(cfg *Config) *cleanup.Runner {
+	rules := []cleanup.Rule{}
+	if cfg.GoldenConfigDir != "" {
+		hook := cleanup.GoldenConfig{Client: gnmiClient(cfg), Dir: cfg.GoldenConfigDir}
+		rules = append(rules, cleanup.Rule{Name: "golden configuration", Types: dutTypes, Hook: hook})
+	}
+	if cfg.DUTCleanupScript != "" {
+		rules = append(rules, cleanup.Rule{Name: "DUT cleanup script", Types: dutTypes, Hook: cleanup.Script{Path: cfg.DUTCleanupScript}})
+	}
+	if cfg.OTGClear {
+		hook := cleanup.OTGClear{InsecureSkipVerify: cfg.OTGInsecure}
+		rules = append(rules, cleanup.Rule{Name: "ATE session clear", Types: ateTypes, Hook: hook})
+	}
+	if cfg.ATECleanupScript != "" {
+		rules = append(rules, cleanup.Rule{Name: "ATE cleanup script", Types: ateTypes, Hook: cleanup.Script{Path: cfg.ATECleanupScript}})
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return &cleanup.Runner{Rules: rules, Timeout: cfg.CleanupTimeout}
+}
+
+// startCleaningLocked marks the devices released by r that need cleaning up,
+// and returns them. Shareable devices are only cleaned up once no other
+// reservation holds them. The caller must hold inventoryMu.
+func startCleaningLocked(r *Reservation) []cleanup.Device {
+	if cleaner == nil {
+		return nil
+	}
+	devices := []cleanup.Device{}
+	for _, name := range r.Devices {
+		node, ok := inventoryNodes[name]
+		if !ok || (isShareable(node) && len(holdingReservations(name)) > 1) {
+			continue
+		}
+		d := cleanup.Device{
+			Name:        name,
+			Attrs:       copyAttrs(inventoryConfig.Devices[name].Attrs),
+			Services:    healthTarget(name).Services,
+			Reservation: r.ID,
+		}
+		if cleaner.Needed(d) {
+			cleaning[name] = r.ID
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// cleaningExclusions adds the devices being cleaned up to the exclusions of
+// an inventory view. The caller must hold inventoryMu.
+func cleaningExclusions(excludedNodes map[*graph.ConcreteNode]bool) {
+	for name := range cleaning {
+		if node, ok := inventoryNodes[name]; ok {
+			excludedNodes[node] = true
+		}
+	}
+}
+
+// runCleanup cleans up devices in the background. They are marked as being
+// cleaned up in NetBox meanwhile.
+func runCleanup(devices []cleanup.Device) {
+	if len(devices) == 0 {
+		return
+	}
+	names := []string{}
+	for _, d := range devices {
+		names = append(names, d.Name)
+	}
+	setNetboxState(names, utils.StateCleaning)
+	for _, d := range devices {
+		go func(d cleanup.Device) {
+			finishCleanup(d, cleaner.Run(context.Background(), d))
+		}(d)
+	}
+}
+
+// finishCleanup returns a cleaned up device to the pool, or quarantines it if
+// its cleanup failed. Pending reservations waiting for a device that failed
+// its cleanup are queued again to be given other devices.
+func finishCleanup(d cleanup.Device, err error) {
+	inventoryMu.Lock()
+	if cleaning[d.Name] != d.Reservation {
+		inventoryMu.Unlock()
+		return
+	}
+	delete(cleaning, d.Name)
+	changes := netboxChanges{}
+	if err != nil {
+		changes.released = requeueWaiting(d.Name)
+	}
+	changes.reserved = activatePending()
+	state := netboxState(d.Name)
+	if inMaintenance(d.Name) {
+		state = utils.StateMaintenance
+	}
+	inventoryMu.Unlock()
+
+	if err != nil {
+		log.Printf("Cleanup of %s after reservation %s failed: %v", d.Name, d.Reservation, err)
+		healthChecker.Quarantine(d.Name, err)
+		alertCleanupFailed(d, err)
+	} else {
+		setNetboxState([]string{d.Name}, state)
+	}
+	changes.apply()
+	go dispatchQueue()
+}
+
+// requeueWaiting queues again the pending reservations holding a device and
+// returns the devices this frees. The caller must hold inventoryMu.
+func requeueWaiting(device string) []string {
+	freed := []string{}
+	for _, r := range reservations {
+		if r.Status != statusPending {
+			continue
+		}
+		for _, name := range r.Devices {
+			if name != device {
+				continue
+			}
+			freed = append(freed, unclaim(r)...)
+			r.Status = statusQueued
+			r.Testbed = Testbed{ReservationID: r.ID, Status: statusQueued}
+			r.Devices, r.Ports, r.Preempts = nil, nil, nil
+			recordReservation(events.Queued, audit.System, r, map[string]string{"reason": "device " + device + " failed its cleanup"})
+			log.Printf("Reservation %s queued again: device %s failed its cleanup", r.ID, device)
+			break
+		}
+	}
+	return freed
+}
+
+// alertCleanupFailed reports a device quarantined after a failed cleanup to
+// the alert URL.
+func alertCleanupFailed(d cleanup.Device, reason error) {
+	if cleanupAlertURL == "" {
+		return
+	}
+	go func() {
+		content, _ := json.Marshal(gin.H{
+			"event":       "cleanup_failed",
+			"device":      d.Name,
+			"reservation": d.Reservation,
+			"error":       reason.Error(),
+			"quarantined": true,
+		})
+		resp, err := http.Post(cleanupAlertURL, "application/json", bytes.NewBuffer(content))
+		if err != nil {
+			log.Printf("Error alerting of the failed cleanup of %s: %v", d.Name, err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
+
+// CleaningDevice is a device being cleaned up.
+type CleaningDevice struct {
+	Device      string `json:"device"`
+	Reservation string `json:"reservation"`
+}
+
+func listCleaning(c *gin.Context) {
+	inventoryMu.RLock()
+	list := []CleaningDevice{}
+	for _, name := range sortedKeys(cleaning) {
+		list = append(list, CleaningDevice{Device: name, Reservation: cleaning[name]})
+	}
+	inventoryMu.RUnlock()
+	c.IndentedJSON(http.StatusOK, list)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"lablrs/utilization"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// usageHistory records when the devices and ports of released reservations
+// were held. Nothing is recorded while it is nil.
+var usageHistory *utilization.History
+
+// defaultReportRange is the range of reports not given a start.
+const defaultReportRange = 7 * 24 * time.Hour
+
+// reservationIntervals lists the devices, with their ports, a reservation
+// held from its start until end. The caller must hold inventoryMu.
+func reservationIntervals(r *Reservation, end time.Time) []utilization.Interval {
+	if r.Started == nil {
+		return nil
+	}
+	intervals := []utilization.Interval{}
+	for _, device := range r.Testbed.Devices {
+		i := utilization.Interval{
+			Reservation: r.ID,
+			User:        ownerName(r),
+			Team:        r.Team,
+			Device:      device.Name,
+			Type:        device.Attrs["type"],
+			Vendor:      device.Attrs["vendor"],
+			Start:       *r.Started,
+			End:         end,
+		}
+		for _, port := range device.Ports {
+			i.Ports = append(i.Ports, port.Name)
+		}
+		intervals = append(intervals, i)
+	}
+	return intervals
+}
+
+// recordUsage records what a reservation held until it was released. The
+// caller must hold inventoryMu.
+func recordUsage(r *Reservation) {
+	if usageHistory == nil || r.Released == nil {
+		return
+	}
+	if err := usageHistory.Append(reservationIntervals(r, *r.Released)); err != nil {
+		log.Printf("Error recording the usage of reservation %s: %v", r.ID, err)
+	}
+}
+
+// utilizationReport reports the utilization of the inventory from from to to,
+// the reservations holding their testbed counting until now.
+func utilizationReport(from, to time.Time) (utilization.Report, error) {
+	intervals, err := usageHistory.Overlapping(from, to)
+	if err != nil {
+		return utilization.Report{}, err
+	}
+	lastUsed, err := usageHistory.LastUsed(to)
+	if err != nil {
+		return utilization.Report{}, err
+	}
+	now := time.Now()
+	inventoryMu.RLock()
+	defer inventoryMu.RUnlock()
+	for _, r := range reservations {
+		if r.holds() {
+			intervals = append(intervals, reservationIntervals(r, now)...)
+		}
+	}
+	devices := []utilization.Device{}
+	for _, node := range inventory.Nodes {
+		devices = append(devices, utilization.Device{
+			Name:   node.Desc,
+			Type:   node.Attrs["type"],
+			Vendor: node.Attrs["vendor"],
+			Ports:  len(node.Ports),
+		})
+	}
+	return utilization.Compute(devices, intervals, lastUsed, from, to), nil
+}
+
+// getReport reports the utilization of the inventory between the from and
+// to query parameters, RFC 3339 times defaulting to the last week. The whole
+// report is JSON; its tables, e.g. /reports/devices, are JSON or, with
+// format=csv, CSV.
+func getReport(c *gin.Context) {
+	to := time.Now()
+	var from time.Time
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := c.Query(name); v != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: %q is not an RFC 3339 time", name, v)})
+				return
+			}
+		}
+	}
+	if from.IsZero() {
+		from = to.Add(-defaultReportRange)
+	}
+	if !from.Before(to) {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown format %q, expected json or csv", format)})
+		return
+	}
+	table := c.Param("table")
+	if table == "" && format == "csv" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("CSV reports are tables, one of %s", strings.Join(utilization.Tables, ", "))})
+		return
+	}
+
+	report, err := utilizationReport(from, to)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if table == "" {
+		c.IndentedJSON(http.StatusOK, report)
+		return
+	}
+	rows, ok := report.Table(table)
+	if !ok {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("unknown report %q, expected one of %s", table, strings.Join(utilization.Tables, ", "))})
+		return
+	}
+	if format == "json" {
+		switch table {
+		case "devices":
+			c.IndentedJSON(http.StatusOK, report.Devices)
+		case "idle":
+			c.IndentedJSON(http.StatusOK, report.Idle)
+		case "types":
+			c.IndentedJSON(http.StatusOK, report.Types)
+		case "teams":
+			c.IndentedJSON(http.StatusOK, report.Teams)
+		}
+		return
+	}
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, table))
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	w.WriteAll(rows)
+	if err := w.Error(); err != nil {
+		log.Printf("Error writing the %s report: %v", table, err)
+	}
+}
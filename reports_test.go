@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"lablrs/utilization"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGetReport(t *testing.T) {
+	useInventory(t, twoDUTs)
+	history, err := utilization.OpenHistory(filepath.Join(t.TempDir(), "usage_history.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := usageHistory
+	usageHistory = history
+	t.Cleanup(func() { usageHistory = saved })
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = history.Append([]utilization.Interval{{Reservation: "r1", Team: "core", Device: "d1", Type: "DUT", Ports: []string{"e0"}, Start: from.Add(time.Hour), End: from.Add(6 * time.Hour)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/reports", getReport)
+	router.GET("/reports/:table", getReport)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	rangeQuery := "from=2024-01-01T00:00:00Z&to=2024-01-01T10:00:00Z"
+
+	w := get("/reports?" + rangeQuery)
+	report := utilization.Report{}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &report) != nil {
+		t.Fatalf("GET /reports = %d %s", w.Code, w.Body)
+	}
+	if report.Peak.Devices != 1 || len(report.Devices) != 2 || report.Devices[0].Utilization != 50 || len(report.Idle) != 1 || report.Idle[0].Device != "d2" {
+		t.Errorf("report %+v, want d1 busy half the time and d2 idle", report)
+	}
+
+	w = get("/reports/teams?" + rangeQuery)
+	teams := []utilization.GroupUsage{}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &teams) != nil || len(teams) != 1 || teams[0].Name != "core" {
+		t.Errorf("GET /reports/teams = %d %s, want the core team", w.Code, w.Body)
+	}
+
+	w = get("/reports/devices?format=csv&" + rangeQuery)
+	rows, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+	if w.Code != http.StatusOK || err != nil || len(rows) != 3 {
+		t.Fatalf("GET /reports/devices?format=csv = %d %s", w.Code, w.Body)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") || rows[0][0] != "device" || rows[1][0] != "d1" || rows[1][5] != "50" || rows[1][7] != "2024-01-01T06:00:00Z" {
+		t.Errorf("CSV report %v", rows)
+	}
+
+	for path, want := range map[string]int{
+		"/reports?format=csv":                                        http.StatusBadRequest,
+		"/reports/devices?format=xml":                                http.StatusBadRequest,
+		"/reports?from=yesterday":                                    http.StatusBadRequest,
+		"/reports?from=2024-01-02T00:00:00Z&to=2024-01-01T00:00:00Z": http.StatusBadRequest,
+		"/reports/racks?" + rangeQuery:                               http.StatusNotFound,
+	} {
+		if w := get(path); w.Code != want {
+			t.Errorf("GET %s = %d %s, want %d", path, w.Code, w.Body, want)
+		}
+	}
+}
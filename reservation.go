@@ -2,12 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"lablrs/audit"
+	"lablrs/auth"
+	"lablrs/events"
+	"lablrs/utilization"
 	"lablrs/utils"
 	"log"
 	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	graph "github.com/openconfig/ondatra/binding/portgraph"
@@ -18,6 +32,34 @@ var inventory graph.ConcreteGraph
 var configNodesToDevices map[*graph.ConcreteNode]Device
 var configPortsToPorts map[*graph.ConcretePort]Interface
 
+// inventoryNodes and inventoryPorts index the inventory by device name and by
+// "device:port" name.
+var inventoryNodes map[string]*graph.ConcreteNode
+var inventoryPorts map[string]*graph.ConcretePort
+
+// sharingPortShareable is the "sharing" attribute of devices whose ports may
+// be reserved by several reservations at once. Devices with any other value
+// are reserved as a whole.
+const sharingPortShareable = "port-shareable"
+
+func isShareable(n *graph.ConcreteNode) bool {
+	return n.Attrs["sharing"] == sharingPortShareable
+}
+
+// inventoryMu guards the attributes of the inventory nodes and ports.
+var inventoryMu sync.RWMutex
+
+// reserveMu serializes reservations, so that no two requests are given the
+// same ports.
+var reserveMu sync.Mutex
+
+// policy controls what principals may do. Without a policy file every
+// principal may do everything.
+var policy *auth.Policy
+
+// solveTimeout bounds the time spent finding an assignment for one request.
+var solveTimeout time.Duration
+
 type Inventory struct {
 	Desc    string            `json:"desc"`
 	Devices map[string]Device `json:"devices"`
@@ -25,13 +67,22 @@ type Inventory struct {
 }
 
 type Testbed struct {
-	Desc    string             `json:"desc"`
-	Devices map[string]BDevice `json:"devices"`
-	Links   []Link             `json:"links"`
+	Desc       string             `json:"desc"`
+	Devices    map[string]BDevice `json:"devices"`
+	Links      []Link             `json:"links"`
+	LinkGroups []LinkGroup        `json:"link_groups,omitempty"`
+	// DeviceGroups holds the affinity rules of a requested testbed.
+	DeviceGroups []DeviceGroup `json:"device_groups,omitempty"`
+	Cost         float64       `json:"cost,omitempty"`
+	// UnmetPreferences lists the preferences given up to satisfy the request.
+	UnmetPreferences []UnmetPreference `json:"unmet_preferences,omitempty"`
+	ReservationID    string            `json:"reservation_id,omitempty"`
+	Status           string            `json:"status,omitempty"`
 }
 
 type Device struct {
 	Name       string            `json:"name"`
+	State      string            `json:"state,omitempty"`
 	Attrs      map[string]string `json:"attributes"`
 	Services   []Service         `json:"services"`
 	Interfaces []Interface       `json:"interfaces"`
@@ -55,15 +106,59 @@ type Link struct {
 	Dst string `json:"dst"`
 }
 
+// LinkGroup is a set of parallel links between two devices, optionally
+// bundled with LACP. Same lists the port attributes that must be equal on all
+// member ports of each side.
+type LinkGroup struct {
+	Name  string   `json:"name"`
+	LACP  bool     `json:"lacp,omitempty"`
+	Same  []string `json:"same,omitempty"`
+	Links []Link   `json:"links"`
+}
+
+// DeviceGroup is an affinity rule between devices of a request. With Rule
+// "same" the devices must all have the same value of Attribute, such as
+// "rack", "site" or "chassis"; with Rule "different" no two of them may share
+// a value. Devices lacking the attribute satisfy neither rule.
+type DeviceGroup struct {
+	Devices   []string `json:"devices"`
+	Attribute string   `json:"attribute"`
+	Rule      string   `json:"rule"`
+}
+
+const (
+	ruleSame      = "same"
+	ruleDifferent = "different"
+)
+
 type BDevice struct {
 	Name  string            `json:"name"`
 	Attrs map[string]string `json:"attributes"`
 	Ports map[string]Port   `json:"ports"`
+	Prefs []Preference      `json:"preferences,omitempty"`
 }
 
 type Port struct {
 	Name  string            `json:"name"`
 	Attrs map[string]string `json:"attributes"`
+	Prefs []Preference      `json:"preferences,omitempty"`
+}
+
+// Preference is a soft constraint: the attribute should have the given value,
+// but the request may still be satisfied without it. When not all preferences
+// can be honored, those with the lowest weight are given up first.
+type Preference struct {
+	Name   string  `json:"name"`
+	Value  string  `json:"value"`
+	Weight float64 `json:"weight,omitempty"`
+}
+
+// UnmetPreference identifies a preference of a device, or of one of its ports
+// when Port is set.
+type UnmetPreference struct {
+	Device string `json:"device"`
+	Port   string `json:"port,omitempty"`
+	Preference
 }
 
 type InputAttributes struct {
@@ -72,33 +167,255 @@ type InputAttributes struct {
 }
 
 type InputInterface struct {
-	Attributes []InputAttributes `json:"attributes,omitempty"`
-	Name       string            `json:"name"`
-	Speed      string            `json:"speed,omitempty"`
+	Attributes  []InputAttributes `json:"attributes,omitempty"`
+	Preferences []Preference      `json:"preferences,omitempty"`
+	Name        string            `json:"name"`
+	Speed       string            `json:"speed,omitempty"`
 }
 
 type InputDevice struct {
-	Interfaces []InputInterface `json:"interfaces"`
-	Model      string           `json:"model"`
-	Name       string           `json:"name"`
-	Vendor     string           `json:"vendor"`
+	Interfaces  []InputInterface    `json:"interfaces"`
+	AnyPorts    []InputPortWildcard `json:"any_ports,omitempty"`
+	Preferences []Preference        `json:"preferences,omitempty"`
+	Model       string              `json:"model"`
+	Name        string              `json:"name"`
+	Vendor      string              `json:"vendor"`
+}
+
+// InputPortWildcard asks for Count ports of a device without naming them.
+// When ConnectedTo names another device of the request, each of the ports is
+// linked to a port of that device.
+type InputPortWildcard struct {
+	Count       int               `json:"count"`
+	Speed       string            `json:"speed,omitempty"`
+	Attributes  []InputAttributes `json:"attributes,omitempty"`
+	ConnectedTo string            `json:"connected_to,omitempty"`
+}
+
+// wildcardPortName returns the name of the i-th (zero based) port synthesized
+// for the k-th wildcard of a device.
+func wildcardPortName(k, i int) string {
+	return fmt.Sprintf("any%d/%d", k+1, i+1)
+}
+
+// wildcardPeerPortName returns the name of the port synthesized on the peer
+// device for the i-th port of the k-th wildcard of device dname.
+func wildcardPeerPortName(dname string, k, i int) string {
+	return dname + "." + wildcardPortName(k, i)
 }
 
 type InputLink struct {
-	Dst string `json:"dst"`
-	Src string `json:"src"`
+	Dst Endpoint `json:"dst"`
+	Src Endpoint `json:"src"`
+}
+
+// Endpoint identifies one end of a link by device and port name. In a request
+// it may be written either as an object {"device": "d1", "port": "intf1"} or
+// as a "device:port" string.
+type Endpoint struct {
+	Device string `json:"device"`
+	Port   string `json:"port"`
+}
+
+func (e Endpoint) String() string {
+	return e.Device + ":" + e.Port
+}
+
+func (e *Endpoint) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		device, port, found := strings.Cut(s, ":")
+		if !found {
+			// A bare port name; the device is resolved from the request.
+			*e = Endpoint{Port: s}
+			return nil
+		}
+		*e = Endpoint{Device: device, Port: port}
+		return nil
+	}
+	type endpoint Endpoint
+	var ep endpoint
+	if err := json.Unmarshal(data, &ep); err != nil {
+		return fmt.Errorf("link endpoint must be a \"device:port\" string or a {device, port} object")
+	}
+	*e = Endpoint(ep)
+	return nil
+}
+
+// InputLinkGroup asks for Count parallel links between devices Src and Dst
+// without naming the member ports. Same lists port attributes, such as "speed"
+// or "linecard", whose value must match across the member ports of each side.
+type InputLinkGroup struct {
+	Name  string   `json:"name"`
+	Src   string   `json:"src"`
+	Dst   string   `json:"dst"`
+	Count int      `json:"count"`
+	Speed string   `json:"speed,omitempty"`
+	LACP  bool     `json:"lacp,omitempty"`
+	Same  []string `json:"same,omitempty"`
+}
+
+// portName returns the name of the i-th (zero based) port synthesized for
+// the group on each of its devices.
+func (g InputLinkGroup) portName(i int) string {
+	return fmt.Sprintf("%s/%d", g.Name, i+1)
 }
 
 type InputData struct {
-	Devices []InputDevice `json:"devices"`
-	Links   []InputLink   `json:"links"`
+	Devices    []InputDevice    `json:"devices"`
+	Links      []InputLink      `json:"links"`
+	LinkGroups []InputLinkGroup `json:"link_groups,omitempty"`
+	// DeviceGroups lists affinity and anti-affinity rules between devices.
+	DeviceGroups []DeviceGroup `json:"device_groups,omitempty"`
+}
+
+// ReserveRequest is the body of a reservation request: either a topology
+// given inline, or the name of a stored template with its parameters. A
+// request that cannot be satisfied may preempt reservations of a lower
+// Priority; NotifyURL is called if the reservation is itself preempted.
+// Reservations count against the quotas of their User and Team, which are
+// taken from the credentials of authenticated callers; with Wait, a request
+// that cannot be satisfied yet is queued instead of refused. A reservation
+// with a Duration expires that long, up to maxLease, after its testbed is
+// assigned, unless renewed. With DryRun, the testbed that would be assigned
+// is returned and nothing is reserved.
+type ReserveRequest struct {
+	InputData
+	Template  string                 `json:"template,omitempty"`
+	Version   int                    `json:"version,omitempty"`
+	Params    map[string]interface{} `json:"params,omitempty"`
+	Priority  int                    `json:"priority,omitempty"`
+	NotifyURL string                 `json:"notify_url,omitempty"`
+	User      string                 `json:"user,omitempty"`
+	Team      string                 `json:"team,omitempty"`
+	Wait      bool                   `json:"wait,omitempty"`
+	Duration  string                 `json:"duration,omitempty"`
+	DryRun    bool                   `json:"dry_run,omitempty"`
 }
 
 func uploadInventory() {
 	loadConcreteGraph()
 }
 
-func ConvertData(srcData InputData) Testbed {
+// loadInventory reads the inventory file and rebuilds the inventory graph.
+// What reservations hold is marked reserved again in the new graph.
+func loadInventory(path string) error {
+	return loadInventoryKeeping(path, "")
+}
+
+// readInventory reads an inventory file.
+func readInventory(path string) (Inventory, error) {
+	jsonData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Inventory{}, fmt.Errorf("Error reading file: %v", err)
+	}
+	config := Inventory{}
+	// Unmarshalling JSON data into the inventoryConfig object
+	err = json.Unmarshal(jsonData, &config)
+	if err != nil {
+		return Inventory{}, fmt.Errorf("Error unmarshalling JSON: %v", err)
+	}
+	return config, nil
+}
+
+// loadInventoryKeeping loads the inventory of path like loadInventory. The
+// devices reservations hold or wait for, or that are being cleaned up, are
+// taken from the inventory of globalPath when path leaves them out, as
+// inventory.json does with the devices reserved in NetBox.
+func loadInventoryKeeping(path, globalPath string) error {
+	config, err := readInventory(path)
+	if err != nil {
+		return err
+	}
+	global := Inventory{}
+	if globalPath != "" {
+		if global, err = readInventory(globalPath); err != nil {
+			return err
+		}
+	}
+	inventoryMu.Lock()
+	defer inventoryMu.Unlock()
+	for name, device := range global.Devices {
+		_, dirty := cleaning[name]
+		if _, ok := config.Devices[name]; ok || (!dirty && len(holdingReservations(name)) == 0) {
+			continue
+		}
+		if config.Devices == nil {
+			config.Devices = map[string]Device{}
+		}
+		config.Devices[name] = device
+	}
+	inventoryConfig = config
+	inventory = graph.ConcreteGraph{}
+	configNodesToDevices = map[*graph.ConcreteNode]Device{}
+	configPortsToPorts = map[*graph.ConcretePort]Interface{}
+	inventoryNodes = map[string]*graph.ConcreteNode{}
+	inventoryPorts = map[string]*graph.ConcretePort{}
+	uploadInventory()
+	for _, r := range reservations {
+		if r.holds() || r.Status == statusPending {
+			claim(r)
+		}
+	}
+	return nil
+}
+
+// refreshInventory reloads the inventory from NetBox. Reservations keep what
+// they hold, although NetBox now has it reserved; devices and ports that
+// left NetBox are no longer offered.
+func refreshInventory(c *gin.Context) {
+	reserveMu.Lock()
+	utils.GetCreateInvFromNetbox()
+	err := loadInventoryKeeping(utils.DataPath("inventory.json"), utils.DataPath("inventory_global.json"))
+	reserveMu.Unlock()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	go dispatchQueue()
+	inventoryMu.RLock()
+	devices, ports := len(inventory.Nodes), 0
+	for _, node := range inventory.Nodes {
+		ports += len(node.Ports)
+	}
+	inventoryMu.RUnlock()
+	publishDevice(events.InventoryRefreshed, "", map[string]string{"devices": strconv.Itoa(devices), "ports": strconv.Itoa(ports)})
+	c.IndentedJSON(http.StatusOK, gin.H{"devices": devices, "ports": ports})
+}
+
+// InventoryDevice is a device of the inventory with its ports, its state as
+// in the device metrics, and the reservations holding it.
+type InventoryDevice struct {
+	Name         string            `json:"name"`
+	Attrs        map[string]string `json:"attributes"`
+	State        string            `json:"state"`
+	Reservations []string          `json:"reservations,omitempty"`
+	Ports        []Port            `json:"ports"`
+}
+
+func listInventory(c *gin.Context) {
+	inventoryMu.RLock()
+	list := []InventoryDevice{}
+	for _, node := range inventory.Nodes {
+		device := InventoryDevice{
+			Name:         node.Desc,
+			Attrs:        copyAttrs(node.Attrs),
+			State:        deviceState(node.Desc),
+			Reservations: holdingReservations(node.Desc),
+			Ports:        []Port{},
+		}
+		for _, port := range node.Ports {
+			device.Ports = append(device.Ports, Port{Name: port.Desc, Attrs: copyAttrs(port.Attrs)})
+		}
+		sort.Slice(device.Ports, func(i, j int) bool { return device.Ports[i].Name < device.Ports[j].Name })
+		list = append(list, device)
+	}
+	inventoryMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	c.IndentedJSON(http.StatusOK, list)
+}
+
+func ConvertData(srcData InputData) (Testbed, error) {
 	destData := Testbed{
 		Desc:    "testbed",
 		Devices: make(map[string]BDevice),
@@ -109,6 +426,7 @@ func ConvertData(srcData InputData) Testbed {
 			Name:  srcDevice.Name,
 			Attrs: make(map[string]string),
 			Ports: make(map[string]Port),
+			Prefs: srcDevice.Preferences,
 		}
 
 		// Process device attributes
@@ -121,6 +439,7 @@ func ConvertData(srcData InputData) Testbed {
 			destPort := Port{
 				Name:  srcInterface.Name,
 				Attrs: make(map[string]string),
+				Prefs: srcInterface.Preferences,
 			}
 
 			// Process interface attributes
@@ -130,7 +449,7 @@ func ConvertData(srcData InputData) Testbed {
 
 			// Process speed attribute
 			if srcInterface.Speed != "" {
-				destPort.Attrs["speed"] = srcInterface.Speed
+				destPort.Attrs["speed"] = normalizeSpeed(srcInterface.Speed)
 			}
 
 			destDevice.Ports[srcInterface.Name] = destPort
@@ -142,56 +461,145 @@ func ConvertData(srcData InputData) Testbed {
 	}
 
 	// Process links
-	for _, srcLink := range srcData.Links {
-		// Update device names in the links based on the mapping
-		srcDeviceName := parseLink(srcLink.Src)
-		dstDeviceName := parseLink(srcLink.Dst)
-
-		srcDeviceName = deviceNameMap[srcDeviceName]
-		dstDeviceName = deviceNameMap[dstDeviceName]
-		srcPortName := srcLink.Src
-		dstPortName := srcLink.Dst
+	for i, srcLink := range srcData.Links {
+		src, err := resolveEndpoint(srcData, srcLink.Src)
+		if err != nil {
+			return Testbed{}, fmt.Errorf("links[%d].src: %v", i, err)
+		}
+		dst, err := resolveEndpoint(srcData, srcLink.Dst)
+		if err != nil {
+			return Testbed{}, fmt.Errorf("links[%d].dst: %v", i, err)
+		}
 
+		// Update device names in the links based on the mapping
 		destLink := Link{
-			Src: fmt.Sprintf("%s:%s", srcDeviceName, srcPortName),
-			Dst: fmt.Sprintf("%s:%s", dstDeviceName, dstPortName),
+			Src: fmt.Sprintf("%s:%s", deviceNameMap[src.Device], src.Port),
+			Dst: fmt.Sprintf("%s:%s", deviceNameMap[dst.Device], dst.Port),
 		}
 		destData.Links = append(destData.Links, destLink)
 	}
 
-	return destData
-}
+	// Expand port wildcards into ports, and links to the peer device if any
+	for _, srcDevice := range srcData.Devices {
+		dname := deviceNameMap[srcDevice.Name]
+		for k, wildcard := range srcDevice.AnyPorts {
+			peer, connected := destData.Devices[deviceNameMap[wildcard.ConnectedTo]]
+			if wildcard.ConnectedTo != "" && !connected {
+				return Testbed{}, fmt.Errorf("device %q: any_ports[%d]: device %q not found", srcDevice.Name, k, wildcard.ConnectedTo)
+			}
+			for i := 0; i < wildcard.Count; i++ {
+				destPort := Port{Name: wildcardPortName(k, i), Attrs: make(map[string]string)}
+				for _, srcAttr := range wildcard.Attributes {
+					destPort.Attrs[srcAttr.Name] = srcAttr.Value
+				}
+				if wildcard.Speed != "" {
+					destPort.Attrs["speed"] = normalizeSpeed(wildcard.Speed)
+				}
+				destData.Devices[dname].Ports[destPort.Name] = destPort
+				if !connected {
+					continue
+				}
+				peerPort := Port{Name: wildcardPeerPortName(dname, k, i), Attrs: make(map[string]string)}
+				if wildcard.Speed != "" {
+					peerPort.Attrs["speed"] = normalizeSpeed(wildcard.Speed)
+				}
+				peer.Ports[peerPort.Name] = peerPort
+				destLink := Link{
+					Src: fmt.Sprintf("%s:%s", dname, destPort.Name),
+					Dst: fmt.Sprintf("%s:%s", peer.Name, peerPort.Name),
+				}
+				destData.Links = append(destData.Links, destLink)
+			}
+		}
+	}
 
-// parseLink splits the link string into device and port parts
-func parseLink(link string) string {
-	parts := splitLink(link)
-	// return parts[0], parts[1]  // here return both device and interface names
-	return parts[0]
-}
+	// Expand link groups into one port on each device per member link
+	for i, srcGroup := range srcData.LinkGroups {
+		for _, dname := range []string{srcGroup.Src, srcGroup.Dst} {
+			if _, ok := destData.Devices[deviceNameMap[dname]]; !ok {
+				return Testbed{}, fmt.Errorf("link_groups[%d]: device %q not found", i, dname)
+			}
+		}
+		destGroup := LinkGroup{Name: srcGroup.Name, LACP: srcGroup.LACP, Same: srcGroup.Same}
+		for i := 0; i < srcGroup.Count; i++ {
+			portName := srcGroup.portName(i)
+			for _, dname := range []string{srcGroup.Src, srcGroup.Dst} {
+				destPort := Port{Name: portName, Attrs: make(map[string]string)}
+				if srcGroup.Speed != "" {
+					destPort.Attrs["speed"] = normalizeSpeed(srcGroup.Speed)
+				}
+				destData.Devices[deviceNameMap[dname]].Ports[portName] = destPort
+			}
+			destLink := Link{
+				Src: fmt.Sprintf("%s:%s", deviceNameMap[srcGroup.Src], portName),
+				Dst: fmt.Sprintf("%s:%s", deviceNameMap[srcGroup.Dst], portName),
+			}
+			destData.Links = append(destData.Links, destLink)
+			destGroup.Links = append(destGroup.Links, destLink)
+		}
+		destData.LinkGroups = append(destData.LinkGroups, destGroup)
+	}
+
+	for _, srcGroup := range srcData.DeviceGroups {
+		destGroup := DeviceGroup{Attribute: srcGroup.Attribute, Rule: srcGroup.Rule}
+		for _, dname := range srcGroup.Devices {
+			destGroup.Devices = append(destGroup.Devices, deviceNameMap[dname])
+		}
+		destData.DeviceGroups = append(destData.DeviceGroups, destGroup)
+	}
 
-// splitLink splits the link string into device and port parts
-func splitLink(link string) []string {
-	return split(link, "_")
+	return destData, nil
 }
 
-// split is a helper function to split a string based on a separator
-func split(s, sep string) []string {
-	return append([]string{}, append([]string(nil), splitSlice(s, sep)...)...)
+var speedPattern = regexp.MustCompile(`(?i)^(\d+)\s*g(b|bps|bit|be)?$`)
+
+// normalizeSpeed converts short speed notations such as "100G" or "400Gbps"
+// to the "speed_100_gbps" form used by the inventory. Other values are
+// returned unchanged.
+func normalizeSpeed(speed string) string {
+	if m := speedPattern.FindStringSubmatch(strings.TrimSpace(speed)); m != nil {
+		return "speed_" + m[1] + "_gbps"
+	}
+	return speed
 }
 
-// splitSlice is a helper function to split a string based on a separator
-func splitSlice(s, sep string) []string {
-	i := 0
-	for {
-		if i+len(sep) > len(s) {
-			break
+// resolveEndpoint checks that the endpoint names a device and port of the
+// request. An endpoint given as a bare port name is resolved to the single
+// device that has an interface of that name.
+func resolveEndpoint(srcData InputData, ep Endpoint) (Endpoint, error) {
+	if ep.Port == "" {
+		return ep, fmt.Errorf("endpoint %q has no port", ep.String())
+	}
+	if ep.Device == "" {
+		owners := []string{}
+		for _, device := range srcData.Devices {
+			for _, intf := range device.Interfaces {
+				if intf.Name == ep.Port {
+					owners = append(owners, device.Name)
+				}
+			}
+		}
+		switch len(owners) {
+		case 0:
+			return ep, fmt.Errorf("port %q not found on any device", ep.Port)
+		case 1:
+			return Endpoint{Device: owners[0], Port: ep.Port}, nil
+		default:
+			return ep, fmt.Errorf("port %q is ambiguous, found on devices %s; use \"device:port\"", ep.Port, strings.Join(owners, ", "))
 		}
-		if s[i:i+len(sep)] == sep {
-			return append([]string{s[:i]}, splitSlice(s[i+len(sep):], sep)...)
+	}
+	for _, device := range srcData.Devices {
+		if device.Name != ep.Device {
+			continue
+		}
+		for _, intf := range device.Interfaces {
+			if intf.Name == ep.Port {
+				return ep, nil
+			}
 		}
-		i++
+		return ep, fmt.Errorf("device %q has no port %q", ep.Device, ep.Port)
 	}
-	return append([]string{s}, []string{}...)
+	return ep, fmt.Errorf("device %q not found", ep.Device)
 }
 
 func loadConcreteGraph() {
@@ -209,6 +617,7 @@ func loadConcreteGraph() {
 			ports = append(ports, newPort)
 			configPortsToPorts[newPort] = port
 			portPointers[dname+":"+port.Name] = newPort
+			inventoryPorts[newPort.Desc] = newPort
 		}
 		if device.Attrs == nil {
 			device.Attrs = map[string]string{}
@@ -217,6 +626,7 @@ func loadConcreteGraph() {
 		newNode := &graph.ConcreteNode{Desc: dname, Ports: ports, Attrs: device.Attrs}
 		nodes = append(nodes, newNode)
 		configNodesToDevices[newNode] = device
+		inventoryNodes[dname] = newNode
 	}
 	inventory.Nodes = nodes
 	for _, link := range inventoryConfig.Links {
@@ -226,29 +636,134 @@ func loadConcreteGraph() {
 }
 
 func reserve(c *gin.Context) {
-	testbedData := InputData{}
-	if err := c.BindJSON(&testbedData); err != nil {
+	request := ReserveRequest{}
+	if err := c.BindJSON(&request); err != nil {
+		reservationRequests.inc("invalid")
+		return
+	}
+	testbedData := request.InputData
+	if request.Template != "" {
+		if len(testbedData.Devices) > 0 || len(testbedData.Links) > 0 || len(testbedData.LinkGroups) > 0 ||
+			len(testbedData.DeviceGroups) > 0 {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "a request gives either a template or a topology, not both"})
+			reservationRequests.inc("invalid")
+			return
+		}
+		t, ok := templates.get(request.Template, request.Version)
+		if !ok {
+			msg := fmt.Sprintf("template %q not found", request.Template)
+			if request.Version != 0 {
+				msg = fmt.Sprintf("template %q has no version %d", request.Template, request.Version)
+			}
+			c.IndentedJSON(http.StatusNotFound, gin.H{"error": msg})
+			reservationRequests.inc("invalid")
+			return
+		}
+		var err error
+		if testbedData, err = t.Expand(request.Params); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			reservationRequests.inc("invalid")
+			return
+		}
+	}
+	if errs := testbedData.Validate(); len(errs) > 0 {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid topology request", "errors": errs})
+		reservationRequests.inc("invalid")
 		return
 	}
 
-	testbedConfig := ConvertData(testbedData)
+	testbedConfig, err := ConvertData(testbedData)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		reservationRequests.inc("invalid")
+		return
+	}
+	var lease time.Duration
+	if request.Duration != "" {
+		if lease, err = time.ParseDuration(request.Duration); err != nil || lease <= 0 {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("duration: %q is not a positive duration", request.Duration)})
+			reservationRequests.inc("invalid")
+			return
+		}
+	}
 
-	testbed := graph.AbstractGraph{}
-	loadAbstractGraph(testbedConfig, &testbed)
-	assignment, err := graph.Solve(context.Background(), &testbed, &inventory)
+	ctx, cancel := context.WithTimeout(c.Request.Context(), solveTimeout)
+	defer cancel()
+	r := newReservation(request, testbedConfig, auth.PrincipalOf(c))
+	r.lease = capLease(lease)
+	reserveMu.Lock()
+	defer reserveMu.Unlock()
+	start := time.Now()
+	// The request may preempt reservations of a lower priority
+	victims, solution, snapshot, err := solveReservation(ctx, r, true, !request.DryRun)
+	var assignment *graph.Assignment
+	var quotaErr error
+	if err == nil {
+		assignment = snapshot.translate(solution.assignment)
+		devices, ports := assignedResources(assignment)
+		inventoryMu.RLock()
+		quotaErr = checkQuota(r, devices, ports)
+		inventoryMu.RUnlock()
+	}
+	if request.Wait && !request.DryRun && ctx.Err() == nil && (err != nil || quotaErr != nil) {
+		observeOutcome("queued", start)
+		enqueue(r)
+		c.IndentedJSON(http.StatusAccepted, gin.H{"reservation_id": r.ID, "status": statusQueued})
+		return
+	}
 	if err != nil {
+		switch {
+		case c.Request.Context().Err() != nil:
+			observeOutcome("canceled", start)
+			log.Printf("Reservation request canceled by the client: %v", c.Request.Context().Err())
+			c.Abort()
+		case ctx.Err() == context.DeadlineExceeded:
+			observeOutcome("timeout", start)
+			c.IndentedJSON(http.StatusGatewayTimeout, gin.H{"code": "SOLVE_TIMEOUT", "error": fmt.Sprintf("no assignment found within %v", solveTimeout)})
+		default:
+			observeOutcome("unsatisfiable", start)
+			c.IndentedJSON(http.StatusConflict, gin.H{"code": "NO_ASSIGNMENT", "error": solveErrorMessage(err)})
+		}
 		return
 	}
+	if quotaErr != nil {
+		observeOutcome("over_quota", start)
+		c.IndentedJSON(http.StatusForbidden, gin.H{"code": "QUOTA_EXCEEDED", "error": quotaErr.Error()})
+		return
+	}
+	if request.DryRun {
+		observeOutcome("dry_run", start)
+		inventoryMu.RLock()
+		testbed := buildTestbed(testbedConfig, solution, assignment)
+		inventoryMu.RUnlock()
+		preempts := []string{}
+		for _, victim := range victims {
+			preempts = append(preempts, victim.ID)
+		}
+		c.IndentedJSON(http.StatusOK, gin.H{"testbed": testbed, "preempts": preempts})
+		return
+	}
+	observeOutcome("ok", start)
+	testbed := commitReservation(r, solution, assignment, victims, r.Owner.Name)
+	if testbed.Status == statusPending {
+		c.IndentedJSON(http.StatusAccepted, testbed)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, testbed)
+}
+
+// buildTestbed describes the inventory devices, ports and links assigned to a
+// testbed. The caller must hold inventoryMu.
+func buildTestbed(testbedConfig Testbed, sol *solution, assignment *graph.Assignment) Testbed {
+	testbed := sol.testbed
 	devices := map[string]BDevice{}
 	for _, node := range testbed.Nodes {
 		ports := map[string]Port{}
 		for _, port := range node.Ports {
-			configPortsToPorts[assignment.Port2Port[port]].Attrs["reserved"] = "yes"
-			newPort := Port{Name: assignment.Port2Port[port].Desc, Attrs: assignment.Port2Port[port].Attrs}
+			newPort := Port{Name: assignment.Port2Port[port].Desc, Attrs: copyAttrs(assignment.Port2Port[port].Attrs)}
 			ports[port.Desc] = newPort
 		}
-		configNodesToDevices[assignment.Node2Node[node]].Attrs["reserved"] = "yes"
-		newNode := BDevice{Name: assignment.Node2Node[node].Desc, Attrs: assignment.Node2Node[node].Attrs, Ports: ports}
+		newNode := BDevice{Name: assignment.Node2Node[node].Desc, Attrs: copyAttrs(assignment.Node2Node[node].Attrs), Ports: ports}
 		devices[node.Desc] = newNode
 	}
 	links := []Link{}
@@ -256,19 +771,33 @@ func reserve(c *gin.Context) {
 		newLink := Link{Src: assignment.Port2Port[edge.Src].Desc, Dst: assignment.Port2Port[edge.Dst].Desc}
 		links = append(links, newLink)
 	}
-	content, _ := json.Marshal(Testbed{Devices: devices, Links: links})
-	err = ioutil.WriteFile("output.json", content, 0644)
-	if err != nil {
-		log.Fatal(err)
+	abstractPorts := map[string]*graph.AbstractPort{}
+	for _, node := range testbed.Nodes {
+		for _, port := range node.Ports {
+			abstractPorts[port.Desc] = port
+		}
 	}
-	utils.UpdateInventory()
-	c.IndentedJSON(http.StatusCreated, Testbed{Devices: devices, Links: links})
+	linkGroups := []LinkGroup{}
+	for _, group := range testbedConfig.LinkGroups {
+		newGroup := LinkGroup{Name: group.Name, LACP: group.LACP, Same: group.Same}
+		for _, link := range group.Links {
+			newLink := Link{Src: assignment.Port2Port[abstractPorts[link.Src]].Desc, Dst: assignment.Port2Port[abstractPorts[link.Dst]].Desc}
+			newGroup.Links = append(newGroup.Links, newLink)
+		}
+		linkGroups = append(linkGroups, newGroup)
+	}
+	return Testbed{Devices: devices, Links: links, LinkGroups: linkGroups, Cost: sol.cost, UnmetPreferences: sol.unmet}
 }
 
-func loadAbstractGraph(testbedConfig Testbed, testbed *graph.AbstractGraph) {
+// loadAbstractGraph builds the abstract graph of a testbed. Preferences are
+// added as constraints, except for those in relaxed.
+func loadAbstractGraph(testbedConfig Testbed, relaxed map[UnmetPreference]bool, testbed *graph.AbstractGraph) {
 	nodes := []*graph.AbstractNode{}
 	edges := []*graph.AbstractEdge{}
 	portPointers := map[string]*graph.AbstractPort{}
+	portConstraints := map[*graph.AbstractPort]portLeaves{}
+	nodePointers := map[string]*graph.AbstractNode{}
+	nodeConstraints := map[*graph.AbstractNode]nodeLeaves{}
 	for dname, device := range testbedConfig.Devices {
 		ports := []*graph.AbstractPort{}
 		for pid, port := range device.Ports {
@@ -276,11 +805,17 @@ func loadAbstractGraph(testbedConfig Testbed, testbed *graph.AbstractGraph) {
 				port.Attrs = map[string]string{"reserved": "no"}
 			}
 			port.Attrs["reserved"] = "no"
-			portConstraints := map[string]graph.PortConstraint{}
+			leaves := portLeaves{}
 			for aid, attribute := range port.Attrs {
-				portConstraints[aid] = graph.Equal(attribute)
+				leaves.add(aid, graph.Equal(attribute))
+			}
+			for _, pref := range port.Prefs {
+				if !relaxed[UnmetPreference{Device: dname, Port: pid, Preference: pref}] {
+					leaves.add(pref.Name, graph.Equal(pref.Value))
+				}
 			}
-			newPort := &graph.AbstractPort{Desc: (dname + ":" + pid), Constraints: portConstraints}
+			newPort := &graph.AbstractPort{Desc: (dname + ":" + pid)}
+			portConstraints[newPort] = leaves
 			ports = append(ports, newPort)
 			portPointers[dname+":"+pid] = newPort
 		}
@@ -288,11 +823,18 @@ func loadAbstractGraph(testbedConfig Testbed, testbed *graph.AbstractGraph) {
 			device.Attrs = map[string]string{}
 		}
 		device.Attrs["reserved"] = "no"
-		deviceConstraints := map[string]graph.NodeConstraint{}
+		deviceConstraints := nodeLeaves{}
 		for aid, attribute := range device.Attrs {
-			deviceConstraints[aid] = graph.Equal(attribute)
+			deviceConstraints.add(aid, graph.Equal(attribute))
 		}
-		newNode := &graph.AbstractNode{Desc: dname, Ports: ports, Constraints: deviceConstraints}
+		for _, pref := range device.Prefs {
+			if !relaxed[UnmetPreference{Device: dname, Preference: pref}] {
+				deviceConstraints.add(pref.Name, graph.Equal(pref.Value))
+			}
+		}
+		newNode := &graph.AbstractNode{Desc: dname, Ports: ports}
+		nodeConstraints[newNode] = deviceConstraints
+		nodePointers[dname] = newNode
 		nodes = append(nodes, newNode)
 	}
 	testbed.Nodes = nodes
@@ -300,29 +842,235 @@ func loadAbstractGraph(testbedConfig Testbed, testbed *graph.AbstractGraph) {
 		edges = append(edges, &graph.AbstractEdge{Src: portPointers[link.Src], Dst: portPointers[link.Dst]})
 	}
 	testbed.Edges = edges
+	// Members of a link group must match the first member on each side
+	for _, group := range testbedConfig.LinkGroups {
+		if len(group.Links) < 2 {
+			continue
+		}
+		first := group.Links[0]
+		for _, link := range group.Links[1:] {
+			for _, attr := range group.Same {
+				portConstraints[portPointers[link.Src]].add(attr, graph.SameAsPort(portPointers[first.Src]))
+				portConstraints[portPointers[link.Dst]].add(attr, graph.SameAsPort(portPointers[first.Dst]))
+			}
+		}
+	}
+	for port, leaves := range portConstraints {
+		port.Constraints = leaves.constraints()
+	}
+	// Affinity rules compare the attribute of each device with the others
+	for _, group := range testbedConfig.DeviceGroups {
+		for i, dname := range group.Devices {
+			for _, other := range group.Devices[:i] {
+				switch group.Rule {
+				case ruleSame:
+					nodeConstraints[nodePointers[dname]].add(group.Attribute, graph.SameAsNode(nodePointers[other]))
+				case ruleDifferent:
+					nodeConstraints[nodePointers[dname]].add(group.Attribute, graph.NotSameAsNode(nodePointers[other]))
+				}
+			}
+		}
+	}
+	for node, leaves := range nodeConstraints {
+		node.Constraints = leaves.constraints()
+	}
+}
+
+// portLeaves collects the leaf constraints on each attribute of an abstract
+// port, so that several constraints on the same attribute can be combined.
+type portLeaves map[string][]graph.LeafPortConstraint
+
+func (l portLeaves) add(attr string, c graph.LeafPortConstraint) {
+	l[attr] = append(l[attr], c)
+}
+
+func (l portLeaves) constraints() map[string]graph.PortConstraint {
+	constraints := map[string]graph.PortConstraint{}
+	for attr, leaves := range l {
+		if len(leaves) == 1 {
+			constraints[attr] = leaves[0]
+		} else {
+			constraints[attr] = graph.AndPort(leaves...)
+		}
+	}
+	return constraints
+}
+
+// nodeLeaves is the abstract node counterpart of portLeaves.
+type nodeLeaves map[string][]graph.LeafNodeConstraint
+
+func (l nodeLeaves) add(attr string, c graph.LeafNodeConstraint) {
+	l[attr] = append(l[attr], c)
+}
+
+func (l nodeLeaves) constraints() map[string]graph.NodeConstraint {
+	constraints := map[string]graph.NodeConstraint{}
+	for attr, leaves := range l {
+		if len(leaves) == 1 {
+			constraints[attr] = leaves[0]
+		} else {
+			constraints[attr] = graph.AndNode(leaves...)
+		}
+	}
+	return constraints
 }
 
 func main() {
-	utils.GetCreateInvFromNetbox()
-	filePath := "inventory.json"
-	jsonData, err := ioutil.ReadFile(filePath)
+	cfg, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
-		fmt.Println("Error reading file:", err)
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	cfg.report(os.Stdout)
+	solveTimeout = cfg.SolveTimeout
+	queueTTL = cfg.QueueTTL
+	maxLease = cfg.MaxLease
+	placementPolicy = cfg.Placement
+	preemptGrace = cfg.PreemptGrace
+	healthChecker = newHealthChecker(cfg)
+	healthRetries = cfg.HealthRetries
+	linkVerifier = newLinkVerifier(cfg)
+	linkRecheckAfter = cfg.LinkRecheckAfter
+	cleaner = newCleaner(cfg)
+	cleanupAlertURL = cfg.CleanupAlertURL
+	utils.Configure(utils.Config{NetboxURL: cfg.NetboxURL, NetboxToken: cfg.NetboxToken, DataDir: cfg.DataDir, Observer: observeNetbox})
+	chain, err := authenticators(cfg.TokensFile, cfg.JWT, cfg.ClientCA)
+	if err != nil {
+		fmt.Println("Error configuring authentication:", err)
 		return
 	}
-
-	// Unmarshalling JSON data into the inventoryConfig object
-	err = json.Unmarshal(jsonData, &inventoryConfig)
+	if cfg.PolicyFile != "" {
+		if policy, err = auth.LoadPolicy(cfg.PolicyFile); err != nil {
+			fmt.Println("Error loading policy:", err)
+			return
+		}
+	}
+	server := &http.Server{Addr: cfg.Listen}
+	if cfg.ClientCA != "" {
+		pem, err := ioutil.ReadFile(cfg.ClientCA)
+		if err != nil {
+			fmt.Println("Error reading client CA:", err)
+			return
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			fmt.Println("No certificate found in", cfg.ClientCA)
+			return
+		}
+		server.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	}
+	utils.GetCreateInvFromNetbox()
+	go retryNetboxStates()
+	if err := loadInventory(utils.DataPath("inventory.json")); err != nil {
+		fmt.Println(err)
+		return
+	}
+	restoreDeviceStates()
+	quotasFile := cfg.QuotasFile
+	if quotasFile == "" {
+		quotasFile = utils.DataPath("quotas.json")
+	}
+	if err := loadQuotas(quotasFile); err != nil {
+		fmt.Println("Error loading quotas:", err)
+		return
+	}
+	templates, err = newTemplateStore(utils.DataPath("templates.json"))
 	if err != nil {
-		fmt.Println("Error unmarshalling JSON:", err)
+		fmt.Println("Error loading templates:", err)
 		return
 	}
-	inventory = graph.ConcreteGraph{}
-	configNodesToDevices = map[*graph.ConcreteNode]Device{}
-	configPortsToPorts = map[*graph.ConcretePort]Interface{}
-	uploadInventory()
+	auditFile := cfg.AuditFile
+	if auditFile == "" {
+		auditFile = utils.DataPath("audit.jsonl")
+	}
+	if auditLog, err = audit.Open(auditFile); err != nil {
+		fmt.Println("Error opening audit log:", err)
+		return
+	}
+	if usageHistory, err = utilization.OpenHistory(utils.DataPath("usage_history.jsonl")); err != nil {
+		fmt.Println("Error opening usage history:", err)
+		return
+	}
+	if cfg.WebhooksFile != "" {
+		webhooks, err := events.LoadWebhooks(cfg.WebhooksFile)
+		if err != nil {
+			fmt.Println("Error loading webhooks:", err)
+			return
+		}
+		dispatcher := &events.Dispatcher{
+			Webhooks: webhooks,
+			Attempts: cfg.WebhookAttempts,
+			Backoff:  cfg.WebhookBackoff,
+			Client:   &http.Client{Timeout: 10 * time.Second},
+			OnDrop:   func(h events.Webhook, e events.Event) { webhookDrops.inc(h.URL) },
+		}
+		dispatcher.Start(eventBus)
+	}
+	go dispatchPeriodically()
 	// reserve()
 	router := gin.Default()
-	router.POST("/reserve", reserve)
-	router.Run(":8080")
+	router.GET("/metrics", metrics)
+	api := router.Group("/", auth.Middleware(chain))
+	read := auth.Require(policy, auth.PermRead)
+	api.POST("/reserve", auth.Require(policy, auth.PermReserve), reserve)
+	api.GET("/reservations", read, listReservations)
+	api.GET("/reservations/:id", read, getReservation)
+	api.DELETE("/reservations/:id", deleteReservation)
+	api.POST("/reservations/:id/renew", renewReservation)
+	api.GET("/inventory", read, listInventory)
+	api.GET("/queue", read, listQueue)
+	api.GET("/usage", read, getUsage)
+	api.POST("/inventory/refresh", auth.Require(policy, auth.PermRefresh), refreshInventory)
+	api.GET("/drains", read, listDrains)
+	api.POST("/devices/:name/drain", auth.Require(policy, auth.PermDrain), drainDevice)
+	api.POST("/devices/:name/undrain", auth.Require(policy, auth.PermDrain), undrainDevice)
+	api.GET("/health", read, listHealth)
+	api.POST("/devices/:name/unquarantine", auth.Require(policy, auth.PermDrain), unquarantineDevice)
+	api.GET("/links/bad", read, listBadLinks)
+	api.GET("/cleanup", read, listCleaning)
+	api.GET("/events", read, streamEvents)
+	api.GET("/reports", read, getReport)
+	api.GET("/reports/:table", read, getReport)
+	api.GET("/audit", auth.Require(policy, auth.PermAudit), getAudit)
+	api.DELETE("/links/bad", auth.Require(policy, auth.PermDrain), clearBadLinks)
+	api.GET("/templates", read, listTemplates)
+	api.POST("/templates", auth.Require(policy, auth.PermTemplates), createTemplate)
+	api.GET("/templates/:name", read, getTemplate)
+	api.PUT("/templates/:name", auth.Require(policy, auth.PermTemplates), updateTemplate)
+	api.DELETE("/templates/:name", auth.Require(policy, auth.PermTemplates), deleteTemplate)
+	api.GET("/templates/:name/versions", read, listTemplateVersions)
+	server.Handler = router
+	if cfg.TLSCert != "" {
+		err = server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	fmt.Println("Error serving:", err)
+}
+
+// authenticators returns the authenticators enabled by the configuration:
+// static tokens, OIDC tokens and client certificates, tried in that order.
+func authenticators(tokensFile string, jwtConfig auth.JWTConfig, clientCA string) (auth.Chain, error) {
+	chain := auth.Chain{}
+	if tokensFile != "" {
+		tokens, err := auth.LoadTokens(tokensFile)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, tokens)
+	}
+	if jwtConfig.JWKSFile != "" {
+		jwt, err := auth.NewJWT(jwtConfig)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, jwt)
+	}
+	if clientCA != "" {
+		chain = append(chain, auth.ClientCerts{})
+	}
+	return chain, nil
 }
@@ -0,0 +1,654 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"lablrs/audit"
+	"lablrs/auth"
+	"lablrs/cleanup"
+	"lablrs/events"
+	"lablrs/health"
+	"lablrs/utils"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	graph "github.com/openconfig/ondatra/binding/portgraph"
+)
+
+// Reservation states.
+const (
+	// statusActive reservations hold their devices and ports.
+	statusActive = "active"
+	// statusPending reservations preempted others and wait for them to be
+	// released before their testbed is handed out.
+	statusPending = "pending"
+	// statusPreempted reservations were preempted and keep their testbed
+	// until the end of their grace period.
+	statusPreempted = "preempted"
+	// statusQueued reservations wait for resources, or for quota, to become
+	// available.
+	statusQueued = "queued"
+	// statusReleased reservations no longer hold anything.
+	statusReleased = "released"
+)
+
+// preemptGrace is how long preempted reservations keep their testbed.
+var preemptGrace time.Duration
+
+// reservations holds every reservation by ID. It is guarded by inventoryMu.
+var reservations = map[string]*Reservation{}
+
+// netboxMu serializes the updates of device states in NetBox, which go
+// through a single output file.
+var netboxMu sync.Mutex
+
+// Reservation is a testbed handed out to a caller. Devices and Ports list the
+// inventory devices and ports it uses.
+type Reservation struct {
+	ID          string          `json:"id"`
+	Owner       *auth.Principal `json:"owner"`
+	Priority    int             `json:"priority"`
+	Status      string          `json:"status"`
+	Created     time.Time       `json:"created"`
+	User        string          `json:"user,omitempty"`
+	Team        string          `json:"team"`
+	NotifyURL   string          `json:"notify_url,omitempty"`
+	Preempts    []string        `json:"preempts,omitempty"`
+	PreemptedBy string          `json:"preempted_by,omitempty"`
+	ReleaseAt   *time.Time      `json:"release_at,omitempty"`
+	Expires     *time.Time      `json:"expires,omitempty"`
+	Started     *time.Time      `json:"started,omitempty"`
+	Released    *time.Time      `json:"released,omitempty"`
+	Devices     []string        `json:"devices"`
+	Ports       []string        `json:"ports"`
+	Testbed     Testbed         `json:"testbed"`
+
+	// request and testbedConfig are kept to solve queued reservations.
+	request       ReserveRequest
+	testbedConfig Testbed
+	// lease is how long the reservation lasts once a testbed is assigned to
+	// it, forever when zero; expiry releases it when Expires is reached.
+	lease  time.Duration
+	expiry *time.Timer
+}
+
+func newReservationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// size is the number of devices and ports a reservation holds.
+func (r *Reservation) size() int {
+	return len(r.Devices) + len(r.Ports)
+}
+
+// holds reports whether the reservation currently holds its testbed.
+func (r *Reservation) holds() bool {
+	return r.Status == statusActive || r.Status == statusPreempted
+}
+
+// claim marks the ports of a reservation, and its devices unless shareable,
+// as reserved. The caller must hold inventoryMu.
+func claim(r *Reservation) {
+	for _, name := range r.Ports {
+		if port, ok := inventoryPorts[name]; ok {
+			port.Attrs["reserved"] = "yes"
+		}
+	}
+	for _, name := range r.Devices {
+		if node, ok := inventoryNodes[name]; ok && !isShareable(node) {
+			node.Attrs["reserved"] = "yes"
+		}
+	}
+}
+
+// unclaim marks what a reservation holds as free again, except for what
+// other reservations hold or wait for, and returns the exclusive devices it
+// freed for NetBox. The caller must hold inventoryMu.
+func unclaim(r *Reservation) []string {
+	for _, name := range r.Ports {
+		if port, ok := inventoryPorts[name]; ok {
+			port.Attrs["reserved"] = "no"
+		}
+	}
+	for _, name := range r.Devices {
+		if node, ok := inventoryNodes[name]; ok && !isShareable(node) {
+			node.Attrs["reserved"] = "no"
+		}
+	}
+	for _, other := range reservations {
+		if other != r && (other.holds() || other.Status == statusPending) {
+			claim(other)
+		}
+	}
+	freed := []string{}
+	for _, name := range r.Devices {
+		// Devices in maintenance stay so in NetBox, devices being cleaned up
+		// are released once clean
+		_, dirty := cleaning[name]
+		if node, ok := inventoryNodes[name]; ok && !isShareable(node) && node.Attrs["reserved"] == "no" && !inMaintenance(name) && !dirty {
+			freed = append(freed, name)
+		}
+	}
+	return freed
+}
+
+// netboxChanges lists the device state changes to make in NetBox once
+// inventoryMu is released, and the devices to clean up.
+type netboxChanges struct {
+	released []string
+	reserved []Testbed
+	cleanup  []cleanup.Device
+}
+
+func (n netboxChanges) apply() {
+	if len(n.released) > 0 {
+		setNetboxState(n.released, utils.StateAvailable)
+	}
+	for _, testbed := range n.reserved {
+		reserveInNetbox(testbed)
+	}
+	runCleanup(n.cleanup)
+}
+
+// reserveInNetbox marks the devices of a testbed as reserved in NetBox.
+func reserveInNetbox(testbed Testbed) {
+	netboxMu.Lock()
+	defer netboxMu.Unlock()
+	content, _ := json.Marshal(testbed)
+	err := ioutil.WriteFile(utils.DataPath("output.json"), content, 0644)
+	if err != nil {
+		log.Printf("Error reserving devices in NetBox: %v", err)
+		return
+	}
+	if err := utils.UpdateInventory(); err != nil {
+		log.Printf("Error reserving devices in NetBox, will retry: %v", err)
+	}
+}
+
+// netboxRetryInterval is how often the device states NetBox failed to take
+// are set again.
+const netboxRetryInterval = time.Minute
+
+// setNetboxState sets the state of devices in NetBox. The states NetBox
+// fails to take are logged, and set again by retryNetboxStates.
+func setNetboxState(names []string, state string) {
+	if err := utils.SetDevicesState(names, state); err != nil {
+		log.Printf("Error setting device state in NetBox, will retry: %v", err)
+	}
+}
+
+// retryNetboxStates sets again, until they are taken, the device states
+// NetBox failed to take.
+func retryNetboxStates() {
+	for range time.Tick(netboxRetryInterval) {
+		if err := utils.RetryDeviceStates(); err != nil {
+			log.Printf("Error setting device state in NetBox, will retry: %v", err)
+		}
+	}
+}
+
+// releaseLocked releases a reservation and hands out the testbeds of pending
+// reservations that no longer wait for anything. The release is recorded as
+// event, events.Released or events.Expired, done by actor. The caller must
+// hold inventoryMu and apply the returned changes after releasing it.
+func releaseLocked(r *Reservation, event, actor string) netboxChanges {
+	changes := netboxChanges{}
+	if r.holds() || r.Status == statusPending {
+		if r.holds() {
+			changes.cleanup = startCleaningLocked(r)
+		}
+		changes.released = unclaim(r)
+	}
+	now := time.Now()
+	held := r.holds()
+	r.Status = statusReleased
+	r.Released = &now
+	r.ReleaseAt = nil
+	if r.expiry != nil {
+		r.expiry.Stop()
+	}
+	if held {
+		recordUsage(r)
+	}
+	var details map[string]string
+	if r.PreemptedBy != "" {
+		details = map[string]string{"preempted_by": r.PreemptedBy}
+	}
+	recordReservation(event, actor, r, details)
+	changes.reserved = activatePending()
+	return changes
+}
+
+// activatePending hands out the testbeds of the pending reservations that no
+// longer wait for the release or the cleanup of any device. The caller must
+// hold inventoryMu.
+func activatePending() []Testbed {
+	now := time.Now()
+	activated := []Testbed{}
+	for _, pending := range reservations {
+		if pending.Status != statusPending {
+			continue
+		}
+		waiting := false
+		for _, id := range pending.Preempts {
+			if reservations[id].Status != statusReleased {
+				waiting = true
+			}
+		}
+		for _, name := range pending.Devices {
+			if _, ok := cleaning[name]; ok {
+				waiting = true
+			}
+		}
+		if !waiting {
+			claim(pending)
+			pending.Status = statusActive
+			pending.Started = &now
+			pending.Testbed.Status = statusActive
+			activated = append(activated, pending.Testbed)
+			recordReservation(events.Reserved, audit.System, pending, nil)
+		}
+	}
+	return activated
+}
+
+// releaseReservation releases the reservation with the given ID, if it is
+// not released yet, and records the release as event done by actor.
+func releaseReservation(id, event, actor string) (*Reservation, bool) {
+	inventoryMu.Lock()
+	r, ok := reservations[id]
+	if !ok || r.Status == statusReleased {
+		inventoryMu.Unlock()
+		return r, false
+	}
+	changes := releaseLocked(r, event, actor)
+	inventoryMu.Unlock()
+	changes.apply()
+	go dispatchQueue()
+	return r, true
+}
+
+// preemptionCandidates lists the active reservations with a priority below
+// priority, in the order they are preferably preempted: lowest priority
+// first, then smallest, then most recent. The caller must hold inventoryMu.
+func preemptionCandidates(priority int) []*Reservation {
+	candidates := []*Reservation{}
+	for _, r := range reservations {
+		if r.Status == statusActive && r.Priority < priority {
+			candidates = append(candidates, r)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		if a.size() != b.size() {
+			return a.size() < b.size()
+		}
+		return a.Created.After(b.Created)
+	})
+	return candidates
+}
+
+// ownerView returns a snapshot of the inventory without the drained,
+// unhealthy or uncleaned devices and ports, the ports of bad links, nor the
+// devices and ports of the pools the owner may not use.
+func ownerView(owner *auth.Principal) *inventoryView {
+	inventoryMu.RLock()
+	defer inventoryMu.RUnlock()
+	excludedNodes, excludedPorts := ownerExclusions(owner)
+	return newInventoryView(&inventory, excludedNodes, excludedPorts)
+}
+
+// ownerExclusions returns the devices and ports left out of the views of an
+// owner. The caller must hold inventoryMu.
+func ownerExclusions(owner *auth.Principal) (map[*graph.ConcreteNode]bool, map[*graph.ConcretePort]bool) {
+	excludedNodes := map[*graph.ConcreteNode]bool{}
+	excludedPorts := map[*graph.ConcretePort]bool{}
+	for _, pool := range policy.DeniedPools(owner) {
+		for _, node := range inventory.Nodes {
+			if !pool.HasDevice(node.Attrs) {
+				continue
+			}
+			if pool.WholeDevice() {
+				excludedNodes[node] = true
+				continue
+			}
+			for _, port := range node.Ports {
+				if pool.HasPort(port.Attrs) {
+					excludedPorts[port] = true
+				}
+			}
+		}
+	}
+	drainExclusions(excludedNodes, excludedPorts)
+	linkExclusions(excludedPorts)
+	cleaningExclusions(excludedNodes)
+	for _, node := range inventory.Nodes {
+		if healthChecker.Unhealthy(node.Desc) {
+			excludedNodes[node] = true
+		}
+	}
+	return excludedNodes, excludedPorts
+}
+
+// assignmentAvailable reports whether the devices and ports of an assignment
+// solved on an earlier view of the owner are still free and usable by it.
+// The caller must hold inventoryMu.
+func assignmentAvailable(owner *auth.Principal, a *graph.Assignment) bool {
+	excludedNodes, excludedPorts := ownerExclusions(owner)
+	for _, node := range a.Node2Node {
+		if excludedNodes[node] || (!isShareable(node) && node.Attrs["reserved"] == "yes") {
+			return false
+		}
+	}
+	for _, port := range a.Port2Port {
+		if excludedPorts[port] || port.Attrs["reserved"] == "yes" {
+			return false
+		}
+	}
+	return true
+}
+
+// solveWithout solves the testbed of a reservation on a snapshot of the
+// inventory it may use, in which the given reservations are released.
+func solveWithout(ctx context.Context, r *Reservation, victims []*Reservation) (*solution, *inventoryView, error) {
+	snapshot := ownerView(r.Owner)
+	freedPorts := map[string]bool{}
+	freedNodes := map[string]bool{}
+	for _, r := range victims {
+		for _, name := range r.Ports {
+			freedPorts[name] = true
+		}
+		for _, name := range r.Devices {
+			freedNodes[name] = true
+		}
+	}
+	for viewNode := range snapshot.nodes {
+		if freedNodes[viewNode.Desc] && !isShareable(viewNode) {
+			viewNode.Attrs["reserved"] = "no"
+		}
+	}
+	for viewPort := range snapshot.ports {
+		if freedPorts[viewPort.Desc] {
+			viewPort.Attrs["reserved"] = "no"
+		}
+	}
+	sol, err := solveTestbed(ctx, r.testbedConfig, &snapshot.graph)
+	return sol, snapshot, err
+}
+
+// solveReservation finds a testbed for a reservation, preempting reservations
+// of a lower priority when allowed and needed. With probe, the assigned
+// devices are health checked and the assigned links verified against LLDP;
+// when some fail, the testbed is solved again without them. Dry runs do not
+// probe, leaving the health of devices and links as it is.
+func solveReservation(ctx context.Context, r *Reservation, preempt, probe bool) ([]*Reservation, *solution, *inventoryView, error) {
+	for attempt := 0; ; attempt++ {
+		victims := []*Reservation{}
+		sol, snapshot, err := solveWithout(ctx, r, nil)
+		if err != nil && preempt && ctx.Err() == nil {
+			var preemptErr error
+			if victims, sol, snapshot, preemptErr = planPreemption(ctx, r); preemptErr == nil {
+				err = nil
+			}
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !probe {
+			return victims, sol, snapshot, nil
+		}
+		assignment := snapshot.translate(sol.assignment)
+		devices, _ := assignedResources(assignment)
+		failed := checkHealth(ctx, devices)
+		problem := "devices failed health checks"
+		if len(failed) == 0 {
+			failed = verifyLinks(ctx, assignedLinks(sol.testbed, assignment))
+			problem = "links are not cabled as in the inventory"
+		}
+		if len(failed) == 0 {
+			return victims, sol, snapshot, nil
+		}
+		log.Printf("Reservation %s: assigned %s: %s", r.ID, problem, health.Summary(failed))
+		if attempt >= healthRetries {
+			return nil, nil, nil, fmt.Errorf("assigned %s: %s", problem, health.Summary(failed))
+		}
+	}
+}
+
+// planPreemption looks for a cheap set of reservations with a priority below
+// that of r whose release makes its testbed satisfiable. Candidates are added
+// in preemptionCandidates order until the testbed can be solved, then every
+// victim the solution does not need is spared again.
+func planPreemption(ctx context.Context, r *Reservation) ([]*Reservation, *solution, *inventoryView, error) {
+	inventoryMu.RLock()
+	candidates := preemptionCandidates(r.Priority)
+	inventoryMu.RUnlock()
+	victims := []*Reservation{}
+	for _, candidate := range candidates {
+		victims = append(victims, candidate)
+		sol, snapshot, err := solveWithout(ctx, r, victims)
+		if ctx.Err() != nil {
+			return nil, nil, nil, ctx.Err()
+		}
+		if err != nil {
+			continue
+		}
+		// The last victim added was needed; the earlier ones may not be.
+		for i := len(victims) - 2; i >= 0 && ctx.Err() == nil; i-- {
+			spared := append(append([]*Reservation{}, victims[:i]...), victims[i+1:]...)
+			if s, v, err := solveWithout(ctx, r, spared); err == nil {
+				victims, sol, snapshot = spared, s, v
+			}
+		}
+		return victims, sol, snapshot, nil
+	}
+	return nil, nil, nil, fmt.Errorf("no set of lower priority reservations frees enough resources")
+}
+
+// notifyClient posts preemption notices. Its timeout keeps notification URLs
+// that do not answer from holding a goroutine forever.
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// notifyPreempted tells the owner of a preempted reservation, through its
+// notification URL, when it loses its testbed.
+func notifyPreempted(r Reservation) {
+	if r.NotifyURL == "" {
+		return
+	}
+	go func() {
+		content, _ := json.Marshal(gin.H{
+			"event":        "preempted",
+			"reservation":  r.ID,
+			"preempted_by": r.PreemptedBy,
+			"release_at":   r.ReleaseAt,
+		})
+		resp, err := notifyClient.Post(r.NotifyURL, "application/json", bytes.NewBuffer(content))
+		if err != nil {
+			log.Printf("Error notifying reservation %s of preemption: %v", r.ID, err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
+
+// newReservation returns a reservation for a request, not yet recorded.
+// Authenticated callers own their reservations, and reserve as themselves and
+// for their team, the unassigned team if they have none, whatever the request
+// says.
+func newReservation(request ReserveRequest, testbedConfig Testbed, owner *auth.Principal) *Reservation {
+	if owner != auth.Anonymous {
+		request.User = owner.Name
+		request.Team = owner.Team
+	}
+	return &Reservation{
+		ID:            newReservationID(),
+		Owner:         owner,
+		Priority:      request.Priority,
+		User:          request.User,
+		Team:          teamOf(request.Team),
+		Created:       time.Now(),
+		NotifyURL:     request.NotifyURL,
+		request:       request,
+		testbedConfig: testbedConfig,
+	}
+}
+
+// assignedResources lists the inventory devices and ports of an assignment.
+func assignedResources(assignment *graph.Assignment) ([]string, []string) {
+	devices := []string{}
+	ports := []string{}
+	for _, node := range assignment.Node2Node {
+		devices = append(devices, node.Desc)
+	}
+	for _, port := range assignment.Port2Port {
+		ports = append(ports, port.Desc)
+	}
+	sort.Strings(devices)
+	sort.Strings(ports)
+	return devices, ports
+}
+
+// commitReservation hands a solved testbed to a reservation and records it.
+// Victims are preempted: released at once without a grace period, otherwise
+// left their testbed until the grace period ends while the reservation waits.
+// The reservation is recorded as made by actor.
+func commitReservation(r *Reservation, sol *solution, assignment *graph.Assignment, victims []*Reservation, actor string) Testbed {
+	now := time.Now()
+	inventoryMu.Lock()
+	r.Devices, r.Ports = assignedResources(assignment)
+	r.Status = statusActive
+	changes := netboxChanges{}
+	notify := []Reservation{}
+	for _, victim := range victims {
+		victim.PreemptedBy = r.ID
+		if preemptGrace == 0 {
+			recordReservation(events.Preempted, actor, victim, map[string]string{"preempted_by": r.ID})
+			victimChanges := releaseLocked(victim, events.Released, audit.System)
+			changes.released = append(changes.released, victimChanges.released...)
+			changes.reserved = append(changes.reserved, victimChanges.reserved...)
+			changes.cleanup = append(changes.cleanup, victimChanges.cleanup...)
+		} else {
+			releaseAt := now.Add(preemptGrace)
+			victim.Status = statusPreempted
+			victim.ReleaseAt = &releaseAt
+			r.Preempts = append(r.Preempts, victim.ID)
+			r.Status = statusPending
+			id := victim.ID
+			time.AfterFunc(preemptGrace, func() { releaseReservation(id, events.Released, audit.System) })
+			recordReservation(events.Preempted, actor, victim, map[string]string{"preempted_by": r.ID, "release_at": releaseAt.Format(time.RFC3339)})
+		}
+		notify = append(notify, *victim)
+	}
+	// The devices of released victims may have to be cleaned up first
+	for _, name := range r.Devices {
+		if _, ok := cleaning[name]; ok {
+			r.Status = statusPending
+		}
+	}
+	if r.Status == statusActive {
+		r.Started = &now
+	}
+	if r.lease > 0 {
+		extendLease(r, now.Add(r.lease))
+	}
+	claim(r)
+	r.Testbed = buildTestbed(r.testbedConfig, sol, assignment)
+	r.Testbed.ReservationID = r.ID
+	r.Testbed.Status = r.Status
+	reservations[r.ID] = r
+	if r.Status == statusActive {
+		changes.reserved = append(changes.reserved, r.Testbed)
+		recordReservation(events.Reserved, actor, r, nil)
+	} else {
+		recordReservation(events.Pending, actor, r, nil)
+	}
+	testbed := r.Testbed
+	inventoryMu.Unlock()
+
+	for _, victim := range notify {
+		notifyPreempted(victim)
+	}
+	changes.apply()
+	return testbed
+}
+
+func listReservations(c *gin.Context) {
+	inventoryMu.RLock()
+	list := []Reservation{}
+	for _, r := range reservations {
+		if status := c.Query("status"); status == "" || status == r.Status {
+			list = append(list, *r)
+		}
+	}
+	inventoryMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	c.IndentedJSON(http.StatusOK, list)
+}
+
+func getReservation(c *gin.Context) {
+	inventoryMu.RLock()
+	r, ok := reservations[c.Param("id")]
+	var copied Reservation
+	if ok {
+		copied = *r
+	}
+	inventoryMu.RUnlock()
+	if !ok {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("reservation %q not found", c.Param("id"))})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, copied)
+}
+
+// releasePermissions lists the permissions allowing a principal to release a
+// reservation. The caller must hold inventoryMu.
+func releasePermissions(principal *auth.Principal, r *Reservation) []string {
+	switch {
+	case r.Owner != nil && r.Owner.Name == principal.Name:
+		return []string{auth.PermReleaseOwn, auth.PermReleaseTeam, auth.PermReleaseAny}
+	case principal.Team != "" && r.Team == principal.Team:
+		return []string{auth.PermReleaseTeam, auth.PermReleaseAny}
+	}
+	return []string{auth.PermReleaseAny}
+}
+
+func deleteReservation(c *gin.Context) {
+	principal := auth.PrincipalOf(c)
+	inventoryMu.RLock()
+	r, ok := reservations[c.Param("id")]
+	allowed := ok && policy.Allowed(principal, releasePermissions(principal, r)...)
+	inventoryMu.RUnlock()
+	if ok && !allowed {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%q is not allowed to release reservation %q", principal.Name, r.ID)})
+		return
+	}
+	r, released := releaseReservation(c.Param("id"), events.Released, principal.Name)
+	if r == nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("reservation %q not found", c.Param("id"))})
+		return
+	}
+	if !released {
+		c.IndentedJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("reservation %q is already released", r.ID)})
+		return
+	}
+	inventoryMu.RLock()
+	copied := *r
+	inventoryMu.RUnlock()
+	c.IndentedJSON(http.StatusOK, copied)
+}
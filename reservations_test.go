@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"lablrs/audit"
+	"lablrs/auth"
+	"lablrs/events"
+	"lablrs/utils"
+)
+
+func TestNewReservationTakesOwnerFromPrincipal(t *testing.T) {
+	request := ReserveRequest{User: "bob", Team: "other"}
+	for _, tc := range []struct {
+		principal *auth.Principal
+		user      string
+		team      string
+	}{
+		{&auth.Principal{Name: "alice", Team: "core", Method: "token"}, "alice", "core"},
+		// A principal without a team cannot charge another team.
+		{&auth.Principal{Name: "alice", Method: "token"}, "alice", unassignedTeam},
+		// Without authentication the request says who it is for.
+		{auth.Anonymous, "bob", "other"},
+	} {
+		r := newReservation(request, Testbed{}, tc.principal)
+		if r.User != tc.user || r.Team != tc.team {
+			t.Errorf("reservation of %s is for %s of %s, want %s of %s", tc.principal.Name, r.User, r.Team, tc.user, tc.team)
+		}
+	}
+}
+
+func TestShareableDevicesLendTheirFreePorts(t *testing.T) {
+	useInventory(t, `{"devices": {
+		"shared": {"attributes": {"sharing": "port-shareable"}, "interfaces": [{"name": "e0"}, {"name": "e1"}]},
+		"excl": {"attributes": {}, "interfaces": [{"name": "e0"}, {"name": "e1"}]}
+	}, "links": []}`)
+	r1 := useReservation(t, "r1")
+	inventoryMu.Lock()
+	r1.Devices, r1.Ports = []string{"excl", "shared"}, []string{"excl:e0", "shared:e0"}
+	claim(r1)
+	inventoryMu.Unlock()
+
+	request := InputData{Devices: []InputDevice{{Name: "dut", Interfaces: []InputInterface{{Name: "p"}}}}}
+	_, devices, ports := solveRequest(t, request)
+	if fmt.Sprint(devices) != "[shared]" || fmt.Sprint(ports) != "[shared:e1]" {
+		t.Fatalf("assigned %v %v, want the free port shared:e1 of the device r1 shares", devices, ports)
+	}
+
+	inventoryMu.Lock()
+	r2 := &Reservation{ID: "r2", Status: statusActive, Devices: devices, Ports: ports}
+	reservations[r2.ID] = r2
+	claim(r2)
+	changes := releaseLocked(r1, events.Released, audit.System)
+	free := inventoryPorts["shared:e0"].Attrs["reserved"] == "no" && inventoryPorts["shared:e1"].Attrs["reserved"] == "yes"
+	inventoryMu.Unlock()
+	if fmt.Sprint(changes.released) != "[excl]" {
+		t.Errorf("releasing r1 frees %v in NetBox, want [excl]: shared stays available", changes.released)
+	}
+	if !free {
+		t.Error("releasing r1 did not free shared:e0 only")
+	}
+}
+
+// useNetbox points the NetBox client to a fake NetBox for the duration of a
+// test, and returns a function listing the device states set in it.
+func useNetbox(t *testing.T) func() map[string]string {
+	var mu sync.Mutex
+	states := map[string]string{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			name := r.URL.Query().Get("name")
+			fmt.Fprintf(w, `{"results": [{"name": %q, "url": %q, "device_type": {"id": 1}}]}`, name, server.URL+"/dcim/devices/"+name+"/")
+		case http.MethodPatch:
+			var update struct {
+				CustomFields struct {
+					State string
+				} `json:"custom_fields"`
+			}
+			json.NewDecoder(r.Body).Decode(&update)
+			mu.Lock()
+			states[path.Base(r.URL.Path)] = update.CustomFields.State
+			mu.Unlock()
+		}
+	}))
+	utils.Configure(utils.Config{NetboxURL: server.URL, DataDir: t.TempDir()})
+	t.Cleanup(func() {
+		server.Close()
+		utils.Configure(utils.Config{DataDir: "."})
+	})
+	return func() map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		copied := map[string]string{}
+		for name, state := range states {
+			copied[name] = state
+		}
+		return copied
+	}
+}
+
+func TestPreemptionWithGracePeriod(t *testing.T) {
+	useInventory(t, twoDUTs)
+	netboxStates := useNetbox(t)
+	log, err := audit.Open(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedLog, savedGrace := auditLog, preemptGrace
+	auditLog, preemptGrace = log, 50*time.Millisecond
+	t.Cleanup(func() { auditLog, preemptGrace = savedLog, savedGrace })
+	notified := make(chan string, 1)
+	notify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notice struct {
+			Event       string `json:"event"`
+			PreemptedBy string `json:"preempted_by"`
+		}
+		json.NewDecoder(r.Body).Decode(&notice)
+		notified <- notice.Event + " by " + notice.PreemptedBy
+	}))
+	defer notify.Close()
+
+	low := useReservation(t, "low")
+	inventoryMu.Lock()
+	low.Owner, low.NotifyURL = &auth.Principal{Name: "alice"}, notify.URL
+	low.Devices, low.Ports = []string{"d1"}, []string{"d1:e0"}
+	mid := &Reservation{ID: "mid", Owner: &auth.Principal{Name: "bob"}, Priority: 1, Status: statusActive, Devices: []string{"d2"}, Ports: []string{"d2:e0"}}
+	reservations[mid.ID] = mid
+	claim(low)
+	claim(mid)
+	inventoryMu.Unlock()
+
+	high := oneDUTReservation(t)
+	high.Priority = 2
+	victims, sol, snapshot, err := solveReservation(context.Background(), high, true, false)
+	if err != nil {
+		t.Fatalf("solveReservation() error: %v", err)
+	}
+	if len(victims) != 1 || victims[0] != low {
+		t.Fatalf("preempts %d reservations, want only low, of the lowest priority", len(victims))
+	}
+	commitReservation(high, sol, snapshot.translate(sol.assignment), victims, "carol")
+	if status := statusOf(low); status != statusPreempted {
+		t.Errorf("low is %s, want %s during its grace period", status, statusPreempted)
+	}
+	if status := statusOf(high); status != statusPending {
+		t.Errorf("high is %s, want %s during the grace period of low", status, statusPending)
+	}
+	select {
+	case notice := <-notified:
+		if want := "preempted by " + high.ID; notice != want {
+			t.Errorf("notified %q, want %q", notice, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the owner of low was not notified")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for statusOf(high) != statusActive || netboxStates()["d1"] != utils.StateReserved {
+		if time.Now().After(deadline) {
+			t.Fatalf("high is %s with d1 %q in NetBox after the grace period, want active with d1 reserved", statusOf(high), netboxStates()["d1"])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := statusOf(low); status != statusReleased {
+		t.Errorf("low is %s after its grace period, want %s", status, statusReleased)
+	}
+	actions := []string{}
+	log.Scan(audit.Filter{Reservation: "low"}, func(e audit.Entry) bool {
+		actions = append(actions, e.Action+" by "+e.Actor)
+		return true
+	})
+	if want := "[preempted by carol force_released by system]"; fmt.Sprint(actions) != want {
+		t.Errorf("audit log of low: %v, want %s", actions, want)
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	graph "github.com/openconfig/ondatra/binding/portgraph"
+)
+
+// Placement policies, selecting how devices are chosen among those that fit.
+const (
+	// placementFirstFit takes the cheapest assignment regardless of how it
+	// leaves the remaining ports.
+	placementFirstFit = "first-fit"
+	// placementPack also counts, as cost, every free port an assignment
+	// leaves behind on the devices it uses. This favors small or already
+	// partially used devices and keeps large ones whole for big topologies.
+	placementPack = "pack"
+)
+
+var placementPolicy = placementFirstFit
+
+// maxCostSearchSolves bounds how many extra solves are spent looking for a
+// cheaper assignment than the first one found.
+const maxCostSearchSolves = 20
+
+// defaultPortCosts is the cost of a port without a "cost" attribute, by speed.
+// Ports of other speeds cost 1.
+var defaultPortCosts = map[string]float64{
+	"speed_400_gbps": 4,
+	"speed_200_gbps": 2,
+	"speed_100_gbps": 1,
+}
+
+// nodeCost returns the cost of reserving a device, taken from its "cost"
+// attribute. Devices without one cost 1.
+func nodeCost(n *graph.ConcreteNode) float64 {
+	if cost, err := strconv.ParseFloat(n.Attrs["cost"], 64); err == nil {
+		return cost
+	}
+	return 1
+}
+
+// portCost returns the cost of reserving a port, taken from its "cost"
+// attribute or else from its speed.
+func portCost(p *graph.ConcretePort) float64 {
+	if cost, err := strconv.ParseFloat(p.Attrs["cost"], 64); err == nil {
+		return cost
+	}
+	if cost, ok := defaultPortCosts[p.Attrs["speed"]]; ok {
+		return cost
+	}
+	return 1
+}
+
+// leftoverPorts returns how many free ports of n an assignment leaves
+// unused.
+func leftoverPorts(n *graph.ConcreteNode, a *graph.Assignment) int {
+	assigned := map[*graph.ConcretePort]bool{}
+	for _, p := range a.Port2Port {
+		assigned[p] = true
+	}
+	leftover := 0
+	for _, p := range n.Ports {
+		if p.Attrs["reserved"] != "yes" && !assigned[p] {
+			leftover++
+		}
+	}
+	return leftover
+}
+
+// placementCost is the extra cost the placement policy puts on using n.
+func placementCost(n *graph.ConcreteNode, a *graph.Assignment) float64 {
+	if placementPolicy != placementPack {
+		return 0
+	}
+	return float64(leftoverPorts(n, a))
+}
+
+// fragmentation summarizes how the free ports of the inventory are spread.
+// Stranded ports are free ports of reserved devices: nobody can use them
+// until the reservation holding the device is released.
+type fragmentation struct {
+	freePorts       int
+	strandedPorts   int
+	freeDevices     int // devices with every port free
+	partiallyUsed   int // usable devices with some ports reserved
+	fragmentedShare float64
+}
+
+// inventoryFragmentation computes the fragmentation of the inventory. The
+// caller must hold inventoryMu.
+func inventoryFragmentation() fragmentation {
+	f := fragmentation{}
+	for _, n := range inventory.Nodes {
+		free := 0
+		for _, p := range n.Ports {
+			if p.Attrs["reserved"] != "yes" {
+				free++
+			}
+		}
+		switch {
+		case n.Attrs["reserved"] == "yes":
+			f.strandedPorts += free
+		case free == len(n.Ports):
+			f.freeDevices++
+			f.freePorts += free
+		default:
+			f.partiallyUsed++
+			f.freePorts += free
+		}
+	}
+	if total := f.freePorts + f.strandedPorts; total > 0 {
+		f.fragmentedShare = float64(f.strandedPorts) / float64(total)
+	}
+	return f
+}
+
+// assignmentCost is the total cost of the devices and ports of an assignment,
+// including the placement cost of its devices.
+func assignmentCost(a *graph.Assignment) float64 {
+	total := 0.0
+	for _, n := range a.Node2Node {
+		total += nodeCost(n) + placementCost(n, a)
+	}
+	for _, p := range a.Port2Port {
+		total += portCost(p)
+	}
+	return total
+}
+
+// inventoryView is the part of the inventory handed to the solver, without
+// the excluded devices and ports. Its nodes and ports are snapshots of the
+// inventory, so that a solve abandoned on timeout can keep running without
+// racing with later changes to the inventory attributes.
+type inventoryView struct {
+	graph graph.ConcreteGraph
+	nodes map[*graph.ConcreteNode]*graph.ConcreteNode // view node to inventory node
+	ports map[*graph.ConcretePort]*graph.ConcretePort // view port to inventory port
+}
+
+func newInventoryView(g *graph.ConcreteGraph, excludedNodes map[*graph.ConcreteNode]bool, excludedPorts map[*graph.ConcretePort]bool) *inventoryView {
+	v := &inventoryView{
+		nodes: map[*graph.ConcreteNode]*graph.ConcreteNode{},
+		ports: map[*graph.ConcretePort]*graph.ConcretePort{},
+	}
+	viewPorts := map[*graph.ConcretePort]*graph.ConcretePort{}
+	for _, node := range g.Nodes {
+		if excludedNodes[node] {
+			continue
+		}
+		ports := []*graph.ConcretePort{}
+		for _, port := range node.Ports {
+			if excludedPorts[port] {
+				continue
+			}
+			viewPort := &graph.ConcretePort{Desc: port.Desc, Attrs: copyAttrs(port.Attrs)}
+			ports = append(ports, viewPort)
+			viewPorts[port] = viewPort
+			v.ports[viewPort] = port
+		}
+		viewNode := &graph.ConcreteNode{Desc: node.Desc, Ports: ports, Attrs: copyAttrs(node.Attrs)}
+		v.graph.Nodes = append(v.graph.Nodes, viewNode)
+		v.nodes[viewNode] = node
+	}
+	for _, edge := range g.Edges {
+		src, srcOK := viewPorts[edge.Src]
+		dst, dstOK := viewPorts[edge.Dst]
+		if srcOK && dstOK {
+			v.graph.Edges = append(v.graph.Edges, &graph.ConcreteEdge{Src: src, Dst: dst})
+		}
+	}
+	return v
+}
+
+// solveErrorMessage describes a solve failure. The errors of the solver panic
+// when printed if not a single device could be assigned.
+func solveErrorMessage(err error) (msg string) {
+	defer func() {
+		if recover() != nil {
+			msg = "no device of the inventory matches the request"
+		}
+	}()
+	return err.Error()
+}
+
+func copyAttrs(attrs map[string]string) map[string]string {
+	c := make(map[string]string, len(attrs))
+	for k, v := range attrs {
+		c[k] = v
+	}
+	return c
+}
+
+// solverSlots bounds the solver runs going on at once. graph.Solve does not
+// notice a done context while it searches for device combinations, so a run
+// outlives the request that timed out; a run keeps its slot until it really
+// ends, and abandoned runs thus delay new ones instead of piling up.
+var solverSlots = make(chan struct{}, runtime.GOMAXPROCS(0))
+
+// abandonedSolves counts the solver runs still going after their request
+// stopped waiting for them.
+var abandonedSolves atomic.Int64
+
+// solve runs the solver on the view and translates the assignment back to
+// the inventory. solve returns as soon as ctx is done and leaves the solver
+// to finish in the background, holding its slot of solverSlots.
+func (v *inventoryView) solve(ctx context.Context, testbed *graph.AbstractGraph) (*graph.Assignment, error) {
+	select {
+	case solverSlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	type result struct {
+		assignment *graph.Assignment
+		err        error
+	}
+	done := make(chan result, 1)
+	var state atomic.Int32 // running, then finished or abandoned first
+	const finished, abandoned = 1, 2
+	go func() {
+		defer func() { <-solverSlots }()
+		start := time.Now()
+		assignment, err := graph.Solve(ctx, testbed, &v.graph)
+		outcome := "assigned"
+		switch {
+		case ctx.Err() != nil:
+			outcome = "timeout"
+		case err != nil:
+			outcome = "unsatisfiable"
+		}
+		graphSolveDuration.observeSince(start, outcome)
+		done <- result{assignment, err}
+		if !state.CompareAndSwap(0, finished) {
+			abandonedSolves.Add(-1)
+		}
+	}()
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		if state.CompareAndSwap(0, abandoned) {
+			abandonedSolves.Add(1)
+		}
+		return nil, ctx.Err()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return v.translate(r.assignment), nil
+}
+
+// translate maps an assignment to view nodes and ports to one of the graph
+// the view was made from.
+func (v *inventoryView) translate(a *graph.Assignment) *graph.Assignment {
+	assignment := &graph.Assignment{
+		Node2Node: map[*graph.AbstractNode]*graph.ConcreteNode{},
+		Port2Port: map[*graph.AbstractPort]*graph.ConcretePort{},
+	}
+	for abstract, node := range a.Node2Node {
+		assignment.Node2Node[abstract] = v.nodes[node]
+	}
+	for abstract, port := range a.Port2Port {
+		assignment.Port2Port[abstract] = v.ports[port]
+	}
+	return assignment
+}
+
+// solution is a testbed's abstract graph together with its assignment.
+type solution struct {
+	testbed    *graph.AbstractGraph
+	assignment *graph.Assignment
+	cost       float64
+	unmet      []UnmetPreference
+}
+
+// solveTestbed finds the cheapest assignment of a testbed it can. When the
+// testbed cannot be satisfied, its preferences are given up one at a time,
+// lowest weight first, until it can. Preferences given up on the way are then
+// taken back, highest weight first, wherever the testbed stays satisfiable.
+func solveTestbed(ctx context.Context, testbedConfig Testbed, g *graph.ConcreteGraph) (*solution, error) {
+	prefs := testbedPreferences(testbedConfig)
+	relaxed := map[UnmetPreference]bool{}
+	var best *solution
+	given := 0
+	for best == nil {
+		sol, err := solveRelaxed(ctx, testbedConfig, relaxed, g)
+		if err == nil {
+			best = sol
+			break
+		}
+		if given == len(prefs) || ctx.Err() != nil {
+			return nil, err
+		}
+		relaxed[prefs[given]] = true
+		given++
+	}
+
+	// The last preference given up was needed; the earlier ones may not be.
+	for j := given - 2; j >= 0 && ctx.Err() == nil; j-- {
+		delete(relaxed, prefs[j])
+		sol, err := solveRelaxed(ctx, testbedConfig, relaxed, g)
+		if err != nil {
+			relaxed[prefs[j]] = true
+			continue
+		}
+		best = sol
+	}
+	best.unmet = []UnmetPreference{}
+	for _, pref := range prefs {
+		if relaxed[pref] {
+			best.unmet = append(best.unmet, pref)
+		}
+	}
+	return best, nil
+}
+
+func solveRelaxed(ctx context.Context, testbedConfig Testbed, relaxed map[UnmetPreference]bool, g *graph.ConcreteGraph) (*solution, error) {
+	testbed := &graph.AbstractGraph{Desc: testbedConfig.Desc}
+	loadAbstractGraph(testbedConfig, relaxed, testbed)
+	assignment, cost, err := solveCheapest(ctx, testbed, g)
+	if err != nil {
+		return nil, err
+	}
+	return &solution{testbed: testbed, assignment: assignment, cost: cost}, nil
+}
+
+// testbedPreferences lists the preferences of a testbed in the order they are
+// given up: lowest weight first.
+func testbedPreferences(testbedConfig Testbed) []UnmetPreference {
+	prefs := []UnmetPreference{}
+	for dname, device := range testbedConfig.Devices {
+		for _, pref := range device.Prefs {
+			prefs = append(prefs, UnmetPreference{Device: dname, Preference: pref})
+		}
+		for pid, port := range device.Ports {
+			for _, pref := range port.Prefs {
+				prefs = append(prefs, UnmetPreference{Device: dname, Port: pid, Preference: pref})
+			}
+		}
+	}
+	sort.Slice(prefs, func(i, j int) bool {
+		a, b := prefs[i], prefs[j]
+		if a.Weight != b.Weight {
+			return a.Weight < b.Weight
+		}
+		if a.Device != b.Device {
+			return a.Device < b.Device
+		}
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		return a.Name < b.Name
+	})
+	return prefs
+}
+
+// solveCheapest finds an assignment of testbed in the inventory and then
+// searches for a cheaper one: it repeatedly excludes the most expensive device
+// or port the last assignment found can do without and solves again, keeping
+// the cheapest assignment seen. Exclusions add up, so the search goes on past
+// assignments costlier than the best one. It stops when nothing more can be
+// excluded, after maxCostSearchSolves extra solves, or when ctx is done.
+func solveCheapest(ctx context.Context, testbed *graph.AbstractGraph, g *graph.ConcreteGraph) (*graph.Assignment, float64, error) {
+	excludedNodes := map[*graph.ConcreteNode]bool{}
+	excludedPorts := map[*graph.ConcretePort]bool{}
+	current, err := newInventoryView(g, excludedNodes, excludedPorts).solve(ctx, testbed)
+	if err != nil {
+		return nil, 0, err
+	}
+	best, bestCost := current, assignmentCost(current)
+
+	// needed holds the elements without which the testbed cannot be solved
+	// any more; exclusions only grow, so they stay needed.
+	needed := map[interface{}]bool{}
+	solves := 0
+	for solves < maxCostSearchSolves && ctx.Err() == nil {
+		moved := false
+		for _, candidate := range costCandidates(current) {
+			if needed[candidate.element] || solves >= maxCostSearchSolves || ctx.Err() != nil {
+				continue
+			}
+			solves++
+			nodes, ports := copyExclusions(excludedNodes, excludedPorts)
+			switch e := candidate.element.(type) {
+			case *graph.ConcreteNode:
+				nodes[e] = true
+			case *graph.ConcretePort:
+				ports[e] = true
+			}
+			assignment, err := newInventoryView(g, nodes, ports).solve(ctx, testbed)
+			if err != nil {
+				needed[candidate.element] = true
+				continue
+			}
+			current, excludedNodes, excludedPorts = assignment, nodes, ports
+			if cost := assignmentCost(assignment); cost < bestCost {
+				best, bestCost = assignment, cost
+			}
+			moved = true
+			break
+		}
+		if !moved {
+			break
+		}
+	}
+	return best, bestCost, nil
+}
+
+type costCandidate struct {
+	element interface{} // *graph.ConcreteNode or *graph.ConcretePort
+	desc    string
+	cost    float64
+}
+
+// costCandidates lists the devices and ports of an assignment, most
+// expensive first.
+func costCandidates(a *graph.Assignment) []costCandidate {
+	candidates := []costCandidate{}
+	for _, n := range a.Node2Node {
+		candidates = append(candidates, costCandidate{n, n.Desc, nodeCost(n) + placementCost(n, a)})
+	}
+	for _, p := range a.Port2Port {
+		candidates = append(candidates, costCandidate{p, p.Desc, portCost(p)})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].cost == candidates[j].cost {
+			return candidates[i].desc < candidates[j].desc
+		}
+		return candidates[i].cost > candidates[j].cost
+	})
+	return candidates
+}
+
+func copyExclusions(nodes map[*graph.ConcreteNode]bool, ports map[*graph.ConcretePort]bool) (map[*graph.ConcreteNode]bool, map[*graph.ConcretePort]bool) {
+	newNodes := map[*graph.ConcreteNode]bool{}
+	for n := range nodes {
+		newNodes[n] = true
+	}
+	newPorts := map[*graph.ConcretePort]bool{}
+	for p := range ports {
+		newPorts[p] = true
+	}
+	return newNodes, newPorts
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	graph "github.com/openconfig/ondatra/binding/portgraph"
+)
+
+// hardGraphs returns a request for a ring of an odd number of devices and an
+// inventory wired as a complete bipartite graph. The inventory has no odd
+// cycle, so the request is unsatisfiable, but the solver only finds out
+// after trying a great many device combinations, without checking its
+// context: a ring of 7 in 9+9 devices takes it seconds.
+func hardGraphs(ring, side int) (*graph.AbstractGraph, *graph.ConcreteGraph) {
+	abstract := &graph.AbstractGraph{Desc: "ring"}
+	nodes := make([]*graph.AbstractNode, ring)
+	for i := range nodes {
+		nodes[i] = &graph.AbstractNode{Desc: fmt.Sprintf("dut%d", i)}
+		abstract.Nodes = append(abstract.Nodes, nodes[i])
+	}
+	for i := range nodes {
+		j := (i + 1) % ring
+		src := &graph.AbstractPort{Desc: fmt.Sprintf("dut%d:next", i)}
+		dst := &graph.AbstractPort{Desc: fmt.Sprintf("dut%d:prev", j)}
+		nodes[i].Ports = append(nodes[i].Ports, src)
+		nodes[j].Ports = append(nodes[j].Ports, dst)
+		abstract.Edges = append(abstract.Edges, &graph.AbstractEdge{Src: src, Dst: dst})
+	}
+
+	concrete := &graph.ConcreteGraph{Desc: "bipartite"}
+	left := make([]*graph.ConcreteNode, side)
+	right := make([]*graph.ConcreteNode, side)
+	for i := 0; i < side; i++ {
+		left[i] = &graph.ConcreteNode{Desc: fmt.Sprintf("l%d", i), Attrs: map[string]string{}}
+		right[i] = &graph.ConcreteNode{Desc: fmt.Sprintf("r%d", i), Attrs: map[string]string{}}
+		concrete.Nodes = append(concrete.Nodes, left[i], right[i])
+	}
+	for i, l := range left {
+		for j, r := range right {
+			src := &graph.ConcretePort{Desc: fmt.Sprintf("l%d:%d", i, j), Attrs: map[string]string{}}
+			dst := &graph.ConcretePort{Desc: fmt.Sprintf("r%d:%d", j, i), Attrs: map[string]string{}}
+			l.Ports = append(l.Ports, src)
+			r.Ports = append(r.Ports, dst)
+			concrete.Edges = append(concrete.Edges, &graph.ConcreteEdge{Src: src, Dst: dst})
+		}
+	}
+	return abstract, concrete
+}
+
+func graphSolves(result string) uint64 {
+	graphSolveDuration.mu.Lock()
+	defer graphSolveDuration.mu.Unlock()
+	if s, ok := graphSolveDuration.series[seriesKey([]string{result})]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func TestSolveTimeout(t *testing.T) {
+	abstract, concrete := hardGraphs(7, 9)
+	timeouts := graphSolves("timeout")
+
+	const timeout = 100 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	_, err := newInventoryView(concrete, nil, nil).solve(ctx, abstract)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("solve() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > timeout+time.Second {
+		t.Errorf("solve() returned after %v, want about %v", elapsed, timeout)
+	}
+
+	// The abandoned solver run ends on its own and is counted as a timeout.
+	deadline := time.Now().Add(time.Minute)
+	for graphSolves("timeout") == timeouts || abandonedSolves.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("abandoned solver run still going after a minute: %d timeouts, %d abandoned", graphSolves("timeout")-timeouts, abandonedSolves.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := len(solverSlots); got != 0 {
+		t.Errorf("%d solver slots still taken", got)
+	}
+}
+
+func TestSolveTimeoutWaitsForSlot(t *testing.T) {
+	for i := 0; i < cap(solverSlots); i++ {
+		solverSlots <- struct{}{}
+	}
+	defer func() {
+		for i := 0; i < cap(solverSlots); i++ {
+			<-solverSlots
+		}
+	}()
+	abstract, concrete := hardGraphs(3, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := newInventoryView(concrete, nil, nil).solve(ctx, abstract); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("solve() with no free solver slot: error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// solveRequest solves a request on the whole inventory and returns the
+// solution with the devices and ports it assigns.
+func solveRequest(t *testing.T, data InputData) (*solution, []string, []string) {
+	t.Helper()
+	testbedConfig, err := ConvertData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sol, err := solveTestbed(context.Background(), testbedConfig, &inventory)
+	if err != nil {
+		t.Fatalf("solveTestbed() error: %v", err)
+	}
+	devices, ports := assignedResources(sol.assignment)
+	return sol, devices, ports
+}
+
+func TestSolveTestbedTakesCheapestAssignment(t *testing.T) {
+	useInventory(t, `{"devices": {
+		"d1": {"attributes": {"cost": "3"}, "interfaces": [{"name": "e0", "attributes": {"speed": "speed_400_gbps"}}, {"name": "e1", "attributes": {"speed": "speed_100_gbps"}}]},
+		"d2": {"attributes": {"cost": "1"}, "interfaces": [{"name": "e0", "attributes": {"speed": "speed_400_gbps"}}, {"name": "e1", "attributes": {"speed": "speed_100_gbps"}}]},
+		"d3": {"attributes": {"cost": "2"}, "interfaces": [{"name": "e0", "attributes": {"speed": "speed_400_gbps"}}, {"name": "e1", "attributes": {"speed": "speed_100_gbps"}}]}
+	}, "links": []}`)
+	request := InputData{Devices: []InputDevice{{Name: "dut", Interfaces: []InputInterface{{Name: "p"}}}}}
+
+	// The solver alone may return any of the six ports.
+	for i := 0; i < 5; i++ {
+		sol, devices, ports := solveRequest(t, request)
+		if len(devices) != 1 || devices[0] != "d2" || len(ports) != 1 || ports[0] != "d2:e1" {
+			t.Fatalf("assigned %v %v, want d2:e1, the 100G port of the cheapest device", devices, ports)
+		}
+		if sol.cost != 2 {
+			t.Errorf("cost = %g, want 2", sol.cost)
+		}
+	}
+}
+
+func TestSolveTestbedRelaxesLightestPreferences(t *testing.T) {
+	useInventory(t, `{"devices": {
+		"d1": {"attributes": {"vendor": "B", "rack": "r1"}, "interfaces": [{"name": "e0"}]},
+		"d2": {"attributes": {"vendor": "A", "rack": "r2"}, "interfaces": [{"name": "e0"}]}
+	}, "links": []}`)
+	vendor := Preference{Name: "vendor", Value: "B", Weight: 1}
+	rack := Preference{Name: "rack", Value: "r2", Weight: 5}
+	for _, tc := range []struct {
+		prefs   []Preference
+		devices []string
+		unmet   []UnmetPreference
+	}{
+		// No device meets both: the lighter vendor preference is given up.
+		{[]Preference{vendor, rack}, []string{"d2"}, []UnmetPreference{{Device: "dut", Preference: vendor}}},
+		{[]Preference{vendor, {Name: "rack", Value: "r1"}}, []string{"d1"}, []UnmetPreference{}},
+		// A preference nothing meets is given up alone.
+		{[]Preference{rack, {Name: "site", Value: "s1", Weight: 9}}, []string{"d2"}, []UnmetPreference{{Device: "dut", Preference: Preference{Name: "site", Value: "s1", Weight: 9}}}},
+	} {
+		request := InputData{Devices: []InputDevice{{Name: "dut", Interfaces: []InputInterface{{Name: "p"}}, Preferences: tc.prefs}}}
+		sol, devices, _ := solveRequest(t, request)
+		if fmt.Sprint(devices) != fmt.Sprint(tc.devices) || fmt.Sprint(sol.unmet) != fmt.Sprint(tc.unmet) {
+			t.Errorf("preferences %v: assigned %v with %v unmet, want %v with %v unmet", tc.prefs, devices, sol.unmet, tc.devices, tc.unmet)
+		}
+	}
+}
+
+func TestSolveTestbedDeviceGroups(t *testing.T) {
+	useInventory(t, `{"devices": {
+		"d1": {"attributes": {"rack": "r1"}, "interfaces": [{"name": "e0"}]},
+		"d2": {"attributes": {"rack": "r2"}, "interfaces": [{"name": "e0"}]},
+		"d3": {"attributes": {"rack": "r2"}, "interfaces": [{"name": "e0"}]},
+		"d4": {"attributes": {}, "interfaces": [{"name": "e0"}]}
+	}, "links": []}`)
+	request := func(rule string) InputData {
+		return InputData{
+			Devices: []InputDevice{
+				{Name: "a", Interfaces: []InputInterface{{Name: "p"}}},
+				{Name: "b", Interfaces: []InputInterface{{Name: "p"}}},
+			},
+			DeviceGroups: []DeviceGroup{{Devices: []string{"a", "b"}, Attribute: "rack", Rule: rule}},
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if _, devices, _ := solveRequest(t, request(ruleSame)); fmt.Sprint(devices) != "[d2 d3]" {
+			t.Fatalf("same rack: assigned %v, want [d2 d3], the only two devices sharing a rack", devices)
+		}
+		// d4 has no rack, so it is in no rack different from the others.
+		_, devices, _ := solveRequest(t, request(ruleDifferent))
+		if fmt.Sprint(devices) != "[d1 d2]" && fmt.Sprint(devices) != "[d1 d3]" {
+			t.Fatalf("different racks: assigned %v, want d1 and one of d2 and d3", devices)
+		}
+	}
+}
+
+func TestSolveTestbedPacks(t *testing.T) {
+	useInventory(t, `{"devices": {
+		"big": {"attributes": {}, "interfaces": [{"name": "e0"}, {"name": "e1"}, {"name": "e2"}, {"name": "e3"}]},
+		"small": {"attributes": {}, "interfaces": [{"name": "e0"}, {"name": "e1"}]}
+	}, "links": []}`)
+	saved := placementPolicy
+	placementPolicy = placementPack
+	defer func() { placementPolicy = saved }()
+	request := InputData{Devices: []InputDevice{{Name: "dut", Interfaces: []InputInterface{{Name: "p"}}}}}
+
+	// Both devices cost the same, but big would be left with more free ports.
+	for i := 0; i < 5; i++ {
+		sol, devices, _ := solveRequest(t, request)
+		if fmt.Sprint(devices) != "[small]" {
+			t.Fatalf("assigned %v, want [small], keeping big whole", devices)
+		}
+		if sol.cost != 3 {
+			t.Errorf("cost = %g, want 3 with the free port left on small", sol.cost)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var templates *templateStore
+
+// TopologyTemplate is a named, versioned topology request. Body is the JSON of
+// an InputData written as a Go text/template; it is expanded with the
+// parameters given at reservation time, e.g. "speed": "{{.speed}}".
+type TopologyTemplate struct {
+	Name        string                   `json:"name"`
+	Version     int                      `json:"version"`
+	Description string                   `json:"description,omitempty"`
+	Params      map[string]TemplateParam `json:"params,omitempty"`
+	Body        string                   `json:"body"`
+	Created     time.Time                `json:"created"`
+}
+
+// TemplateParam describes a template parameter. A parameter without a default
+// must be given by every request using the template.
+type TemplateParam struct {
+	Description string `json:"description,omitempty"`
+	Default     string `json:"default,omitempty"`
+}
+
+// Bounds of template expansion, so that parameters cannot exhaust memory.
+const (
+	// maxSeq is the longest sequence seq builds.
+	maxSeq = 1024
+	// maxExpansion is the largest request, in bytes, a template expands to.
+	maxExpansion = 1 << 20
+)
+
+// templateFuncs are available to template bodies, e.g. to build a ring:
+// {{range $i := seq .size}}...{{end}}
+var templateFuncs = template.FuncMap{
+	"seq": func(n interface{}) ([]int, error) {
+		count, err := templateInt(n)
+		if err != nil {
+			return nil, err
+		}
+		if count > maxSeq {
+			return nil, fmt.Errorf("seq %d is longer than %d", count, maxSeq)
+		}
+		s := []int{}
+		for i := 1; i <= count; i++ {
+			s = append(s, i)
+		}
+		return s, nil
+	},
+	"add": func(a, b interface{}) (int, error) {
+		x, y, err := templateInts(a, b)
+		return x + y, err
+	},
+	"mod": func(a, b interface{}) (int, error) {
+		x, y, err := templateInts(a, b)
+		if err != nil {
+			return 0, err
+		}
+		if y == 0 {
+			return 0, fmt.Errorf("mod by zero")
+		}
+		return x % y, nil
+	},
+}
+
+// templateInt converts an argument of a template function to a number. The
+// parameters of a template are strings, while seq gives numbers.
+func templateInt(v interface{}) (int, error) {
+	n, err := strconv.Atoi(fmt.Sprint(v))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a whole number", fmt.Sprint(v))
+	}
+	return n, nil
+}
+
+func templateInts(a, b interface{}) (int, int, error) {
+	x, err := templateInt(a)
+	if err != nil {
+		return 0, 0, err
+	}
+	y, err := templateInt(b)
+	return x, y, err
+}
+
+// jsonEscape escapes a parameter value as the content of a JSON string, so
+// that it cannot end the string it is written in or add fields.
+func jsonEscape(v string) string {
+	quoted, _ := json.Marshal(v)
+	return string(quoted[1 : len(quoted)-1])
+}
+
+// limitedBuffer is a buffer failing writes beyond its limit.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		return 0, fmt.Errorf("expands to more than %d bytes", b.limit)
+	}
+	return b.Buffer.Write(p)
+}
+
+// Expand renders the template with params, falling back to parameter
+// defaults, and decodes the result into a topology request. Values are
+// JSON-escaped, they are meant to be written in strings or as numbers.
+func (t TopologyTemplate) Expand(params map[string]interface{}) (InputData, error) {
+	values := map[string]string{}
+	for name, param := range t.Params {
+		if v, ok := params[name]; ok {
+			values[name] = jsonEscape(fmt.Sprint(v))
+		} else if param.Default != "" {
+			values[name] = jsonEscape(param.Default)
+		} else {
+			return InputData{}, fmt.Errorf("template %q: missing parameter %q", t.Name, name)
+		}
+	}
+	for name := range params {
+		if _, ok := t.Params[name]; !ok {
+			return InputData{}, fmt.Errorf("template %q: unknown parameter %q", t.Name, name)
+		}
+	}
+
+	tmpl, err := template.New(t.Name).Funcs(templateFuncs).Option("missingkey=error").Parse(t.Body)
+	if err != nil {
+		return InputData{}, fmt.Errorf("template %q: %v", t.Name, err)
+	}
+	buf := limitedBuffer{limit: maxExpansion}
+	if err := tmpl.Execute(&buf, values); err != nil {
+		return InputData{}, fmt.Errorf("template %q: %v", t.Name, err)
+	}
+	data := InputData{}
+	if err := json.Unmarshal(buf.Bytes(), &data); err != nil {
+		return InputData{}, fmt.Errorf("template %q does not expand to a valid request: %v", t.Name, err)
+	}
+	return data, nil
+}
+
+// templateStore keeps every version of every template and persists them to a
+// JSON file.
+type templateStore struct {
+	mu        sync.Mutex
+	path      string
+	templates map[string][]TopologyTemplate
+}
+
+func newTemplateStore(path string) (*templateStore, error) {
+	s := &templateStore{path: path, templates: map[string][]TopologyTemplate{}}
+	jsonData, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(jsonData, &s.templates); err != nil {
+		return nil, fmt.Errorf("reading templates from %s: %v", path, err)
+	}
+	return s, nil
+}
+
+func (s *templateStore) save() error {
+	content, err := json.MarshalIndent(s.templates, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, content, 0644)
+}
+
+// get returns the given version of a template, or the latest if version is 0.
+func (s *templateStore) get(name string, version int) (TopologyTemplate, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions := s.templates[name]
+	if len(versions) == 0 {
+		return TopologyTemplate{}, false
+	}
+	if version == 0 {
+		return versions[len(versions)-1], true
+	}
+	for _, t := range versions {
+		if t.Version == version {
+			return t, true
+		}
+	}
+	return TopologyTemplate{}, false
+}
+
+// Errors of templateStore.put.
+var (
+	errTemplateExists   = errors.New("template already exists")
+	errTemplateNotFound = errors.New("template not found")
+)
+
+// put stores t as the next version of its template. A template is created
+// when create is set, and fails with errTemplateExists if it exists already;
+// otherwise it is updated, and fails with errTemplateNotFound if missing.
+func (s *templateStore) put(t TopologyTemplate, create bool) (TopologyTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions := s.templates[t.Name]
+	switch {
+	case create && len(versions) > 0:
+		return TopologyTemplate{}, errTemplateExists
+	case !create && len(versions) == 0:
+		return TopologyTemplate{}, errTemplateNotFound
+	}
+	t.Version = 1
+	if len(versions) > 0 {
+		t.Version = versions[len(versions)-1].Version + 1
+	}
+	t.Created = time.Now()
+	s.templates[t.Name] = append(versions, t)
+	if err := s.save(); err != nil {
+		s.templates[t.Name] = versions
+		return TopologyTemplate{}, err
+	}
+	return t, nil
+}
+
+func (s *templateStore) remove(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions, ok := s.templates[name]
+	if !ok {
+		return false, nil
+	}
+	delete(s.templates, name)
+	if err := s.save(); err != nil {
+		s.templates[name] = versions
+		return true, err
+	}
+	return true, nil
+}
+
+func (s *templateStore) latest() []TopologyTemplate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []TopologyTemplate{}
+	for _, versions := range s.templates {
+		list = append(list, versions[len(versions)-1])
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (s *templateStore) versions(name string) []TopologyTemplate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]TopologyTemplate{}, s.templates[name]...)
+}
+
+// checkTemplate verifies that a template parses and, when every parameter
+// has a default, that it expands to a valid request.
+func checkTemplate(t TopologyTemplate) error {
+	if t.Name == "" {
+		return fmt.Errorf("template name is required")
+	}
+	if _, err := template.New(t.Name).Funcs(templateFuncs).Parse(t.Body); err != nil {
+		return err
+	}
+	for _, param := range t.Params {
+		if param.Default == "" {
+			return nil
+		}
+	}
+	data, err := t.Expand(nil)
+	if err != nil {
+		return err
+	}
+	if errs := data.Validate(); len(errs) > 0 {
+		return fmt.Errorf("template expands to an invalid request: %v", errs)
+	}
+	return nil
+}
+
+func listTemplates(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, templates.latest())
+}
+
+func getTemplate(c *gin.Context) {
+	version := 0
+	if v := c.Query("version"); v != "" {
+		var err error
+		if version, err = strconv.Atoi(v); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "version must be a number"})
+			return
+		}
+	}
+	t, ok := templates.get(c.Param("name"), version)
+	if !ok {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("template %q not found", c.Param("name"))})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, t)
+}
+
+func listTemplateVersions(c *gin.Context) {
+	versions := templates.versions(c.Param("name"))
+	if len(versions) == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("template %q not found", c.Param("name"))})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, versions)
+}
+
+func createTemplate(c *gin.Context) {
+	t := TopologyTemplate{}
+	if err := c.BindJSON(&t); err != nil {
+		return
+	}
+	storeTemplate(c, t, true)
+}
+
+func updateTemplate(c *gin.Context) {
+	t := TopologyTemplate{}
+	if err := c.BindJSON(&t); err != nil {
+		return
+	}
+	t.Name = c.Param("name")
+	storeTemplate(c, t, false)
+}
+
+// storeTemplate creates a template, or updates it when create is false.
+func storeTemplate(c *gin.Context, t TopologyTemplate, create bool) {
+	if err := checkTemplate(t); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	stored, err := templates.put(t, create)
+	switch {
+	case err == errTemplateExists:
+		c.IndentedJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("template %q already exists", t.Name)})
+	case err == errTemplateNotFound:
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("template %q not found", t.Name)})
+	case err != nil:
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case create:
+		c.IndentedJSON(http.StatusCreated, stored)
+	default:
+		c.IndentedJSON(http.StatusOK, stored)
+	}
+}
+
+func deleteTemplate(c *gin.Context) {
+	found, err := templates.remove(c.Param("name"))
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !found {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("template %q not found", c.Param("name"))})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
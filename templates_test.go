@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ring is a template of a ring of devices, numbered from 1.
+var ring = TopologyTemplate{
+	Name: "ring",
+	Params: map[string]TemplateParam{
+		"size":   {Default: "3"},
+		"vendor": {Default: "A"},
+	},
+	Body: `{"devices": [{{range $i := seq .size}}{{if gt $i 1}},{{end}}
+		{"name": "d{{$i}}", "vendor": "{{$.vendor}}", "interfaces": [{"name": "next"}, {"name": "prev"}]}{{end}}],
+	"links": [{{range $i := seq .size}}{{if gt $i 1}},{{end}}
+		{"src": "d{{$i}}:next", "dst": "d{{add (mod $i $.size) 1}}:prev"}{{end}}]}`,
+}
+
+func TestTemplateExpand(t *testing.T) {
+	for _, params := range []map[string]interface{}{
+		{"size": "4"},
+		// Numbers of a JSON request are decoded as float64.
+		{"size": 4.0},
+	} {
+		data, err := ring.Expand(params)
+		if err != nil {
+			t.Fatalf("Expand(%v) error: %v", params, err)
+		}
+		links := []string{}
+		for _, link := range data.Links {
+			links = append(links, link.Src.String()+"-"+link.Dst.String())
+		}
+		if want := "[d1:next-d2:prev d2:next-d3:prev d3:next-d4:prev d4:next-d1:prev]"; len(data.Devices) != 4 || fmt.Sprint(links) != want {
+			t.Errorf("Expand(%v) = %d devices linked %v, want 4 linked %s", params, len(data.Devices), links, want)
+		}
+	}
+
+	// Parameters cannot end the string they are written in.
+	vendor := `A", "model": "B`
+	data, err := ring.Expand(map[string]interface{}{"vendor": vendor})
+	if err != nil {
+		t.Fatalf("Expand() error: %v", err)
+	}
+	if len(data.Devices) != 3 || data.Devices[0].Vendor != vendor || data.Devices[0].Model != "" {
+		t.Errorf("Expand() with vendor %q = %+v, want 3 devices of that vendor", vendor, data.Devices)
+	}
+
+	for _, tc := range []struct {
+		params map[string]interface{}
+		err    string
+	}{
+		{map[string]interface{}{"color": "red"}, `unknown parameter "color"`},
+		{map[string]interface{}{"size": "three"}, "not a whole number"},
+		{map[string]interface{}{"size": maxSeq + 1}, "longer than"},
+	} {
+		if _, err := ring.Expand(tc.params); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Expand(%v) error = %v, want %q", tc.params, err, tc.err)
+		}
+	}
+	withoutDefault := ring
+	withoutDefault.Params = map[string]TemplateParam{"size": {}, "vendor": {}}
+	if _, err := withoutDefault.Expand(map[string]interface{}{"size": 3}); err == nil || !strings.Contains(err.Error(), `missing parameter "vendor"`) {
+		t.Errorf("Expand() without vendor error = %v, want it missing", err)
+	}
+}
+
+func TestTemplateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "templates.json")
+	store, err := newTemplateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.put(ring, false); err != errTemplateNotFound {
+		t.Errorf("updating a missing template: error = %v, want %v", err, errTemplateNotFound)
+	}
+	if v1, err := store.put(ring, true); err != nil || v1.Version != 1 {
+		t.Fatalf("creating a template = version %d, %v, want version 1", v1.Version, err)
+	}
+	if _, err := store.put(ring, true); err != errTemplateExists {
+		t.Errorf("creating a template twice: error = %v, want %v", err, errTemplateExists)
+	}
+	bigger := ring
+	bigger.Params = map[string]TemplateParam{"size": {Default: "8"}, "vendor": {Default: "A"}}
+	if v2, err := store.put(bigger, false); err != nil || v2.Version != 2 {
+		t.Fatalf("updating a template = version %d, %v, want version 2", v2.Version, err)
+	}
+
+	// Every version is kept, and persisted.
+	reopened, err := newTemplateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*templateStore{store, reopened} {
+		latest, ok := s.get("ring", 0)
+		first, firstOK := s.get("ring", 1)
+		if !ok || latest.Version != 2 || latest.Params["size"].Default != "8" || !firstOK || first.Params["size"].Default != "3" {
+			t.Errorf("got versions %d and %d, want 2 of size 8 and 1 of size 3", latest.Version, first.Version)
+		}
+		if _, ok := s.get("ring", 3); ok {
+			t.Error("got version 3 of a template with 2 versions")
+		}
+	}
+
+	if found, err := store.remove("ring"); !found || err != nil {
+		t.Fatalf("remove() = %v, %v, want the template removed", found, err)
+	}
+	if reopened, err = newTemplateStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if list := reopened.latest(); len(list) != 0 {
+		t.Errorf("store still holds %v after the template was removed", list)
+	}
+}
@@ -0,0 +1,157 @@
+// Package utilization records when devices and ports were reserved, and
+// reports how busy the inventory was over a time range.
+package utilization
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Interval is a device, and some of its ports, held by a reservation from
+// Start to End.
+type Interval struct {
+	Reservation string    `json:"reservation"`
+	User        string    `json:"user,omitempty"`
+	Team        string    `json:"team,omitempty"`
+	Device      string    `json:"device"`
+	Type        string    `json:"type,omitempty"`
+	Vendor      string    `json:"vendor,omitempty"`
+	Ports       []string  `json:"ports,omitempty"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+}
+
+// History is a file of the intervals of released reservations, one JSON
+// object per line. When each device was last used is kept in memory, so that
+// reports need not read the whole file for it.
+type History struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	lastUsed map[string]time.Time
+	latest   time.Time
+}
+
+// OpenHistory opens the history at path, creating it if needed, and reads
+// when its devices were last used.
+func OpenHistory(path string) (*History, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	h := &History{path: path, file: file, lastUsed: map[string]time.Time{}}
+	err = h.scan(func(i Interval) {
+		h.used(i)
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// used records the end of an interval as the last use of its device if it is
+// the latest. The caller must hold h.mu, or be the only user of h.
+func (h *History) used(i Interval) {
+	if i.End.After(h.lastUsed[i.Device]) {
+		h.lastUsed[i.Device] = i.End
+	}
+	if i.End.After(h.latest) {
+		h.latest = i.End
+	}
+}
+
+// Append records intervals.
+func (h *History) Append(intervals []Interval) error {
+	content := []byte{}
+	for _, i := range intervals {
+		line, err := json.Marshal(i)
+		if err != nil {
+			return err
+		}
+		content = append(append(content, line...), '\n')
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.file.Write(content); err != nil {
+		return err
+	}
+	for _, i := range intervals {
+		h.used(i)
+	}
+	return nil
+}
+
+// LastUsed returns when devices were last used before to. The history is
+// only read again for a to earlier than the last recorded use.
+func (h *History) LastUsed(to time.Time) (map[string]time.Time, error) {
+	h.mu.Lock()
+	if !h.latest.After(to) {
+		lastUsed := make(map[string]time.Time, len(h.lastUsed))
+		for device, t := range h.lastUsed {
+			lastUsed[device] = t
+		}
+		h.mu.Unlock()
+		return lastUsed, nil
+	}
+	h.mu.Unlock()
+	lastUsed := map[string]time.Time{}
+	err := h.scan(func(i Interval) {
+		if !i.Start.Before(to) {
+			return
+		}
+		end := i.End
+		if end.After(to) {
+			end = to
+		}
+		if end.After(lastUsed[i.Device]) {
+			lastUsed[i.Device] = end
+		}
+	})
+	return lastUsed, err
+}
+
+// Overlapping returns the recorded intervals overlapping from to to.
+func (h *History) Overlapping(from, to time.Time) ([]Interval, error) {
+	intervals := []Interval{}
+	err := h.scan(func(i Interval) {
+		if i.Start.Before(to) && i.End.After(from) {
+			intervals = append(intervals, i)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return intervals, nil
+}
+
+// scan calls each with the recorded intervals, oldest first. Intervals
+// appended meanwhile are not scanned.
+func (h *History) scan(each func(Interval)) error {
+	h.mu.Lock()
+	info, err := h.file.Stat()
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(io.LimitReader(file, info.Size()))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		i := Interval{}
+		if err := json.Unmarshal(scanner.Bytes(), &i); err != nil {
+			return fmt.Errorf("%s:%d: %v", h.path, line, err)
+		}
+		each(i)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,61 @@
+package utilization
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage_history.jsonl")
+	h, err := OpenHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Append([]Interval{interval("r1", "core", "d1", 0, 2), interval("r1", "core", "d2", 0, 2)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Append([]Interval{interval("r2", "core", "d1", 5, 8)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		from, to float64
+		want     int
+	}{
+		{-1, 10, 3},
+		{1, 6, 3},
+		// Intervals ending at from or starting at to do not overlap
+		{2, 5, 0},
+		{6, 7, 1},
+	} {
+		intervals, err := h.Overlapping(at(tc.from), at(tc.to))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(intervals) != tc.want {
+			t.Errorf("Overlapping(%v, %v) = %d intervals, want %d", tc.from, tc.to, len(intervals), tc.want)
+		}
+	}
+
+	// Reopened, the history knows again when devices were last used
+	h, err = OpenHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		to     float64
+		d1, d2 time.Time
+	}{
+		{10, at(8), at(2)},
+		{6, at(6), at(2)},
+		{1, at(1), at(1)},
+	} {
+		lastUsed, err := h.LastUsed(at(tc.to))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !lastUsed["d1"].Equal(tc.d1) || !lastUsed["d2"].Equal(tc.d2) {
+			t.Errorf("LastUsed(%v) = %v, want d1 %v and d2 %v", tc.to, lastUsed, tc.d1, tc.d2)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package utilization
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Device is an inventory device reported on.
+type Device struct {
+	Name   string
+	Type   string
+	Vendor string
+	Ports  int
+}
+
+// Report is the utilization of the inventory from From to To. Percentages are
+// of the time in the range, or of the capacity of the devices for groups.
+type Report struct {
+	From    time.Time     `json:"from"`
+	To      time.Time     `json:"to"`
+	Peak    Peak          `json:"peak"`
+	Devices []DeviceUsage `json:"devices"`
+	Types   []GroupUsage  `json:"types"`
+	Teams   []GroupUsage  `json:"teams"`
+	Idle    []DeviceUsage `json:"idle"`
+}
+
+// Peak is the largest number of devices in use at the same time, first
+// reached at Time.
+type Peak struct {
+	Devices int        `json:"devices"`
+	Time    *time.Time `json:"time,omitempty"`
+}
+
+// DeviceUsage is how busy a device was. A device is busy while a reservation
+// holds it or any of its ports; PortUtilization averages the time each of its
+// ports was held.
+type DeviceUsage struct {
+	Device          string     `json:"device"`
+	Type            string     `json:"type,omitempty"`
+	Vendor          string     `json:"vendor,omitempty"`
+	Reservations    int        `json:"reservations"`
+	BusyHours       float64    `json:"busy_hours"`
+	Utilization     float64    `json:"utilization"`
+	PortUtilization float64    `json:"port_utilization"`
+	LastUsed        *time.Time `json:"last_used,omitempty"`
+}
+
+// GroupUsage is how busy the devices of a type, or the reservations of a
+// team, kept the inventory. For types, Utilization is of the devices of the
+// type, for teams of the whole inventory.
+type GroupUsage struct {
+	Name         string  `json:"name"`
+	Devices      int     `json:"devices"`
+	Reservations int     `json:"reservations"`
+	BusyHours    float64 `json:"busy_hours"`
+	Utilization  float64 `json:"utilization"`
+	Peak         int     `json:"peak"`
+}
+
+// span is a time interval.
+type span struct{ start, end time.Time }
+
+// merge sorts spans and merges the overlapping ones.
+func merge(spans []span) []span {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start.Before(spans[j].start) })
+	merged := []span{}
+	for _, s := range spans {
+		if n := len(merged); n > 0 && !s.start.After(merged[n-1].end) {
+			if s.end.After(merged[n-1].end) {
+				merged[n-1].end = s.end
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+func total(spans []span) time.Duration {
+	var d time.Duration
+	for _, s := range spans {
+		d += s.end.Sub(s.start)
+	}
+	return d
+}
+
+// peak returns the largest number of keys busy at the same time, and when it
+// was first reached.
+func peak(busy map[string][]span) Peak {
+	type change struct {
+		at    time.Time
+		delta int
+	}
+	changes := []change{}
+	for _, spans := range busy {
+		for _, s := range spans {
+			changes = append(changes, change{s.start, 1}, change{s.end, -1})
+		}
+	}
+	// Ends come first, a device handed from a reservation to the next one is
+	// not counted twice
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].at.Equal(changes[j].at) {
+			return changes[i].delta < changes[j].delta
+		}
+		return changes[i].at.Before(changes[j].at)
+	})
+	p := Peak{}
+	current := 0
+	for _, c := range changes {
+		current += c.delta
+		if current > p.Devices {
+			at := c.at
+			p = Peak{Devices: current, Time: &at}
+		}
+	}
+	return p
+}
+
+func hours(d time.Duration) float64 {
+	return math.Round(d.Hours()*100) / 100
+}
+
+func percent(part, whole time.Duration) float64 {
+	if whole <= 0 {
+		return 0
+	}
+	return math.Round(float64(part)/float64(whole)*10000) / 100
+}
+
+// Compute reports the utilization of devices from from to to. Intervals may
+// extend beyond the range, they are clipped to it; those ending before it
+// only tell when devices were last used, as lastUsed does for intervals left
+// out. Devices not in the inventory but in intervals are reported too.
+func Compute(devices []Device, intervals []Interval, lastUsed map[string]time.Time, from, to time.Time) Report {
+	length := to.Sub(from)
+	known := map[string]Device{}
+	for _, d := range devices {
+		known[d.Name] = d
+	}
+	deviceBusy := map[string][]span{}
+	portBusy := map[string]map[string][]span{}
+	teamBusy := map[string]map[string][]span{}
+	deviceReservations := map[string]map[string]bool{}
+	teamReservations := map[string]map[string]bool{}
+	used := map[string]time.Time{}
+	for device, t := range lastUsed {
+		if t.After(to) {
+			t = to
+		}
+		used[device] = t
+	}
+	lastUsed = used
+	for _, i := range intervals {
+		if !i.Start.Before(to) {
+			continue
+		}
+		if _, ok := known[i.Device]; !ok {
+			known[i.Device] = Device{Name: i.Device, Type: i.Type, Vendor: i.Vendor, Ports: len(i.Ports)}
+		}
+		end := i.End
+		if end.After(to) {
+			end = to
+		}
+		if end.After(lastUsed[i.Device]) {
+			lastUsed[i.Device] = end
+		}
+		start := i.Start
+		if start.Before(from) {
+			start = from
+		}
+		if !start.Before(end) {
+			continue
+		}
+		s := span{start, end}
+		deviceBusy[i.Device] = append(deviceBusy[i.Device], s)
+		if portBusy[i.Device] == nil {
+			portBusy[i.Device] = map[string][]span{}
+			deviceReservations[i.Device] = map[string]bool{}
+		}
+		for _, port := range i.Ports {
+			portBusy[i.Device][port] = append(portBusy[i.Device][port], s)
+		}
+		deviceReservations[i.Device][i.Reservation] = true
+		if teamBusy[i.Team] == nil {
+			teamBusy[i.Team] = map[string][]span{}
+			teamReservations[i.Team] = map[string]bool{}
+		}
+		teamBusy[i.Team][i.Device] = append(teamBusy[i.Team][i.Device], s)
+		teamReservations[i.Team][i.Reservation] = true
+	}
+
+	report := Report{From: from, To: to, Devices: []DeviceUsage{}, Types: []GroupUsage{}, Teams: []GroupUsage{}, Idle: []DeviceUsage{}}
+	types := map[string]*GroupUsage{}
+	typeBusy := map[string]map[string][]span{}
+	typeReservations := map[string]map[string]bool{}
+	typeTime := map[string]time.Duration{}
+	for name, d := range known {
+		busy := merge(deviceBusy[name])
+		deviceBusy[name] = busy
+		var portTime time.Duration
+		for _, spans := range portBusy[name] {
+			portTime += total(merge(spans))
+		}
+		usage := DeviceUsage{
+			Device:       name,
+			Type:         d.Type,
+			Vendor:       d.Vendor,
+			Reservations: len(deviceReservations[name]),
+			BusyHours:    hours(total(busy)),
+			Utilization:  percent(total(busy), length),
+		}
+		if d.Ports > 0 {
+			usage.PortUtilization = percent(portTime, length*time.Duration(d.Ports))
+		}
+		if t, ok := lastUsed[name]; ok {
+			usage.LastUsed = &t
+		}
+		report.Devices = append(report.Devices, usage)
+		if len(busy) == 0 {
+			report.Idle = append(report.Idle, usage)
+		}
+
+		group, ok := types[d.Type]
+		if !ok {
+			group = &GroupUsage{Name: d.Type}
+			types[d.Type] = group
+			typeBusy[d.Type] = map[string][]span{}
+			typeReservations[d.Type] = map[string]bool{}
+		}
+		group.Devices++
+		typeTime[d.Type] += total(busy)
+		typeBusy[d.Type][name] = busy
+		for id := range deviceReservations[name] {
+			typeReservations[d.Type][id] = true
+		}
+	}
+	for name, group := range types {
+		group.Reservations = len(typeReservations[name])
+		group.BusyHours = hours(typeTime[name])
+		group.Utilization = percent(typeTime[name], length*time.Duration(group.Devices))
+		group.Peak = peak(typeBusy[name]).Devices
+		report.Types = append(report.Types, *group)
+	}
+	for team, busy := range teamBusy {
+		var teamTime time.Duration
+		for device, spans := range busy {
+			busy[device] = merge(spans)
+			teamTime += total(busy[device])
+		}
+		report.Teams = append(report.Teams, GroupUsage{
+			Name:         team,
+			Devices:      len(busy),
+			Reservations: len(teamReservations[team]),
+			BusyHours:    hours(teamTime),
+			Utilization:  percent(teamTime, length*time.Duration(len(known))),
+			Peak:         peak(busy).Devices,
+		})
+	}
+	report.Peak = peak(deviceBusy)
+
+	sort.Slice(report.Devices, func(i, j int) bool { return report.Devices[i].Device < report.Devices[j].Device })
+	sort.Slice(report.Idle, func(i, j int) bool { return report.Idle[i].Device < report.Idle[j].Device })
+	sort.Slice(report.Types, func(i, j int) bool { return report.Types[i].Name < report.Types[j].Name })
+	sort.Slice(report.Teams, func(i, j int) bool { return report.Teams[i].Name < report.Teams[j].Name })
+	return report
+}
@@ -0,0 +1,257 @@
+package utilization
+
+import (
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// at returns the time h hours after t0.
+func at(h float64) time.Time {
+	return t0.Add(time.Duration(h * float64(time.Hour)))
+}
+
+func interval(reservation, team, device string, start, end float64, ports ...string) Interval {
+	return Interval{Reservation: reservation, Team: team, Device: device, Type: "DUT", Ports: ports, Start: at(start), End: at(end)}
+}
+
+var inventory = []Device{
+	{Name: "d1", Type: "DUT", Vendor: "ARISTA", Ports: 2},
+	{Name: "d2", Type: "DUT", Vendor: "CISCO", Ports: 2},
+	{Name: "a1", Type: "ATE", Vendor: "IXIA", Ports: 4},
+}
+
+func deviceUsage(r Report, name string) DeviceUsage {
+	for _, d := range r.Devices {
+		if d.Device == name {
+			return d
+		}
+	}
+	return DeviceUsage{}
+}
+
+func TestComputeDevices(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		intervals       []Interval
+		busyHours       float64
+		utilization     float64
+		portUtilization float64
+		reservations    int
+		lastUsed        time.Time
+	}{
+		{
+			name:      "idle",
+			intervals: nil,
+		},
+		{
+			name:        "inside",
+			intervals:   []Interval{interval("r1", "core", "d1", 2, 4, "e0")},
+			busyHours:   2,
+			utilization: 20,
+			// One port of two for 2 hours of 10
+			portUtilization: 10,
+			reservations:    1,
+			lastUsed:        at(4),
+		},
+		{
+			name:            "straddles from",
+			intervals:       []Interval{interval("r1", "core", "d1", -5, 1, "e0", "e1")},
+			busyHours:       1,
+			utilization:     10,
+			portUtilization: 10,
+			reservations:    1,
+			lastUsed:        at(1),
+		},
+		{
+			name:            "straddles to",
+			intervals:       []Interval{interval("r1", "core", "d1", 9, 20, "e0", "e1")},
+			busyHours:       1,
+			utilization:     10,
+			portUtilization: 10,
+			reservations:    1,
+			lastUsed:        at(10),
+		},
+		{
+			name:            "covers the range",
+			intervals:       []Interval{interval("r1", "core", "d1", -1, 11, "e0", "e1")},
+			busyHours:       10,
+			utilization:     100,
+			portUtilization: 100,
+			reservations:    1,
+			lastUsed:        at(10),
+		},
+		{
+			name:      "before the range",
+			intervals: []Interval{interval("r1", "core", "d1", -5, -2, "e0")},
+			lastUsed:  at(-2),
+		},
+		{
+			name:      "after the range",
+			intervals: []Interval{interval("r1", "core", "d1", 12, 14, "e0")},
+		},
+		{
+			name: "back to back",
+			intervals: []Interval{
+				interval("r1", "core", "d1", 0, 3, "e0"),
+				interval("r2", "perf", "d1", 3, 5, "e0"),
+			},
+			busyHours:       5,
+			utilization:     50,
+			portUtilization: 25,
+			reservations:    2,
+			lastUsed:        at(5),
+		},
+		{
+			name: "sharing ports",
+			intervals: []Interval{
+				interval("r1", "core", "d1", 0, 4, "e0"),
+				interval("r2", "perf", "d1", 2, 6, "e1"),
+			},
+			busyHours:   6,
+			utilization: 60,
+			// e0 4 hours and e1 4 hours of 2 ports for 10 hours
+			portUtilization: 40,
+			reservations:    2,
+			lastUsed:        at(6),
+		},
+	} {
+		r := Compute(inventory, tc.intervals, nil, at(0), at(10))
+		d := deviceUsage(r, "d1")
+		if d.BusyHours != tc.busyHours || d.Utilization != tc.utilization || d.PortUtilization != tc.portUtilization || d.Reservations != tc.reservations {
+			t.Errorf("%s: d1 usage %+v, want %v hours, %v%%, %v%% of ports, %d reservations", tc.name, d, tc.busyHours, tc.utilization, tc.portUtilization, tc.reservations)
+		}
+		switch {
+		case tc.lastUsed.IsZero() && d.LastUsed != nil:
+			t.Errorf("%s: d1 last used %v, want never", tc.name, d.LastUsed)
+		case !tc.lastUsed.IsZero() && (d.LastUsed == nil || !d.LastUsed.Equal(tc.lastUsed)):
+			t.Errorf("%s: d1 last used %v, want %v", tc.name, d.LastUsed, tc.lastUsed)
+		}
+		idle := false
+		for _, d := range r.Idle {
+			idle = idle || d.Device == "d1"
+		}
+		if idle != (tc.busyHours == 0) {
+			t.Errorf("%s: d1 idle %v, want %v", tc.name, idle, tc.busyHours == 0)
+		}
+	}
+}
+
+func TestComputePeak(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		intervals []Interval
+		want      int
+		wantAt    time.Time
+	}{
+		{name: "none", want: 0},
+		{
+			name: "handover",
+			intervals: []Interval{
+				interval("r1", "core", "d1", 0, 3),
+				interval("r2", "perf", "d1", 3, 5),
+			},
+			want: 1, wantAt: at(0),
+		},
+		{
+			name: "two devices handed over",
+			intervals: []Interval{
+				interval("r1", "core", "d1", 0, 3),
+				interval("r2", "core", "d2", 1, 3),
+				interval("r3", "perf", "d1", 3, 5),
+				interval("r4", "perf", "d2", 3, 5),
+			},
+			want: 2, wantAt: at(1),
+		},
+		{
+			name: "overlap",
+			intervals: []Interval{
+				interval("r1", "core", "d1", 0, 4),
+				interval("r2", "perf", "d2", 2, 6),
+				interval("r3", "perf", "a1", 3, 5),
+			},
+			want: 3, wantAt: at(3),
+		},
+		{
+			name:      "clipped at from",
+			intervals: []Interval{interval("r1", "core", "d1", -3, 2)},
+			want:      1, wantAt: at(0),
+		},
+	} {
+		p := Compute(inventory, tc.intervals, nil, at(0), at(10)).Peak
+		if p.Devices != tc.want || (tc.want > 0 && (p.Time == nil || !p.Time.Equal(tc.wantAt))) {
+			t.Errorf("%s: peak %d at %v, want %d at %v", tc.name, p.Devices, p.Time, tc.want, tc.wantAt)
+		}
+	}
+}
+
+func TestComputeGroups(t *testing.T) {
+	intervals := []Interval{
+		interval("r1", "core", "d1", 0, 5),
+		interval("r1", "core", "d2", 0, 5),
+		interval("r2", "perf", "d1", 5, 10),
+		{Reservation: "r2", Team: "perf", Device: "a1", Type: "ATE", Start: at(5), End: at(10)},
+	}
+	r := Compute(inventory, intervals, nil, at(0), at(10))
+	want := map[string]GroupUsage{
+		// 10 of 20 device hours
+		"DUT": {Name: "DUT", Devices: 2, Reservations: 2, BusyHours: 15, Utilization: 75, Peak: 2},
+		"ATE": {Name: "ATE", Devices: 1, Reservations: 1, BusyHours: 5, Utilization: 50, Peak: 1},
+	}
+	for _, g := range r.Types {
+		if g != want[g.Name] {
+			t.Errorf("type %s: %+v, want %+v", g.Name, g, want[g.Name])
+		}
+	}
+	// Of the 30 device hours of the inventory
+	wantTeams := map[string]GroupUsage{
+		"core": {Name: "core", Devices: 2, Reservations: 1, BusyHours: 10, Utilization: 33.33, Peak: 2},
+		"perf": {Name: "perf", Devices: 2, Reservations: 1, BusyHours: 10, Utilization: 33.33, Peak: 2},
+	}
+	if len(r.Teams) != 2 {
+		t.Fatalf("teams %+v, want core and perf", r.Teams)
+	}
+	for _, g := range r.Teams {
+		if g != wantTeams[g.Name] {
+			t.Errorf("team %s: %+v, want %+v", g.Name, g, wantTeams[g.Name])
+		}
+	}
+}
+
+func TestComputeLastUsedAndUnknownDevices(t *testing.T) {
+	lastUsed := map[string]time.Time{"d1": at(-24), "d2": at(30)}
+	intervals := []Interval{{Reservation: "r1", Device: "gone", Type: "DUT", Ports: []string{"e0"}, Start: at(1), End: at(2)}}
+	r := Compute(inventory, intervals, lastUsed, at(0), at(10))
+	if d := deviceUsage(r, "d1"); d.LastUsed == nil || !d.LastUsed.Equal(at(-24)) {
+		t.Errorf("d1 last used %v, want %v", d.LastUsed, at(-24))
+	}
+	// Uses after the range are clipped to it
+	if d := deviceUsage(r, "d2"); d.LastUsed == nil || !d.LastUsed.Equal(at(10)) {
+		t.Errorf("d2 last used %v, want %v", d.LastUsed, at(10))
+	}
+	if d := deviceUsage(r, "gone"); d.BusyHours != 1 || d.PortUtilization != 10 {
+		t.Errorf("device gone from the inventory: %+v, want 1 busy hour", d)
+	}
+	if len(r.Devices) != 4 || len(r.Idle) != 3 {
+		t.Errorf("%d devices, %d idle, want 4 and 3", len(r.Devices), len(r.Idle))
+	}
+}
+
+func TestTable(t *testing.T) {
+	r := Compute(inventory, []Interval{interval("r1", "core", "d1", 0, 5, "e0")}, nil, at(0), at(10))
+	rows, ok := r.Table("devices")
+	if !ok || len(rows) != 4 {
+		t.Fatalf("devices table %v, want a header and 3 rows", rows)
+	}
+	want := []string{"d1", "DUT", "ARISTA", "1", "5", "50", "25", at(5).Format(time.RFC3339)}
+	for i := range want {
+		if rows[2][i] != want[i] {
+			t.Errorf("row of d1 %v, want %v", rows[2], want)
+			break
+		}
+	}
+	if _, ok := r.Table("racks"); ok {
+		t.Error("unknown table found")
+	}
+}
@@ -0,0 +1,65 @@
+package utilization
+
+import (
+	"strconv"
+	"time"
+)
+
+// Tables are the parts of a report available as tables, e.g. for CSV.
+var Tables = []string{"devices", "types", "teams", "idle"}
+
+// Table returns a part of the report as rows, the first one naming the
+// columns, or false if there is no such table.
+func (r Report) Table(name string) ([][]string, bool) {
+	switch name {
+	case "devices":
+		return deviceRows(r.Devices), true
+	case "idle":
+		return deviceRows(r.Idle), true
+	case "types":
+		return groupRows("type", r.Types), true
+	case "teams":
+		return groupRows("team", r.Teams), true
+	}
+	return nil, false
+}
+
+func deviceRows(devices []DeviceUsage) [][]string {
+	rows := [][]string{{"device", "type", "vendor", "reservations", "busy_hours", "utilization", "port_utilization", "last_used"}}
+	for _, d := range devices {
+		lastUsed := ""
+		if d.LastUsed != nil {
+			lastUsed = d.LastUsed.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{
+			d.Device,
+			d.Type,
+			d.Vendor,
+			strconv.Itoa(d.Reservations),
+			formatFloat(d.BusyHours),
+			formatFloat(d.Utilization),
+			formatFloat(d.PortUtilization),
+			lastUsed,
+		})
+	}
+	return rows
+}
+
+func groupRows(kind string, groups []GroupUsage) [][]string {
+	rows := [][]string{{kind, "devices", "reservations", "busy_hours", "utilization", "peak"}}
+	for _, g := range groups {
+		rows = append(rows, []string{
+			g.Name,
+			strconv.Itoa(g.Devices),
+			strconv.Itoa(g.Reservations),
+			formatFloat(g.BusyHours),
+			formatFloat(g.Utilization),
+			strconv.Itoa(g.Peak),
+		})
+	}
+	return rows
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
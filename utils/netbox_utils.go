@@ -3,50 +3,88 @@ package utils
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	NETBOX_URL = "http://10.39.70.169:8000/api/"
-	TOKEN      = "53bccdc4d527945c9b24b0a5cc5a558e212b3def"
-	HEADERS    = "application/json"
+	HEADERS = "application/json"
 )
 
-var httpClient = &http.Client{}
+// netboxURL and netboxToken are set by Configure.
+var netboxURL string
+var netboxToken string
+
+// httpClient calls NetBox. Its timeout keeps a hung NetBox from blocking
+// device state changes forever.
+var httpClient = &http.Client{Timeout: 30 * time.Second}
 
 func createRequest(method, url string, body []byte) (*http.Request, error) {
 	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Token "+TOKEN)
+	req.Header.Set("Authorization", "Token "+netboxToken)
 	req.Header.Set("Content-Type", HEADERS)
 	return req, nil
 }
 
+// NetboxObserver is told of a NetBox API call: its method, its endpoint such
+// as "dcim/devices", its duration and its status code, 0 if it failed without
+// a response.
+type NetboxObserver func(method, endpoint string, d time.Duration, status int)
+
+var observer NetboxObserver
+
+// netboxEndpoint returns the endpoint of an API path, without the API root
+// and object IDs.
+func netboxEndpoint(path string) string {
+	if i := strings.Index(path, "/api/"); i >= 0 {
+		path = path[i+len("/api/"):]
+	}
+	segments := []string{}
+	for _, s := range strings.Split(path, "/") {
+		if _, err := strconv.Atoi(s); s != "" && err != nil {
+			segments = append(segments, s)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
 func performRequest(req *http.Request) (*http.Response, error) {
+	start := time.Now()
 	resp, err := httpClient.Do(req)
+	if observer != nil {
+		status := 0
+		if err == nil {
+			status = resp.StatusCode
+		}
+		observer(req.Method, netboxEndpoint(req.URL.Path), time.Since(start), status)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return resp, nil
 }
 
-func updateDevicesData(jsonFile string) {
+func updateDevicesData(jsonFile string) error {
 	// Read data from JSON file
 	jsonData, err := ioutil.ReadFile(jsonFile)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	var data map[string]interface{}
 	if err := json.Unmarshal(jsonData, &data); err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	deviceNames := []string{}
@@ -55,6 +93,10 @@ func updateDevicesData(jsonFile string) {
 		if v, ok := value.(map[string]interface{}); ok {
 			for _, v := range v {
 				if vv, ok := v.(map[string]interface{}); ok {
+					// Shareable devices remain available, only their ports are reserved
+					if attrs, ok := vv["attributes"].(map[string]interface{}); ok && attrs["sharing"] == "port-shareable" {
+						continue
+					}
 					if name, ok := vv["name"].(string); ok {
 						deviceNames = append(deviceNames, name)
 					}
@@ -63,86 +105,151 @@ func updateDevicesData(jsonFile string) {
 		}
 	}
 
-	client := httpClient
+	stateErr := SetDevicesState(deviceNames, StateReserved)
 
-	for _, deviceName := range deviceNames {
-		url := NETBOX_URL + "dcim/devices/?name=" + deviceName
-		req, err := createRequest("GET", url, nil)
+	// Check if the file exists before attempting to delete
+	if _, err := os.Stat(jsonFile); err == nil {
+		// Delete the file
+		err := os.Remove(jsonFile)
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("deleting file: %v", err)
 		}
+		log.Printf("File '%s' deleted successfully.\n", jsonFile)
+	} else {
+		log.Printf("File '%s' does not exist.\n", jsonFile)
+	}
+	return stateErr
+}
 
-		response, err := performRequest(req)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer response.Body.Close()
+// setDeviceState sets the State custom field of a NetBox device.
+func setDeviceState(deviceName, state string) error {
+	url := netboxURL + "dcim/devices/?name=" + deviceName
+	req, err := createRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
 
-		body, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			log.Fatal(err)
-		}
+	response, err := performRequest(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("looking up the device: status code %d", response.StatusCode)
+	}
 
-		var deviceDict map[string]interface{}
-		if err := json.Unmarshal(body, &deviceDict); err != nil {
-			log.Fatal(err)
-		}
+	var deviceDict struct {
+		Results []struct {
+			Name       string `json:"name"`
+			URL        string `json:"url"`
+			DeviceType struct {
+				ID int `json:"id"`
+			} `json:"device_type"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&deviceDict); err != nil {
+		return fmt.Errorf("looking up the device: %v", err)
+	}
+	if len(deviceDict.Results) == 0 || !strings.EqualFold(deviceDict.Results[0].Name, deviceName) {
+		return fmt.Errorf("device not found")
+	}
+	device := deviceDict.Results[0]
+	updateData := map[string]interface{}{
+		"name":          device.Name,
+		"device_type":   device.DeviceType.ID,
+		"custom_fields": map[string]interface{}{"State": state},
+	}
 
-		results := deviceDict["results"].([]interface{})
-		if len(results) > 0 {
-			deviceDict := results[0].(map[string]interface{})
-			if strings.ToLower(deviceDict["name"].(string)) == strings.ToLower(deviceName) {
-				deviceURL := deviceDict["url"].(string)
-				updateData := map[string]interface{}{
-					"name":          deviceDict["name"],
-					"device_type":   deviceDict["device_type"].(map[string]interface{})["id"],
-					"custom_fields": map[string]interface{}{"State": "Reserved"},
-				}
+	updateDataJSON, err := json.Marshal(updateData)
+	if err != nil {
+		return err
+	}
 
-				updateDataJSON, err := json.Marshal(updateData)
-				if err != nil {
-					log.Fatal(err)
-				}
+	req, err = createRequest("PATCH", device.URL, updateDataJSON)
+	if err != nil {
+		return err
+	}
 
-				req, err := http.NewRequest("PATCH", deviceURL, bytes.NewBuffer(updateDataJSON))
-				if err != nil {
-					log.Fatal(err)
-				}
-				req.Header.Set("Authorization", "Token "+TOKEN)
-				req.Header.Set("Content-Type", HEADERS)
+	response, err = performRequest(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
 
-				response, err := client.Do(req)
-				if err != nil {
-					log.Fatal(err)
-				}
-				defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("updating the device: status code %d", response.StatusCode)
+	}
+	return nil
+}
 
-				if response.StatusCode == http.StatusOK {
-					log.Println("Device details updated successfully!")
-				} else {
-					log.Printf("Error updating device details. Status code: %d\n", response.StatusCode)
-				}
-			} else {
-				log.Printf("Failed to find the device: %s\n", deviceName)
-			}
+// Device states of the State custom field.
+const (
+	StateAvailable   = "Available"
+	StateReserved    = "Reserved"
+	StateMaintenance = "Maintenance"
+	StateQuarantined = "Quarantined"
+	StateCleaning    = "Cleaning"
+)
+
+// ReleaseDevices marks devices as available again in NetBox.
+func ReleaseDevices(deviceNames []string) error {
+	return SetDevicesState(deviceNames, StateAvailable)
+}
+
+// pendingStates holds, by device, the states SetDevicesState failed to set
+// in NetBox, until RetryDeviceStates sets them. stateMu serializes the state
+// changes, so that a failed change is never retried over a later one.
+var (
+	stateMu       sync.Mutex
+	pendingStates = map[string]string{}
+)
+
+// SetDevicesState sets the State custom field of devices in NetBox. The
+// states it fails to set are kept to be set again by RetryDeviceStates.
+func SetDevicesState(deviceNames []string, state string) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	errs := []error{}
+	for _, deviceName := range deviceNames {
+		if err := setDeviceState(deviceName, state); err != nil {
+			pendingStates[deviceName] = state
+			errs = append(errs, fmt.Errorf("setting %s to %s: %v", deviceName, state, err))
+			continue
 		}
+		delete(pendingStates, deviceName)
 	}
+	return errors.Join(errs...)
+}
 
-	// Check if the file exists before attempting to delete
-	if _, err := os.Stat(jsonFile); err == nil {
-		// Delete the file
-		err := os.Remove(jsonFile)
-		if err != nil {
-			log.Fatalf("Error deleting file: %v\n", err)
+// RetryDeviceStates sets again the states SetDevicesState failed to set.
+func RetryDeviceStates() error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	errs := []error{}
+	for deviceName, state := range pendingStates {
+		if err := setDeviceState(deviceName, state); err != nil {
+			errs = append(errs, fmt.Errorf("setting %s to %s: %v", deviceName, state, err))
+			continue
 		}
-		log.Printf("File '%s' deleted successfully.\n", jsonFile)
-	} else {
-		log.Printf("File '%s' does not exist.\n", jsonFile)
+		delete(pendingStates, deviceName)
 	}
+	return errors.Join(errs...)
+}
+
+// PendingDeviceStates returns the device states that are not yet set in
+// NetBox, by device.
+func PendingDeviceStates() map[string]string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	pending := make(map[string]string, len(pendingStates))
+	for deviceName, state := range pendingStates {
+		pending[deviceName] = state
+	}
+	return pending
 }
 
 func getDeviceDetails(deviceName string) map[string]interface{} {
-	url := fmt.Sprintf("%sdcim/devices/?name=%s", NETBOX_URL, deviceName)
+	url := fmt.Sprintf("%sdcim/devices/?name=%s", netboxURL, deviceName)
 	req, err := createRequest("GET", url, nil)
 	if err != nil {
 		log.Fatal(err)
@@ -166,7 +273,7 @@ func getDeviceDetails(deviceName string) map[string]interface{} {
 }
 
 func getDevicesDetails() []string {
-	url := fmt.Sprintf("%sdcim/devices", NETBOX_URL)
+	url := fmt.Sprintf("%sdcim/devices", netboxURL)
 	req, err := createRequest("GET", url, nil)
 	if err != nil {
 		log.Fatal(err)
@@ -194,7 +301,7 @@ func getDevicesDetails() []string {
 }
 
 func getInterfacesDetails() []map[string]interface{} {
-	url := fmt.Sprintf("%sdcim/interfaces", NETBOX_URL)
+	url := fmt.Sprintf("%sdcim/interfaces", netboxURL)
 	req, err := createRequest("GET", url, nil)
 	if err != nil {
 		log.Fatal(err)
@@ -244,11 +351,19 @@ func getDevicesData() []byte {
 							iface["speed"] = "speed_400_gbps"
 						}
 					}
+					attributes := map[string]interface{}{
+						"speed": iface["speed"],
+					}
+					// The module an interface sits on identifies its line card
+					if module, ok := iface["module"].(map[string]interface{}); ok {
+						attributes["linecard"] = module["display"]
+					}
+					if customFields, ok := iface["custom_fields"].(map[string]interface{}); ok && customFields["Cost"] != nil {
+						attributes["cost"] = fmt.Sprint(customFields["Cost"])
+					}
 					interfaceDict = append(interfaceDict, map[string]interface{}{
-						"name": iface["name"],
-						"attributes": map[string]interface{}{
-							"speed": iface["speed"],
-						},
+						"name":       iface["name"],
+						"attributes": attributes,
 					})
 				}
 			}
@@ -271,6 +386,14 @@ func getDevicesData() []byte {
 				"DeviceType":   deviceDetails["device_type"].(map[string]interface{})["model"],
 				"Manufacturer": deviceDetails["device_type"].(map[string]interface{})["manufacturer"].(map[string]interface{})["name"],
 				"State":        deviceDetails["custom_fields"].(map[string]interface{})["State"],
+				"Cost":         deviceDetails["custom_fields"].(map[string]interface{})["Cost"],
+				"Site":         nestedName(deviceDetails["site"]),
+				"Location":     nestedName(deviceDetails["location"]),
+				"Rack":         nestedName(deviceDetails["rack"]),
+				"Chassis":      chassisName(deviceDetails),
+				"PowerStrip":   deviceDetails["custom_fields"].(map[string]interface{})["PowerStrip"],
+				"Sharing":      deviceDetails["custom_fields"].(map[string]interface{})["Sharing"],
+				"Services":     deviceServices(deviceDetails),
 				"interfaces":   interfaceDict,
 			}
 			listOfDeviceDicts = append(listOfDeviceDicts, deviceData)
@@ -286,6 +409,85 @@ func getDevicesData() []byte {
 	return result
 }
 
+// servicePortFields are the custom fields giving the ports of the management
+// services of a device. A port of 0 leaves the service out.
+var servicePortFields = map[string]string{
+	"gnmi": "GNMIPort",
+	"otg":  "OTGPort",
+	"ssh":  "SSHPort",
+}
+
+// defaultServicePorts are the ports of the management services of devices
+// without a custom field for them, by device type: gNMI and SSH on DUTs, the
+// OTG API on traffic generators.
+var defaultServicePorts = map[string]map[string]int{
+	"DUT":  {"gnmi": 9339, "ssh": 22},
+	"ATE":  {"otg": 8443},
+	"TGEN": {"otg": 8443},
+}
+
+// deviceServices returns the management services of a NetBox device. They
+// listen on its ManagementAddress custom field, or else on its primary IP;
+// a device without either has none.
+func deviceServices(deviceDetails map[string]interface{}) []map[string]interface{} {
+	services := []map[string]interface{}{}
+	customFields, _ := deviceDetails["custom_fields"].(map[string]interface{})
+	address, _ := customFields["ManagementAddress"].(string)
+	if ip, ok := deviceDetails["primary_ip"].(map[string]interface{}); ok && address == "" {
+		address, _ = ip["address"].(string)
+	}
+	// Addresses of IPs come with their prefix length
+	address = strings.SplitN(address, "/", 2)[0]
+	if address == "" {
+		return services
+	}
+	family := "ipv4"
+	if strings.Contains(address, ":") {
+		family = "ipv6"
+	}
+	deviceType := ""
+	if dt, ok := deviceDetails["device_type"].(map[string]interface{}); ok {
+		deviceType, _ = dt["model"].(string)
+	}
+	for _, name := range []string{"gnmi", "otg", "ssh"} {
+		port := defaultServicePorts[strings.ToUpper(deviceType)][name]
+		if v, ok := customFields[servicePortFields[name]].(float64); ok {
+			port = int(v)
+		}
+		if port == 0 {
+			continue
+		}
+		services = append(services, map[string]interface{}{
+			"name":           name,
+			"address_family": family,
+			"address":        address,
+			"protocol":       "tcp",
+			"port":           port,
+		})
+	}
+	return services
+}
+
+// nestedName returns the name of a nested NetBox object such as a device's
+// site or rack, or "" when it is not set.
+func nestedName(v interface{}) string {
+	if obj, ok := v.(map[string]interface{}); ok {
+		if name, ok := obj["name"].(string); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// chassisName returns the virtual chassis of a device, or else the parent
+// device it is installed in.
+func chassisName(deviceDetails map[string]interface{}) string {
+	if name := nestedName(deviceDetails["virtual_chassis"]); name != "" {
+		return name
+	}
+	return nestedName(deviceDetails["parent_device"])
+}
+
 func getDevicesLinks() []byte {
 	interfaceDetails := getInterfacesDetails()
 
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDeviceServices(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		device string
+		want   []map[string]interface{}
+	}{
+		{
+			name:   "DUT with a primary IP",
+			device: `{"device_type": {"model": "DUT"}, "primary_ip": {"address": "192.0.2.1/24"}, "custom_fields": {}}`,
+			want: []map[string]interface{}{
+				{"name": "gnmi", "address_family": "ipv4", "address": "192.0.2.1", "protocol": "tcp", "port": 9339},
+				{"name": "ssh", "address_family": "ipv4", "address": "192.0.2.1", "protocol": "tcp", "port": 22},
+			},
+		},
+		{
+			name:   "ports and address from custom fields",
+			device: `{"device_type": {"model": "DUT"}, "primary_ip": {"address": "192.0.2.1/24"}, "custom_fields": {"ManagementAddress": "2001:db8::1", "GNMIPort": 6030, "SSHPort": 0}}`,
+			want: []map[string]interface{}{
+				{"name": "gnmi", "address_family": "ipv6", "address": "2001:db8::1", "protocol": "tcp", "port": 6030},
+			},
+		},
+		{
+			name:   "traffic generator",
+			device: `{"device_type": {"model": "TGEN"}, "primary_ip": {"address": "192.0.2.2/24"}, "custom_fields": {}}`,
+			want: []map[string]interface{}{
+				{"name": "otg", "address_family": "ipv4", "address": "192.0.2.2", "protocol": "tcp", "port": 8443},
+			},
+		},
+		{
+			name:   "no management address",
+			device: `{"device_type": {"model": "DUT"}, "primary_ip": null, "custom_fields": {"GNMIPort": 6030}}`,
+			want:   []map[string]interface{}{},
+		},
+	} {
+		var details map[string]interface{}
+		if err := json.Unmarshal([]byte(tc.device), &details); err != nil {
+			t.Fatal(err)
+		}
+		if got := deviceServices(details); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: deviceServices() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
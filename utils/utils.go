@@ -5,11 +5,38 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
+// Config tells how to reach NetBox and where the inventory files are kept.
+// Observer, if set, is told of every NetBox API call.
+type Config struct {
+	NetboxURL   string
+	NetboxToken string
+	DataDir     string
+	Observer    NetboxObserver
+}
+
+var dataDir = "."
+
+// Configure sets the NetBox endpoint and the data directory. It must be
+// called before any other function of the package.
+func Configure(c Config) {
+	netboxURL = strings.TrimSuffix(c.NetboxURL, "/") + "/"
+	netboxToken = c.NetboxToken
+	observer = c.Observer
+	if c.DataDir != "" {
+		dataDir = c.DataDir
+	}
+}
+
+// DataPath returns the path of a file of the data directory.
+func DataPath(name string) string {
+	return filepath.Join(dataDir, name)
+}
+
 type Interface struct {
 	Name   string `json:"name"`
 	Speed  int    `json:"speed"`
@@ -26,6 +53,7 @@ type Device struct {
 	Name       string        `json:"name"`
 	State      string        `json:"state"`
 	Attributes Attributes    `json:"attributes"`
+	Services   []interface{} `json:"services,omitempty"`
 	Interfaces []interface{} `json:"interfaces"`
 	// Add more fields as needed
 }
@@ -35,6 +63,16 @@ type Attributes struct {
 	// Add more fields as needed
 	Vendor string `json:"vendor"`
 	Type   string `json:"type"`
+	Cost   string `json:"cost,omitempty"`
+	// Location of the device, used by affinity rules
+	Site       string `json:"site,omitempty"`
+	Location   string `json:"location,omitempty"`
+	Rack       string `json:"rack,omitempty"`
+	Chassis    string `json:"chassis,omitempty"`
+	PowerStrip string `json:"power_strip,omitempty"`
+	// Sharing is "port-shareable" for devices whose ports can be reserved
+	// by different reservations, "exclusive" otherwise
+	Sharing string `json:"sharing,omitempty"`
 }
 
 // Dut represents the structure of the device under "duts" key
@@ -55,17 +93,14 @@ func (c *Counter) nextID() int {
 }
 
 // AddDevice adds a new device with interfaces and an auto-incrementing ID to the provided map
-func AddDevice(counter *Counter, devices map[int]Device, id float64, name, deviceType, state string, manufacturer string, interfaces []interface{}) map[int]Device {
+func AddDevice(counter *Counter, devices map[int]Device, id float64, name, state string, attributes Attributes, services, interfaces []interface{}) map[int]Device {
 	deviceID := counter.nextID()
 	devices[deviceID] = Device{
-		ID:    id,
-		Name:  name,
-		State: state,
-		Attributes: Attributes{
-			// Add inventory details here
-			Vendor: strings.ToUpper(manufacturer),
-			Type:   deviceType,
-		},
+		ID:         id,
+		Name:       name,
+		State:      state,
+		Attributes: attributes,
+		Services:   services,
 		Interfaces: interfaces,
 	}
 	return devices
@@ -87,13 +122,28 @@ func createInventory(listOfDicts []map[string]interface{}, linksOfDicts []map[st
 		manufacturer := dict["Manufacturer"].(string)
 		state := dict["State"].(string)
 		interfaces := dict["interfaces"].([]interface{})
+		services, _ := dict["Services"].([]interface{})
+		attributes := Attributes{
+			// Add inventory details here
+			Vendor: strings.ToUpper(manufacturer),
+			Type:   deviceType,
+		}
+		if cost, ok := dict["Cost"]; ok && cost != nil {
+			attributes.Cost = fmt.Sprint(cost)
+		}
+		attributes.Site, _ = dict["Site"].(string)
+		attributes.Location, _ = dict["Location"].(string)
+		attributes.Rack, _ = dict["Rack"].(string)
+		attributes.Chassis, _ = dict["Chassis"].(string)
+		attributes.PowerStrip, _ = dict["PowerStrip"].(string)
+		attributes.Sharing, _ = dict["Sharing"].(string)
 
 		idCounter := &Counter{}
 		if strings.ToLower(inventoryType) == "all" {
-			devices = AddDevice(idCounter, devices, id, name, deviceType, state, manufacturer, interfaces)
+			devices = AddDevice(idCounter, devices, id, name, state, attributes, services, interfaces)
 		} else {
 			if strings.ToLower(state) != "reserved" {
-				devices = AddDevice(idCounter, devices, id, name, deviceType, state, manufacturer, interfaces)
+				devices = AddDevice(idCounter, devices, id, name, state, attributes, services, interfaces)
 			} else {
 				devices = make(map[int]Device)
 			}
@@ -141,24 +191,20 @@ func FileExists(filePath string) (bool, error) {
 	return true, nil
 }
 
-func UpdateInventory() {
-	filePath := "output.json"
-	exists, err := FileExists(filePath)
-	if err != nil {
-		log.Fatal(err) // Log the error and terminate the program
+// UpdateInventory marks the devices of the testbed written to output.json
+// as reserved in NetBox.
+func UpdateInventory() error {
+	filePath := DataPath("output.json")
+	if _, err := FileExists(filePath); err != nil {
+		return err
 	}
-	if exists {
-		updateDevicesData(filePath)
-		if err != nil {
-			fmt.Println("Error executing Python script:", err)
-			return
-		} else {
-			fmt.Println("Device details updated successfully on Netbox as per testbed details.")
-		}
-	} else {
-		log.Fatal("Output file does not exist.")
+	if err := updateDevicesData(filePath); err != nil {
+		return err
 	}
+	fmt.Println("Device details updated successfully on Netbox as per testbed details.")
+	return nil
 }
+
 func GetCreateInvFromNetbox() {
 	output := getDevicesData()
 	var listOfDicts []map[string]interface{}
@@ -174,6 +220,6 @@ func GetCreateInvFromNetbox() {
 		fmt.Println("Error parsing JSON:", err)
 		return
 	}
-	createInventory(listOfDicts, linksOfDicts, "inventory_global.json", "all")
-	createInventory(listOfDicts, linksOfDicts, "inventory.json", "NA")
+	createInventory(listOfDicts, linksOfDicts, DataPath("inventory_global.json"), "all")
+	createInventory(listOfDicts, linksOfDicts, DataPath("inventory.json"), "NA")
 }
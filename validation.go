@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldError reports a problem with one field of a request. Field is a path
+// into the request body such as "devices[1].interfaces[0].name".
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is the list of problems found in a request.
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	msgs := []string{}
+	for _, e := range v {
+		msgs = append(msgs, e.Field+": "+e.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (v *ValidationErrors) add(field, format string, args ...interface{}) {
+	*v = append(*v, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks that the request describes a well formed topology: device
+// and interface names are present and unique, every link endpoint refers to an
+// interface of the request, no interface is used by more than one link, and
+// port wildcards and link groups connect two existing devices and ask for no
+// more ports than an inventory device has, and device groups name existing
+// devices.
+func (d InputData) Validate() ValidationErrors {
+	errs := ValidationErrors{}
+	maxPorts := maxDevicePorts()
+	if len(d.Devices) == 0 {
+		errs.add("devices", "topology has no devices")
+	}
+
+	devicePaths := map[string]string{}
+	for i, device := range d.Devices {
+		path := fmt.Sprintf("devices[%d]", i)
+		if device.Name == "" {
+			errs.add(path+".name", "device name is required")
+		} else if first, ok := devicePaths[device.Name]; ok {
+			errs.add(path+".name", "duplicate device name %q, first defined at %s", device.Name, first)
+		} else {
+			devicePaths[device.Name] = path
+		}
+
+		validatePreferences(&errs, path, device.Preferences)
+
+		intfPaths := map[string]string{}
+		for j, intf := range device.Interfaces {
+			intfPath := fmt.Sprintf("%s.interfaces[%d]", path, j)
+			validatePreferences(&errs, intfPath, intf.Preferences)
+			if intf.Name == "" {
+				errs.add(intfPath+".name", "interface name is required")
+			} else if first, ok := intfPaths[intf.Name]; ok {
+				errs.add(intfPath+".name", "duplicate interface name %q on device %q, first defined at %s", intf.Name, device.Name, first)
+			} else {
+				intfPaths[intf.Name] = intfPath
+			}
+		}
+
+		for k, wildcard := range device.AnyPorts {
+			wildcardPath := fmt.Sprintf("%s.any_ports[%d]", path, k)
+			if wildcard.Count < 1 {
+				errs.add(wildcardPath+".count", "wildcard needs at least one port")
+			}
+			if wildcard.Count > maxPorts {
+				errs.add(wildcardPath+".count", "wildcard asks for %d ports, more than the %d ports of the largest inventory device", wildcard.Count, maxPorts)
+				continue
+			}
+			for i := 0; i < wildcard.Count; i++ {
+				if first, ok := intfPaths[wildcardPortName(k, i)]; ok {
+					errs.add(wildcardPath, "wildcard port %q clashes with interface %s", wildcardPortName(k, i), first)
+				}
+			}
+			if wildcard.ConnectedTo == "" {
+				continue
+			}
+			peer, ok := findInputDevice(d, wildcard.ConnectedTo)
+			if !ok {
+				errs.add(wildcardPath+".connected_to", "device %q not found", wildcard.ConnectedTo)
+			} else if peer.Name == device.Name {
+				errs.add(wildcardPath+".connected_to", "wildcard ports cannot connect to their own device")
+			}
+		}
+	}
+
+	portUsers := map[string]string{}
+	for i, link := range d.Links {
+		for _, end := range []struct {
+			field string
+			ep    Endpoint
+		}{{"src", link.Src}, {"dst", link.Dst}} {
+			path := fmt.Sprintf("links[%d].%s", i, end.field)
+			ep, err := resolveEndpoint(d, end.ep)
+			if err != nil {
+				errs.add(path, "%v", err)
+				continue
+			}
+			if first, ok := portUsers[ep.String()]; ok {
+				errs.add(path, "port %q is already used by %s", ep.String(), first)
+				continue
+			}
+			portUsers[ep.String()] = path
+		}
+	}
+
+	groupPaths := map[string]string{}
+	for i, group := range d.LinkGroups {
+		path := fmt.Sprintf("link_groups[%d]", i)
+		if group.Name == "" {
+			errs.add(path+".name", "link group name is required")
+		} else if first, ok := groupPaths[group.Name]; ok {
+			errs.add(path+".name", "duplicate link group name %q, first defined at %s", group.Name, first)
+		} else {
+			groupPaths[group.Name] = path
+		}
+		if group.Count < 1 {
+			errs.add(path+".count", "link group needs at least one link")
+		}
+		if group.Count > maxPorts {
+			errs.add(path+".count", "link group asks for %d links, more than the %d ports of the largest inventory device", group.Count, maxPorts)
+			continue
+		}
+		if group.Src == group.Dst {
+			errs.add(path+".dst", "link group must connect two different devices")
+		}
+		for _, end := range []struct {
+			field  string
+			device string
+		}{{"src", group.Src}, {"dst", group.Dst}} {
+			device, ok := findInputDevice(d, end.device)
+			if !ok {
+				errs.add(path+"."+end.field, "device %q not found", end.device)
+				continue
+			}
+			for j := 0; j < group.Count; j++ {
+				for _, intf := range device.Interfaces {
+					if intf.Name == group.portName(j) {
+						errs.add(path+".name", "member port %q clashes with an interface of device %q", intf.Name, device.Name)
+					}
+				}
+			}
+		}
+	}
+
+	for i, group := range d.DeviceGroups {
+		path := fmt.Sprintf("device_groups[%d]", i)
+		if len(group.Devices) < 2 {
+			errs.add(path+".devices", "device group needs at least two devices")
+		}
+		members := map[string]bool{}
+		for j, dname := range group.Devices {
+			if _, ok := findInputDevice(d, dname); !ok {
+				errs.add(fmt.Sprintf("%s.devices[%d]", path, j), "device %q not found", dname)
+			} else if members[dname] {
+				errs.add(fmt.Sprintf("%s.devices[%d]", path, j), "device %q is listed twice", dname)
+			}
+			members[dname] = true
+		}
+		if group.Attribute == "" {
+			errs.add(path+".attribute", "device group attribute is required")
+		}
+		if group.Rule != ruleSame && group.Rule != ruleDifferent {
+			errs.add(path+".rule", "rule must be %q or %q", ruleSame, ruleDifferent)
+		}
+	}
+	return errs
+}
+
+func validatePreferences(errs *ValidationErrors, path string, prefs []Preference) {
+	for i, pref := range prefs {
+		if pref.Name == "" {
+			errs.add(fmt.Sprintf("%s.preferences[%d].name", path, i), "preference attribute name is required")
+		}
+		if pref.Weight < 0 {
+			errs.add(fmt.Sprintf("%s.preferences[%d].weight", path, i), "preference weight must not be negative")
+		}
+	}
+}
+
+func findInputDevice(d InputData, name string) (InputDevice, bool) {
+	for _, device := range d.Devices {
+		if device.Name == name {
+			return device, true
+		}
+	}
+	return InputDevice{}, false
+}
+
+// maxDevicePorts is the number of ports of the largest inventory device, the
+// most a request may ask of one device. The caller must not hold inventoryMu.
+func maxDevicePorts() int {
+	inventoryMu.RLock()
+	defer inventoryMu.RUnlock()
+	max := 0
+	for _, node := range inventory.Nodes {
+		if len(node.Ports) > max {
+			max = len(node.Ports)
+		}
+	}
+	return max
+}